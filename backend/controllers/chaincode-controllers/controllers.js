@@ -2,7 +2,8 @@ var invokesvc = require('../../services/Invokecc.js');
 var querysvc = require('../../services/Querycc.js');
 var queryqsvc = require('../../services/Queryqscc.js');
 var offchain = require('../../services/Offchain.js');
-var logger = require('../../services/utils/utils').getLogger("Chaincode-Controller");
+var utils = require('../../services/utils/utils');
+var logger = utils.getLogger("Chaincode-Controller");
 var User = require('../../services/models/inforUser')
 const uniqid = require('uniqid');
 //getErrorMessage: ham in thong tin loi
@@ -22,7 +23,7 @@ function getErrorMessage(field) {
 //create: Handler tiep nhan tac vu tao san pham
 //      Input: 
 //          tensanpham   : ten san pham tao ra
-//          thoigian     : thoi gian tao san pham
+//          thoigian     : bo qua, chaincode ghi thoi gian giao dich
 //          diadiem      : dia diem thuc hien tao san pham
 //          toado        : toa do dia diem tao san pham
 //          mota         : mo ta bo xung san pham
@@ -82,7 +83,7 @@ exports.create = async function(req, res, next) {
 //      Input: 
 //          id           : dinh danh san pham da ton tai
 //          tensanpham   : ten san pham tao ra
-//          thoigian     : thoi gian tao san pham
+//          thoigian     : bo qua, chaincode ghi thoi gian giao dich
 //          diadiem      : dia diem thuc hien tao san pham
 //          toado        : toa do dia diem tao san pham
 //          mota         : mo ta bo xung san pham
@@ -119,7 +120,7 @@ exports.update = async function (req, res, next) {
       message.message.descrip = await offchain.offChainRead(message.message.Value.FormIDMoiNhat);
     }
     var query =  await User.findOne({
-      'local.username':  message.message.Value.ThucHien
+      'local.username':  utils.getUsername(message.message.Value.ThucHien)
     },'local.displayname local.phonenumber local.address local.img.path').exec();
     message.message.profile = {
           displayname: query.local.displayname,
@@ -141,12 +142,12 @@ exports.update = async function (req, res, next) {
 //      Input: 
 //          id               : dinh danh san pham da ton tai
 //          tensanpham       : ten san pham tao ra
-//          thoigian         : thoi gian tao san pham
+//          thoigian         : bo qua, chaincode ghi thoi gian giao dich
 //          diadiem          : dia diem thuc hien tao san pham
 //          toado            : toa do dia diem tao san pham
 //          mota             : mo ta bo xung san pham
 //          trangthai        : trang thai hien tai cua san pham
-//          formIDmoinhat    : id form tren thiet bi di dong
+//          formIDmoinhat    : id form tren thiet bi di dong, minh chung phai duoc dang ky qua registerEvidence truoc
 //          danhsachmadonggoi: danh sach ma tem dong goi
 //          hoanthanhdonggoi : trang thai danh dau hoan thanh qua trinh
 //          soluong          : so luong duoc dong goi
@@ -190,7 +191,7 @@ exports.dongGoi = async function (req, res, next) {
     }
 
     var query =  await User.findOne({
-      'local.username':  message.message.Value.ThucHien
+      'local.username':  utils.getUsername(message.message.Value.ThucHien)
     },'local.displayname local.phonenumber local.address local.img.path').exec();
     message.message.profile = {
           displayname: query.local.displayname,
@@ -210,14 +211,15 @@ exports.dongGoi = async function (req, res, next) {
   }
 }
 
-//update: Handler tiep nhan tac vu thay doi trang thai san pham
+//transfer: Handler tiep nhan tac vu chuyen giao san pham (giu cho client cu)
+//      Tao de nghi chuyen giao toi thuchien, nguoi nhan xac nhan qua /contract/acceptTransfer
 //      Input: 
 //          id               : dinh danh san pham da ton tai
-//          tensanpham       : ten san pham tao ra
-//          thoigian         : thoi gian tao san pham
+//          nhasanxuat       : ten nha san xuat san pham
+//          thoigian         : bo qua, chaincode ghi thoi gian giao dich
 //          diadiem          : dia diem thuc hien tao san pham
 //          toado            : toa do dia diem tao san pham
-//          thuchien         : ma dinh danh quyen so huu cua nguoi duoc chuyen tiep san pham
+//          thuchien         : ten nguoi nhan, hoac MSP::ten neu thuoc to chuc khac
 //      Output:
 //          success: trang thai thuc hien
 //          message : 
@@ -251,6 +253,92 @@ exports.transfer = async function(req, res, next){
   }
 }
 
+//chuyenGiao: goi tac vu chuyen giao fcn voi cac tham so chung cua de nghi chuyen giao
+async function chuyenGiao(fcn, req, res){
+  try{
+    logger.info('Runninng ' + fcn + ' controller');
+    var user = req.user.local.username;
+    var args = {
+      id : req.body.id,
+      nhasanxuat : req.body.nhasanxuat,
+      nguoinhan : req.body.nguoinhan,
+      thoihangio : parseInt(req.body.thoihangio) || 0,
+      lydo : req.body.lydo,
+      thoigian: req.body.thoigian,
+      diadiem: req.body.diadiem,
+      toado: req.body.toado,
+      formIDmoinhat: req.body.formIDmoinhat
+    }
+
+    if (!user){
+      return res.status(401).send(getErrorMessage('user'));
+    }
+    let message = await invokesvc.Invokecc(fcn,args,user);
+    if(message.success)
+      return res.status(200).send(message);
+    return res.status(500).send(message);
+  }catch(err){
+    return res.status(500).send({
+      success: false,
+      message: err,
+    });
+  }
+}
+
+//proposeTransfer: Handler tiep nhan tac vu de nghi chuyen giao san pham dang giu
+//      Input: 
+//          id               : dinh danh san pham
+//          nhasanxuat       : ten nha san xuat san pham
+//          nguoinhan        : dinh danh nguoi nhan (MSP::ten)
+//          thoihangio       : so gio de nghi con hieu luc (tuy chon)
+//      Output:
+//          success: trang thai thuc hien
+//          message : 
+//                  Value  : de nghi chuyen giao vua tao
+//                  hashpbs: gia tri bam cua trang thai toan he thong truoc do
+exports.proposeTransfer = async function(req, res, next){
+  return chuyenGiao('ProposeTransfer', req, res);
+}
+
+//acceptTransfer: Handler tiep nhan tac vu xac nhan de nghi chuyen giao gui toi nguoi dung
+//      Input: 
+//          id               : dinh danh san pham
+//          nhasanxuat       : ten nha san xuat san pham
+//          thoigian         : bo qua, chaincode ghi thoi gian giao dich
+//          diadiem          : dia diem nhan san pham
+//          toado            : toa do dia diem nhan san pham
+//          formIDmoinhat    : form minh chung khi nhan (tuy chon)
+//      Output:
+//          success: trang thai thuc hien
+//          message : 
+//                  Value  : trang thai san pham sau khi nhan
+//                  hashpbs: gia tri bam cua trang thai toan he thong truoc do
+exports.acceptTransfer = async function(req, res, next){
+  return chuyenGiao('AcceptTransfer', req, res);
+}
+
+//rejectTransfer: Handler tiep nhan tac vu tu choi de nghi chuyen giao gui toi nguoi dung
+//      Input: 
+//          id               : dinh danh san pham
+//          nhasanxuat       : ten nha san xuat san pham
+//          lydo             : ly do tu choi (tuy chon)
+//      Output:
+//          success: trang thai thuc hien
+exports.rejectTransfer = async function(req, res, next){
+  return chuyenGiao('RejectTransfer', req, res);
+}
+
+//cancelTransfer: Handler tiep nhan tac vu huy de nghi chuyen giao do nguoi dung gui
+//      Input: 
+//          id               : dinh danh san pham
+//          nhasanxuat       : ten nha san xuat san pham
+//          lydo             : ly do huy (tuy chon)
+//      Output:
+//          success: trang thai thuc hien
+exports.cancelTransfer = async function(req, res, next){
+  return chuyenGiao('CancelTransfer', req, res);
+}
+
 // thanhToanSanPham: Handler tiep nhan tac vu thanh toan san pham
 // Input:
 // data: Mang chua thong tin san pham (id, nhasanxuat, soluong, v.v.)
@@ -347,16 +435,23 @@ exports.getById = async function(req, res){
 //      Input: 
 //          id               : dinh danh san pham da ton tai
 //          nhasanxuat       : ten tai khoan cua nha san xuat dang so huu san pham
+//          pagesize         : so ban ghi moi trang (tuy chon)
+//          bookmark         : bookmark trang truoc tra ve (tuy chon)
 //      Output:
 //          success: trang thai thuc hien
-//          message : thong tin lich su thay doi trang thai cua san pham duoc trich xuat tu so cai 
+//          message : 
+//                   DanhSach            : thong tin lich su thay doi trang thai cua san pham duoc trich xuat tu so cai 
+//                   FetchedRecordsCount : so ban ghi trong trang
+//                   Bookmark            : bookmark cua trang tiep theo, rong neu da het
 exports.getHistoryById = async function(req, res){
   try{
     logger.info('Runninng QueryHistory controller');
     var fcn = 'QueryHistory';
     var args = {
       id : req.query.id,
-      nhasanxuat  : req.query.nhasanxuat
+      nhasanxuat  : req.query.nhasanxuat,
+      pagesize : parseInt(req.query.pagesize) || 0,
+      bookmark : req.query.bookmark || ''
     }
     var user = req.user.local.username;
     if (!user){
@@ -370,25 +465,25 @@ exports.getHistoryById = async function(req, res){
       });
     }
 
-    for (const i in message.message)
+    for (const i in message.message.DanhSach)
     {
-      message.message[i].hashpbs = await (await querysvc.QueryByTxID('GetBlockByTxID',message.message[i].TxId,user)).message;
-      console.log("index: " + i + " has hashpbs: " + message.message[i].hashpbs + "\n")
+      message.message.DanhSach[i].hashpbs = await (await querysvc.QueryByTxID('GetBlockByTxID',message.message.DanhSach[i].TxId,user)).message;
+      console.log("index: " + i + " has hashpbs: " + message.message.DanhSach[i].hashpbs + "\n")
     }
 
 
-    for (const i in message.message)
+    for (const i in message.message.DanhSach)
     {
-      message.message[i].descrip = await offchain.offChainRead( message.message[i].Value.FormIDMoiNhat);
-      console.log("index: " + i + " has offchain: " + message.message[i].descrip + "\n")
+      message.message.DanhSach[i].descrip = await offchain.offChainRead( message.message.DanhSach[i].Value.FormIDMoiNhat);
+      console.log("index: " + i + " has offchain: " + message.message.DanhSach[i].descrip + "\n")
     }
 
-    for (var i in message.message){
+    for (var i in message.message.DanhSach){
 
       var query =  await User.findOne({
-        'local.username':  message.message[i].Value.ThucHien
+        'local.username':  utils.getUsername(message.message.DanhSach[i].Value.ThucHien)
       },'local.displayname local.phonenumber local.address local.img.path').exec();
-      message.message[i].profile = {
+      message.message.DanhSach[i].profile = {
             displayname: query.local.displayname,
             phonenumber: query.local.phonenumber,
             url: query.local.img.path
@@ -399,7 +494,11 @@ exports.getHistoryById = async function(req, res){
     if(message.success)
       return res.status(200).send({
         success: true,
-        message: message.message.reverse()
+        message: {
+          DanhSach: message.message.DanhSach.reverse(),
+          FetchedRecordsCount: message.message.FetchedRecordsCount,
+          Bookmark: message.message.Bookmark
+        }
       });
 
     return res.status(404).send(message);
@@ -418,6 +517,7 @@ exports.getHistoryById = async function(req, res){
 //      Output:
 //          success: trang thai thuc hien
 //          message : thong tin lich su thay doi trang thai cua san pham duoc trich xuat tu so cai 
+//                    (ma thung/pallet chua nhieu san pham tra ve lich su cua tung san pham)
 exports.getHistoryByMaDongGoi = async function(req, res){
   try{
     logger.info('Runninng QueryHistoryByMaDongGoi controller');
@@ -440,7 +540,7 @@ exports.getHistoryByMaDongGoi = async function(req, res){
 
     for (var i in message.message){
       var query =  await User.findOne({
-        'local.username':  message.message[i].Value.ThucHien
+        'local.username':  utils.getUsername(message.message[i].Value.ThucHien)
       },'local.displayname local.phonenumber local.address local.img.path').exec();
       message.message[i].profile = {
             displayname: query.local.displayname,
@@ -503,18 +603,115 @@ exports.GetHashValue = async function(req, res){
 }
 
 
+//verifyHashChain: Handler tiep nhan tac vu xac minh chuoi niem phong cua san pham
+//      Input: 
+//          id              : ma dinh danh san pham
+//          nhasanxuat      : nha san xuat san pham
+//      Output:
+//          success: trang thai thuc hien
+//          message : ket qua xac minh tung phien ban (HopLe, PhienBanLoi, TxIdLoi, DanhSachThieuLienKet, DanhSach)
+exports.verifyHashChain = async function(req, res){
+  try{
+    logger.info('Runninng VerifyHashChain controller');
+    var fcn = 'VerifyHashChain';
+    var args = {
+      id : req.query.id,
+      nhasanxuat  : req.query.nhasanxuat
+    }
+    var user = req.user.local.username;
+    if (!user){
+      return res.status(401).send(getErrorMessage('user'));
+    }
+    let message = await querysvc.Querycc(fcn,args,user);
+    if(message.success)
+      return res.status(200).send(message);
+    return res.status(404).send(message);
+  }catch(err){
+    return res.status(500).send({
+      success: false,
+      message: err,
+    });
+  }
+}
+
+//getPackagingProof: Handler tiep nhan tac vu lay chung minh Merkle cua mot ma dong goi
+//      Input: 
+//          key             : ma dong goi can chung minh
+//      Output:
+//          success: trang thai thuc hien
+//          message : La, DuongDan (hash anh em tu la len goc), MerkleRoot va HashValue cua san pham
+exports.getPackagingProof = async function(req, res){
+  try{
+    logger.info('Runninng GetPackagingProof controller');
+    var fcn = 'GetPackagingProof';
+    var args = {
+      key : req.query.key
+    }
+    var user = req.user.local.username;
+    if (!user){
+      return res.status(401).send(getErrorMessage('user'));
+    }
+    let message = await querysvc.Querycc(fcn,args,user);
+    if(message.success)
+      return res.status(200).send(message);
+    return res.status(404).send(message);
+  }catch(err){
+    return res.status(500).send({
+      success: false,
+      message: err,
+    });
+  }
+}
+
+//getProvenanceReport: Handler tiep nhan tac vu lay bao cao nguon goc day du cua mot ma dong goi
+//      Input: 
+//          key             : ma dong goi can tra cuu
+//      Output:
+//          success: trang thai thuc hien
+//          message : SanPham, DongThoiGian, ChuoiSoHuu, DongGoi, BanHang, ThuHoi va XacMinhHash;
+//                    ma thung/pallet kem DanhSachMaDonVi la bao cao cua tung ma don vi ben trong
+exports.getProvenanceReport = async function(req, res){
+  try{
+    logger.info('Runninng GetProvenanceReport controller');
+    var fcn = 'GetProvenanceReport';
+    var args = {
+      key : req.query.key
+    }
+    var user = req.user.local.username;
+    if (!user){
+      return res.status(401).send(getErrorMessage('user'));
+    }
+    let message = await querysvc.Querycc(fcn,args,user);
+    if(message.success)
+      return res.status(200).send(message);
+    return res.status(404).send(message);
+  }catch(err){
+    return res.status(500).send({
+      success: false,
+      message: err,
+    });
+  }
+}
+
 //getByAuthor: Handler tiep nhan tac vu truy van trang thai san pham theo nha san xuat
 //      Input: 
 //          nhasanxuat              : ten nha san xuat san pham
+//          pagesize                : so ban ghi moi trang (tuy chon)
+//          bookmark                : bookmark trang truoc tra ve (tuy chon)
 //      Output:
 //          success: trang thai thuc hien
-//          message : thong tin  trang thai cua san pham duoc trich xuat tu so cai theo chi muc chi dinh
+//          message : 
+//                   DanhSach            : thong tin  trang thai cua san pham duoc trich xuat tu so cai theo chi muc chi dinh
+//                   FetchedRecordsCount : so ban ghi trong trang
+//                   Bookmark            : bookmark cua trang tiep theo, rong neu da het
 exports.getByAuthor = async function(req, res){
   try{
     logger.info('Runninng QueryByAuthor controller');
     var fcn = 'QueryByAuthor';
     var args = {
-      nhasanxuat  : req.query.nhasanxuat
+      nhasanxuat  : req.query.nhasanxuat,
+      pagesize : parseInt(req.query.pagesize) || 0,
+      bookmark : req.query.bookmark || ''
     }
     var user = req.user.local.username;
     if (!user){
@@ -523,9 +720,9 @@ exports.getByAuthor = async function(req, res){
 
     let message = await querysvc.Querycc(fcn,args,user);
     logger.info(message)
-    for (const i in message.message)
+    for (const i in message.message.DanhSach)
     {
-      message.message[i].descrip = await offchain.offChainRead( message.message[i].Value.FormIDMoiNhat);
+      message.message.DanhSach[i].descrip = await offchain.offChainRead( message.message.DanhSach[i].Value.FormIDMoiNhat);
     }
 
     if(message.success)
@@ -620,6 +817,7 @@ exports.queryOffchain = async function(req, res){
 //      Output:
 //          success : trang thai thuc hien
 //          message : thong tin minh chung gom anh hoac video
+//      Ghi chu: sau khi tai du minh chung can goi registerEvidence de neo ma bam len so cai
 exports.uploadDescriptions = async function (req, res, next) {
   try{
     logger.info('Runninng uploadDescriptions controller');
@@ -646,6 +844,85 @@ exports.uploadDescriptions = async function (req, res, next) {
   }
 }
 
+//registerEvidence: Handler tiep nhan tac vu dang ky minh chung cua mot form len so cai
+//      Input: 
+//          formID              : ma dinh danh form da tai minh chung len qua uploadDescriptions
+//          nhasanxuat          : ten nha san xuat cua san pham dung minh chung
+//          id                  : dinh danh san pham dung minh chung
+//      Output:
+//          success : trang thai thuc hien
+//          message : ban ghi minh chung tren so cai (MaBam, ThuatToan, LoaiNoiDung, KichThuoc, NguoiTaiLen)
+//      Ghi chu: can dang ky sau khi tai het minh chung va truoc khi create/update/dongGoi/acceptTransfer voi formID nay;
+//               chi nguoi giu san pham (hoac nguoi duoc de nghi nhan, thanh vien nha san xuat khi chua tao) duoc dang ky,
+//               va chi nguoi dang ky duoc dung formID nay cho san pham do;
+//               minh chung tai them sau khi dang ky se lam HashValueOffchain khong con khop
+exports.registerEvidence = async function (req, res) {
+  try{
+    logger.info('Runninng registerEvidence controller');
+    if(!req.body.formID || !req.body.nhasanxuat || !req.body.id){
+      return res.status(400).json({
+        success: false,
+        message: "Missing field"
+      });
+    }
+    var user = req.user.local.username;
+    if (!user){
+      return res.status(401).send(getErrorMessage('user'));
+    }
+    var digest = await offchain.offChainDigest(req.body.formID);
+    var fcn = 'RegisterEvidence';
+    var args = {
+      formid: req.body.formID,
+      nhasanxuat: req.body.nhasanxuat,
+      id: req.body.id,
+      mabam: digest.hash,
+      thuattoan: 'SHA-256',
+      loainoidung: digest.contentType,
+      kichthuoc: digest.size
+    }
+    let message = await invokesvc.Invokecc(fcn,args,user);
+    if(message.success)
+      return res.status(200).send(message);
+    return res.status(400).send(message);
+  }catch(err){
+    return res.status(500).json({
+      success: false,
+      message: err
+    })
+  }
+}
+
+//verifyEvidence: Handler tiep nhan tac vu doi chieu minh chung cua form voi ban ghi tren so cai
+//      Input: 
+//          formID              : ma dinh danh form can doi chieu
+//      Output:
+//          success : trang thai thuc hien
+//          message : DaDangKy, KhopMaBam va ban ghi minh chung tren so cai
+exports.verifyEvidence = async function (req, res) {
+  try{
+    logger.info('Runninng verifyEvidence controller');
+    var user = req.user.local.username;
+    if (!user){
+      return res.status(401).send(getErrorMessage('user'));
+    }
+    var digest = await offchain.offChainDigest(req.query.formID);
+    var fcn = 'VerifyEvidence';
+    var args = {
+      formid: req.query.formID,
+      mabam: digest.hash
+    }
+    let message = await querysvc.Querycc(fcn,args,user);
+    if(message.success)
+      return res.status(200).send(message);
+    return res.status(404).send(message);
+  }catch(err){
+    return res.status(500).json({
+      success: false,
+      message: err
+    })
+  }
+}
+
 //getListSanPhamChiaNho: Handler tiep nhan tac vu truy van thong tin san pham duoc chia nho theo trang
 //      Input: 
 //          pageindex        : chi muc trang 
@@ -677,7 +954,7 @@ exports.getListSanPhamChiaNho = async function(req, res){
     	for (var i in message.message){
       		if (i != 0){
       			var query =  await User.findOne({
-        		'local.username':  message.message[i].Value.ThucHien
+        		'local.username':  utils.getUsername(message.message[i].Value.ThucHien)
       			},'local.displayname local.phonenumber local.address local.img.path').exec();
       			message.message[i].Value.profile = {
             			displayname: query.local.displayname,
@@ -707,16 +984,25 @@ exports.getListSanPhamChiaNho = async function(req, res){
 //searchSanPham: Handler tiep nhan tac vu truy van thong tin san pham theo thong tin duoc cung cap
 //      Input: 
 //          keyword: tu khoa de tim kiem san pham
+//          phamvi    : CUA_TOI (mac dinh), NHA_SAN_XUAT hoac TAT_CA
+//          nhasanxuat: ten nha san xuat khi phamvi la NHA_SAN_XUAT
+//          pagesize  : so ban ghi moi trang (tuy chon)
+//          bookmark  : bookmark trang truoc tra ve (tuy chon)
 //      Output:
 //          success : trang thai thuc hien
 //          message : 
-//                   soluong    : so luong ban ghi tra ve
-//                   cacbanghi  : thong tin  trang thai cua san pham duoc trich xuat tu so cai theo chi muc chi dinh   
+//                   DanhSach            : san pham khop, xep theo Diem giam dan; moi ban ghi kem TruongKhop (TenSanPham, MoTa hoac DiaDiem) va Diem
+//                   FetchedRecordsCount : so ban ghi trong trang
+//                   Bookmark            : bookmark cua trang tiep theo, rong neu da het
 exports.searchSanPham = async function(req, res){
   try{
     var fcn = 'SearchSanPham';
     var args = {
-      keyword: req.query.keyword
+      keyword: req.query.keyword,
+      phamvi: req.query.phamvi || '',
+      nhasanxuat: req.query.nhasanxuat || '',
+      pagesize: parseInt(req.query.pagesize) || 0,
+      bookmark: req.query.bookmark || ''
     }
     var user = req.user.local.username;
     if (!user){ 
@@ -744,7 +1030,8 @@ exports.searchSanPham = async function(req, res){
 // key: Ma dong goi cua san pham
 // Output:
 // success: Trang thai thuc hien
-// message: Thong tin doanh thu san pham duoc trich xuat tu so cai
+// message: Thong tin doanh thu san pham duoc trich xuat tu so cai;
+//          ma thung/pallet chua nhieu san pham tra ve mang doanh thu cua tung san pham
 exports.getDoanhThuSanPham = async function (req, res) {
   try {
     logger.info('Running getDoanhThuSanPham controller');
@@ -1,6 +1,7 @@
 var querysvc = require('../../services/Querycc.js');
 var offchain = require('../../services/Offchain.js');
-var logger = require('../../services/utils/utils.js').getLogger("Network-Controller")
+var utils = require('../../services/utils/utils.js');
+var logger = utils.getLogger("Network-Controller")
 var User = require('../../services/models/inforUser')
 var moment = require('moment');
 
@@ -16,7 +17,8 @@ exports.getHistoryById = async function(req, res) {
         });
         }
 
-        const fcn = 'QueryHistoryByMaDongGoi';
+        // Mot truy van tra ve ca dong thoi gian, niem phong va ket qua xac minh chuoi hash
+        const fcn = 'GetProvenanceReport';
         const args = { Key: maSanPham };
         const user = "guest";
 
@@ -27,14 +29,45 @@ exports.getHistoryById = async function(req, res) {
             message: message.message
         });
         }
+        let baoCao = message.message;
+        // Ma thung/pallet tra ve bao cao cua tung ma don vi ben trong; hien thi ma don vi dau tien
+        if (baoCao.DongGoi.MaDongGoi.CapDongGoi && baoCao.DongGoi.MaDongGoi.CapDongGoi !== 'DON_VI') {
+        if (!baoCao.DanhSachMaDonVi.length) {
+            return res.status(404).send({
+            success: false,
+            message: "Mã đóng gói không chứa sản phẩm"
+            });
+        }
+        baoCao = baoCao.DanhSachMaDonVi[0];
+        }
 
-        for (const item of message.message) {
+        // Chuyen cac moc ve dang ban ghi lich su ma giao dien dang dung, cu nhat truoc
+        const data = baoCao.DongThoiGian
+            .filter(moc => moc.Loai !== 'ProductVoided')
+            .map(moc => ({
+                TxId: moc.TxID,
+                Loai: moc.Loai,
+                Value: {
+                    TenSanPham: moc.TenSanPham,
+                    ThoiGian: moc.ThoiGian,
+                    TrangThai: moc.TrangThai,
+                    DiaDiem: moc.DiaDiem,
+                    MoTa: moc.MoTa,
+                    ThucHien: moc.ThucHien,
+                    FormIDMoiNhat: moc.FormID,
+                    HashValue: moc.HashValue,
+                    HashValueOffchain: moc.HashValueOffchain
+                },
+                hashpbs: moc.HashPb
+            }));
+
+        for (const item of data) {
         item.descrip = item.Value.FormIDMoiNhat 
             ? await offchain.offChainRead(item.Value.FormIDMoiNhat)
             : { success: false, message: "No description" };
 
         const query = await User.findOne(
-            { 'local.username': item.Value.ThucHien || user },
+            { 'local.username': utils.getUsername(item.Value.ThucHien) || user },
             'local.displayname local.phonenumber local.address local.img.path'
         ).exec();
         item.profile = query ? {
@@ -46,12 +79,12 @@ exports.getHistoryById = async function(req, res) {
             phonenumber: 'N/A',
             url: ''
         };
-
-        item.hashpbs = (await querysvc.QueryByTxID('GetBlockByTxID', item.TxId, user)).message;
         }
 
         return res.status(200).render("./guest/chi-tiet", {
-        data: message.message.reverse(),
+        data: data,
+        xacMinh: baoCao.XacMinhHash,
+        baoCao: baoCao,
         moment: moment
         });
     } catch (err) {
@@ -5,7 +5,7 @@ const path = require('path');
 const fs = require('fs');
 const fsPromises = fs.promises;
 
-const { buildCAClient, enrollAdmin, revokeUser, reenrollUser } = require('../../services/CAUtil');
+const { buildCAClient, enrollAdmin, revokeUser, reenrollUser, getUserRole, assignRole } = require('../../services/CAUtil');
 const { buildCCPOrg1, buildCCPOrg2, buildWallet } = require('../../services/AppUtil');
 const FabricCAServices = require('fabric-ca-client');
 const { Wallets } = require('fabric-network');
@@ -115,6 +115,45 @@ exports.reenrollUser = async (req, res) => {
     }
 };
 
+// Vai tro duoc gan qua assignRole; admin/auditor chi duoc gan boi admin
+const cacVaiTro = ['manufacturer', 'distributor', 'retailer', 'auditor', 'admin'];
+
+exports.assignRole = async (req, res) => {
+    const { org, userId, role } = req.body;
+    try {
+        if (org !== 'org1' && org !== 'org2') {
+            return res.status(400).json({ error: 'Org must be org1 or org2' });
+        }
+        if (!userId || !cacVaiTro.includes(role)) {
+            return res.status(400).json({ error: `Invalid user or role: ${role}` });
+        }
+        let ccp, caClient, wallet, walletPath, mspId, caName;
+        if (org === 'org1') {
+            ccp = buildCCPOrg1();
+            caName = 'org1-ca';
+            mspId = mspOrg1;
+        } else {
+            ccp = buildCCPOrg2();
+            caName = 'org2-ca';
+            mspId = mspOrg2;
+        }
+        caClient = buildCAClient(FabricCAServices, ccp, caName);
+        walletPath = getWalletPath(org);
+        await fsPromises.mkdir(walletPath, { recursive: true });
+        wallet = await buildWallet(Wallets, walletPath);
+        // Vai tro cua nguoi goi doc tu CA, khong tin vao du lieu client gui len
+        const callerRole = await getUserRole(caClient, wallet, req.user.local.username, 'rcaadmin');
+        if (callerRole !== 'admin') {
+            return res.status(403).json({ error: 'Only an admin can assign roles' });
+        }
+        await assignRole(caClient, wallet, userId, 'rcaadmin', role, mspId);
+        res.json({ message: `Assigned role ${role} to user ${userId} in ${org} successfully` });
+    } catch (error) {
+        console.error('Error in assignRole:', error);
+        res.status(500).json({ error: error.message });
+    }
+};
+
 exports.getUser = async function(req, res){
     try{
         logger.info('Runninng Get User controller');
@@ -232,6 +271,7 @@ exports.logout = async function(req, res){
 //      Output:
 //          success: trang thai thuc hien
 //          message: thong tin ket qua dang ky nguoi dung
+//      Ghi chu: tai khoan moi chua co vai tro, admin gan vai tro qua /user/role
 exports.registerUser = async function(req, res){
     try{
         logger.info('Runninng register User controller');
@@ -99,6 +99,8 @@ module.exports = function(app, passport) {
     
     app.post('/user/reenroll', passport.authenticate('org1', { session: false }), sysctrl.reenrollUser);
 
+    app.post('/user/role', passport.authenticate('org1', { session: false }), sysctrl.assignRole);
+
 
     
     app.post('/contract/create', passport.authenticate('org1', { session: false }), ccctrl.create);
@@ -109,6 +111,14 @@ module.exports = function(app, passport) {
 
     app.post('/contract/tranfer', passport.authenticate('org1', { session: false }), ccctrl.transfer);
 
+    app.post('/contract/proposeTransfer', passport.authenticate('org1', { session: false }), ccctrl.proposeTransfer);
+
+    app.post('/contract/acceptTransfer', passport.authenticate('org1', { session: false }), ccctrl.acceptTransfer);
+
+    app.post('/contract/rejectTransfer', passport.authenticate('org1', { session: false }), ccctrl.rejectTransfer);
+
+    app.post('/contract/cancelTransfer', passport.authenticate('org1', { session: false }), ccctrl.cancelTransfer);
+
     app.post('/contract/thanhToan', passport.authenticate('org1', { session: false }), ccctrl.thanhToanSanPham);
 
   
@@ -116,6 +126,12 @@ module.exports = function(app, passport) {
 
     app.get('/contract/getHashValue', passport.authenticate('org1', { session: false }), ccctrl.GetHashValue);
 
+    app.get('/contract/verifyHashChain', passport.authenticate('org1', { session: false }), ccctrl.verifyHashChain);
+
+    app.get('/contract/packagingProof', passport.authenticate('org1', { session: false }), ccctrl.getPackagingProof);
+
+    app.get('/contract/provenanceReport', passport.authenticate('org1', { session: false }), ccctrl.getProvenanceReport);
+
     app.get('/contract/getListSanPham', passport.authenticate('org1', { session: false }), ccctrl.getListSanPham);
 
     app.get('/contract/getListSanPhamChiaNho', passport.authenticate('org1', { session: false }), ccctrl.getListSanPhamChiaNho);
@@ -130,6 +146,10 @@ module.exports = function(app, passport) {
 
     app.post('/offchain/uploadDescriptions', uploaddes.fields([{ name: 'descriptions', maxCount: 1 }, { name: 'thumbnail', maxCount: 1 }]), ccctrl.uploadDescriptions);
 
+    app.post('/offchain/registerEvidence', passport.authenticate('org1', { session: false }), ccctrl.registerEvidence);
+
+    app.get('/offchain/verifyEvidence', passport.authenticate('org1', { session: false }), ccctrl.verifyEvidence);
+
     // app.get('/qscc/getBlockbyNum',passport.authenticate('org1', { session: false }),ccctrl.getBlockbyNum);
 
     // app.get('/qscc/getBlockbyTxid', passport.authenticate('org1', { session: false }), ccctrl.getBlockByTxID);
@@ -157,3 +157,52 @@ exports.reenrollUser = async (caClient, wallet, userId, orgMspId) => {
 		throw error;
 	}
 };
+
+/**
+ * Read the role attribute the CA holds for a user, '' when it has none.
+ * @param {*} caClient - The Fabric CA client
+ * @param {*} wallet - The wallet instance
+ * @param {*} userId - The user to look up
+ * @param {*} adminUserId - The admin identity in the wallet
+ */
+exports.getUserRole = async (caClient, wallet, userId, adminUserId) => {
+	const adminIdentity = await wallet.get(adminUserId);
+	if (!adminIdentity) {
+		throw new Error('Admin identity not found in wallet');
+	}
+	const provider = wallet.getProviderRegistry().getProvider(adminIdentity.type);
+	const adminUser = await provider.getUserContext(adminIdentity, adminUserId);
+	const response = await caClient.newIdentityService().getOne(userId, adminUser);
+	const attrs = (response && response.result && response.result.attrs) || [];
+	const role = attrs.find(attr => attr.name === 'role');
+	return role ? role.value : '';
+};
+
+/**
+ * Set a user's role attribute on the CA and reenroll the user so the new
+ * certificate carries it; the chaincode only reads the role from the certificate.
+ * @param {*} caClient - The Fabric CA client
+ * @param {*} wallet - The wallet instance
+ * @param {*} userId - The user to update
+ * @param {*} adminUserId - The admin identity in the wallet
+ * @param {*} role - The role to assign
+ * @param {*} orgMspId - The MSP ID
+ */
+exports.assignRole = async (caClient, wallet, userId, adminUserId, role, orgMspId) => {
+	try {
+		const adminIdentity = await wallet.get(adminUserId);
+		if (!adminIdentity) {
+			throw new Error('Admin identity not found in wallet');
+		}
+		const provider = wallet.getProviderRegistry().getProvider(adminIdentity.type);
+		const adminUser = await provider.getUserContext(adminIdentity, adminUserId);
+		await caClient.newIdentityService().update(userId, {
+			attrs: [{ name: 'role', value: role, ecert: true }]
+		}, adminUser);
+		await exports.reenrollUser(caClient, wallet, userId, orgMspId);
+		console.log(`Successfully assigned role ${role} to user ${userId}`);
+	} catch (error) {
+		console.error(`Failed to assign role to user ${userId}:`, error);
+		throw error;
+	}
+};
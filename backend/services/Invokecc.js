@@ -49,18 +49,11 @@ async function Invokecc(fcn,params,user){
     await gateway.connect(ccp,gatewayOptions);
     const network = await gateway.getNetwork('mychannel');
     const contract = await network.getContract('supplychain-cc');
-    var hashOff = ""
     console.log("hashPbs: " + hashPBs)
-    HashValueOffchain = await offchain.offChainRead(params.formIDmoinhat);
-    if(HashValueOffchain)
-      HashValueOffchain.message.docs.forEach(element => {
-        hashOff += element.hash
-    }); 
-    console.log("hash ValueOffchain: ")
-    console.log(HashValueOffchain)
+    // Cung cach tinh voi MaBam dang ky qua RegisterEvidence, chaincode doi chieu hai gia tri nay
+    var hashOff = (await offchain.offChainDigest(params.formIDmoinhat)).hash
     hashPBs = await utils.getListener(hashPBs, network);
     console.log("hashPBs before : " + hashPBs)
-    hashOff = await utils.generateHash(hashOff);
     console.log("hashOff: " + hashOff)
     params.HashValueOffchain = hashOff
     params.hashvalue = utils.generateHash(hashPBs + hashOff);
@@ -68,7 +61,8 @@ async function Invokecc(fcn,params,user){
     var response ;
     if (fcn === "Transfer")
     {
-      var name = user;
+      // Transfer tao de nghi chuyen giao toi nguoi nhan, nguoi nhan xac nhan qua AcceptTransfer
+      var name = params.thuchien;
       await contract.submitTransaction(fcn, JSON.stringify(params),name);
     }else if (fcn === "ThanhToanSanPham") {
       const { data, uuid } = params;
@@ -81,7 +75,9 @@ async function Invokecc(fcn,params,user){
       console.log("Submitting transaction with params:", JSON.stringify(params));
       var result = await contract.submitTransaction(fcn, JSON.stringify(params));
       console.log("Raw chaincode result:", result.toString());
-      var response = JSON.parse(new Buffer.from(result).toString())
+      // RejectTransfer, CancelTransfer khong tra ve du lieu
+      if (result.length > 0)
+        var response = JSON.parse(new Buffer.from(result).toString())
       console.log("Parsed chaincode response:", JSON.stringify(response, null, 2));
     }
     console.log(fcn)
@@ -1,4 +1,7 @@
+const fs = require('fs');
+const path = require('path');
 const couchdbutil = require('./utils/couchdbUtils.js');
+const utils = require('./utils/utils.js');
 
 const config = require('./utils/config.js');
 const channelid = config.channelid;
@@ -150,5 +153,38 @@ async function readValuesFromCouchDB(nano, channelname, writeObject) {
     }));
 }
 
+// offChainDigest: services tinh ma bam tong hop cua cac minh chung thuoc mot form
+// Input: (formID)
+//        formID   : ma dinh danh form thiet bi luu minh chung
+// Output: (hash, contentType, size)
+//        hash       : sha256 cua chuoi noi cac ma bam minh chung, dung lam HashValueOffchain va MaBam dang ky tren so cai
+//        contentType: dinh dang cua minh chung dau tien
+//        size       : tong kich thuoc tep minh chung con tren may chu
+async function offChainDigest(formID) {
+    var hashOff = "";
+    var contentType = "";
+    var size = 0;
+    var result = await offChainRead(formID);
+    if (result && result.success && result.message && Array.isArray(result.message.docs)) {
+        result.message.docs.forEach(element => {
+            hashOff += element.hash;
+            if (!contentType) {
+                contentType = element.content_type;
+            }
+            try {
+                size += fs.statSync(path.join('./public', element.path)).size;
+            } catch (error) {
+                logger.error(`Cannot stat evidence file ${element.path}: ${error}`);
+            }
+        });
+    }
+    return {
+        hash: utils.generateHash(hashOff),
+        contentType: contentType,
+        size: size
+    }
+}
+
 exports.offChainWrite = offChainWrite;
-exports.offChainRead = offChainRead;
\ No newline at end of file
+exports.offChainRead = offChainRead;
+exports.offChainDigest = offChainDigest;
\ No newline at end of file
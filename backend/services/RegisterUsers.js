@@ -25,6 +25,8 @@ async function RegisterUsers(req) {
                 return res;
             }
         }
+        // Tu dang ky khong mang vai tro (chi goi duoc chuc nang cong khai cua chaincode);
+        // vai tro do admin gan qua /user/role, req.body.role bi bo qua
         const org = req.body.org || process.env.ORG || 'org1';
         if (org !== 'org1') {
             res.message = 'Registration is only allowed for org1.';
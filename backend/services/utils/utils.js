@@ -13,6 +13,20 @@ function generateHash(value) {
 }
 
 
+//getUsername: ham lay ten dang nhap tu dinh danh chaincode ghi vao ThucHien
+//      Input:
+//          danhTinh : dinh danh dang MSP::CN hoac ten dang nhap cu
+//      Output:
+//          ten dang nhap dung de tra cuu local.username
+function getUsername(danhTinh) {
+    if (!danhTinh) {
+        return danhTinh;
+    }
+    const viTri = danhTinh.indexOf('::');
+    return viTri === -1 ? danhTinh : danhTinh.substring(viTri + 2);
+}
+
+
 async function getListener(hashPBs, network, start, stop) {
     try {
         await network.addBlockListener(
@@ -30,5 +44,6 @@ async function getListener(hashPBs, network, start, stop) {
 
 
 exports.getListener = getListener;
+exports.getUsername = getUsername;
 exports.generateHash = generateHash;
 exports.getLogger = getLogger;
\ No newline at end of file
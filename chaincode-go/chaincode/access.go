@@ -0,0 +1,290 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Roles read from the "role" attribute of Fabric CA certificates
+const (
+	VaiTroNhaSanXuat  = "manufacturer"
+	VaiTroNhaPhanPhoi = "distributor"
+	VaiTroBanLe       = "retailer"
+	VaiTroKiemToan    = "auditor"
+	VaiTroQuanTri     = "admin"
+)
+
+// VaiTroCongKhai in a policy entry lets any caller, with or without a role, run the function
+const VaiTroCongKhai = "*"
+
+// thuocTinhVaiTro is the certificate attribute that carries the caller role
+const thuocTinhVaiTro = "role"
+
+// keyChinhSachQuyen stores the policy entries an admin has overridden
+const keyChinhSachQuyen = "ChinhSachQuyen"
+
+// ErrKhongDuQuyen is returned, wrapped, whenever the role policy rejects a call
+var ErrKhongDuQuyen = errors.New("không đủ quyền")
+
+var cacVaiTro = []string{VaiTroNhaSanXuat, VaiTroNhaPhanPhoi, VaiTroBanLe, VaiTroKiemToan, VaiTroQuanTri}
+
+var (
+	vaiTroSanXuat  = []string{VaiTroNhaSanXuat}
+	vaiTroVanHanh  = []string{VaiTroNhaSanXuat, VaiTroNhaPhanPhoi}
+	vaiTroNamGiu   = []string{VaiTroNhaSanXuat, VaiTroNhaPhanPhoi, VaiTroBanLe}
+	vaiTroBanHang  = []string{VaiTroBanLe}
+	vaiTroDoiSoat  = []string{VaiTroBanLe, VaiTroKiemToan, VaiTroQuanTri}
+	vaiTroTraCuu   = []string{VaiTroNhaSanXuat, VaiTroNhaPhanPhoi, VaiTroBanLe, VaiTroKiemToan, VaiTroQuanTri}
+	vaiTroCongKhai = []string{VaiTroCongKhai}
+	vaiTroHeThong  = []string{VaiTroQuanTri}
+)
+
+// chinhSachMacDinh maps every transaction to the roles allowed to call it
+var chinhSachMacDinh = map[string][]string{
+	"Init":                 vaiTroHeThong,
+	"RegisterManufacturer": vaiTroHeThong,
+	"MigrateIdentities":    vaiTroHeThong,
+	"MigrateOwnerIndexes":  vaiTroHeThong,
+	"RebuildSearchIndex":   vaiTroHeThong,
+	"SetSearchConfig":      vaiTroHeThong,
+	"RegisterParticipant":  vaiTroHeThong,
+	"SuspendParticipant":   vaiTroHeThong,
+	"ReinstateParticipant": vaiTroHeThong,
+
+	"Create":         vaiTroSanXuat,
+	"DongGoiSanPham": vaiTroSanXuat,
+	"RecallProduct":  vaiTroSanXuat,
+	"VoidProduct":    vaiTroSanXuat,
+	"UnpackProduct":  vaiTroSanXuat,
+	"SplitProduct":   vaiTroVanHanh,
+	"MergeProducts":  vaiTroVanHanh,
+
+	"AggregatePackaging":    vaiTroVanHanh,
+	"DisaggregatePackaging": vaiTroVanHanh,
+	"UpdatePackagingStatus": vaiTroNamGiu,
+
+	"Update":                vaiTroNamGiu,
+	"Transfer":              vaiTroNamGiu,
+	"ProposeTransfer":       vaiTroNamGiu,
+	"AcceptTransfer":        vaiTroNamGiu,
+	"RejectTransfer":        vaiTroNamGiu,
+	"CancelTransfer":        vaiTroNamGiu,
+	"QueryPendingTransfers": vaiTroNamGiu,
+	"SweepExpiredProducts":  vaiTroNamGiu,
+
+	"RegisterEvidence": vaiTroNamGiu,
+
+	"GrantDelegation":  vaiTroNamGiu,
+	"RevokeDelegation": vaiTroNamGiu,
+	"QueryDelegations": vaiTroNamGiu,
+
+	"ThanhToanSanPham":    vaiTroBanHang,
+	"ReturnSale":          {VaiTroBanLe, VaiTroQuanTri},
+	"QuerySaleReceipt":    vaiTroDoiSoat,
+	"QuerySalesBySeller":  vaiTroDoiSoat,
+	"QuerySalesByProduct": append([]string{VaiTroNhaSanXuat}, vaiTroDoiSoat...),
+
+	"QueryByAuthor":                           vaiTroTraCuu,
+	"QueryParticipants":                       vaiTroTraCuu,
+	"QueryListSanPham":                        vaiTroTraCuu,
+	"QueryListSanPhamTheoPageIndexVaPageSize": vaiTroTraCuu,
+	"SearchSanPham":                           vaiTroTraCuu,
+	"GetSearchConfig":                         vaiTroTraCuu,
+	"QuerySanPhamSapHetHan":                   vaiTroTraCuu,
+	"QueryProducts":                           vaiTroTraCuu,
+
+	// Tra cứu dành cho khách hàng quét mã
+	"Query":                     vaiTroCongKhai,
+	"QueryHistory":              vaiTroCongKhai,
+	"QueryHistoryByMaDongGoi":   vaiTroCongKhai,
+	"QueryDoanhThuSanPham":      vaiTroCongKhai,
+	"GetHashValue":              vaiTroCongKhai,
+	"VerifyHashChain":           vaiTroCongKhai,
+	"GetPackagingProof":         vaiTroCongKhai,
+	"GetProvenanceReport":       vaiTroCongKhai,
+	"VerifyEvidence":            vaiTroCongKhai,
+	"ResolvePackaging":          vaiTroCongKhai,
+	"QueryPackagingCodeHistory": vaiTroCongKhai,
+	"GetID":                     vaiTroCongKhai,
+	"GetManufacturer":           vaiTroCongKhai,
+	"GetParticipant":            vaiTroCongKhai,
+}
+
+// chinhSachCoDinh holds the entries an admin cannot override, so the policy can never lock itself out
+var chinhSachCoDinh = map[string][]string{
+	"SetAccessPolicy": vaiTroHeThong,
+	"GetAccessPolicy": {VaiTroQuanTri, VaiTroKiemToan},
+}
+
+// ChinhSachQuyen struct
+type ChinhSachQuyen struct {
+	HamChucNang    string   `json:"HamChucNang"`
+	DanhSachVaiTro []string `json:"DanhSachVaiTro"`
+}
+
+// GetBeforeTransaction gates every transaction behind the role policy
+func (s *SmartContract) GetBeforeTransaction() interface{} {
+	return kiemTraQuyenGoiHam
+}
+
+// tenHamDangGoi returns the transaction name the way contractapi resolves it
+func tenHamDangGoi(ctx contractapi.TransactionContextInterface) string {
+	fn, _ := ctx.GetStub().GetFunctionAndParameters()
+	if i := strings.LastIndex(fn, ":"); i >= 0 {
+		fn = fn[i+1:]
+	}
+	if fn == "" {
+		return fn
+	}
+	r := []rune(fn)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// getVaiTro reads the caller role from the certificate, "" when it carries none
+func getVaiTro(ctx contractapi.TransactionContextInterface) (string, error) {
+	vaiTro, _, err := ctx.GetClientIdentity().GetAttributeValue(thuocTinhVaiTro)
+	if err != nil {
+		return "", fmt.Errorf("không thể đọc vai trò người dùng: %s", err)
+	}
+	return vaiTro, nil
+}
+
+// getChinhSachQuyen merges the stored overrides over the default policy
+func getChinhSachQuyen(ctx contractapi.TransactionContextInterface) (map[string][]string, error) {
+	chinhSach := map[string][]string{}
+	for ham, vaiTro := range chinhSachMacDinh {
+		chinhSach[ham] = vaiTro
+	}
+
+	exist, err := ctx.GetStub().GetState(keyChinhSachQuyen)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi truy vấn chính sách quyền: %s", err)
+	}
+	if exist != nil {
+		var ghiDe map[string][]string
+		if err := json.Unmarshal(exist, &ghiDe); err != nil {
+			return nil, fmt.Errorf("lỗi phân tích chính sách quyền: %s", err)
+		}
+		for ham, vaiTro := range ghiDe {
+			chinhSach[ham] = vaiTro
+		}
+	}
+
+	for ham, vaiTro := range chinhSachCoDinh {
+		chinhSach[ham] = vaiTro
+	}
+	return chinhSach, nil
+}
+
+// kiemTraVaiTro checks the caller role against the policy entry of one function
+func kiemTraVaiTro(ctx contractapi.TransactionContextInterface, ham string) error {
+	chinhSach, err := getChinhSachQuyen(ctx)
+	if err != nil {
+		return err
+	}
+	choPhep, ok := chinhSach[ham]
+	if !ok {
+		return fmt.Errorf("%w: chức năng %s chưa được cấu hình quyền", ErrKhongDuQuyen, ham)
+	}
+	for _, vaiTro := range choPhep {
+		if vaiTro == VaiTroCongKhai {
+			return nil
+		}
+	}
+
+	vaiTro, err := getVaiTro(ctx)
+	if err != nil {
+		return err
+	}
+	if vaiTro == "" {
+		return fmt.Errorf("%w: chứng chỉ chưa được gán vai trò", ErrKhongDuQuyen)
+	}
+	for _, v := range choPhep {
+		if v == vaiTro {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: vai trò %s không được gọi %s", ErrKhongDuQuyen, vaiTro, ham)
+}
+
+// kiemTraQuyenGoiHam runs before every transaction
+func kiemTraQuyenGoiHam(ctx contractapi.TransactionContextInterface) error {
+	return kiemTraVaiTro(ctx, tenHamDangGoi(ctx))
+}
+
+// SetAccessPolicy overrides the roles allowed to call one function; an empty list restores the default
+func (s *SmartContract) SetAccessPolicy(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data ChinhSachQuyen
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if _, ok := chinhSachMacDinh[data.HamChucNang]; !ok {
+		return "", fmt.Errorf("không thể cấu hình quyền cho chức năng %s", data.HamChucNang)
+	}
+	for _, vaiTro := range data.DanhSachVaiTro {
+		hopLe := vaiTro == VaiTroCongKhai
+		for _, v := range cacVaiTro {
+			if v == vaiTro {
+				hopLe = true
+			}
+		}
+		if !hopLe {
+			return "", fmt.Errorf("vai trò không hợp lệ: %s", vaiTro)
+		}
+	}
+
+	ghiDe := map[string][]string{}
+	exist, err := ctx.GetStub().GetState(keyChinhSachQuyen)
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn chính sách quyền: %s", err)
+	}
+	if exist != nil {
+		if err := json.Unmarshal(exist, &ghiDe); err != nil {
+			return "", fmt.Errorf("lỗi phân tích chính sách quyền: %s", err)
+		}
+	}
+	if len(data.DanhSachVaiTro) == 0 {
+		delete(ghiDe, data.HamChucNang)
+	} else {
+		ghiDe[data.HamChucNang] = data.DanhSachVaiTro
+	}
+
+	asBytes, err := json.Marshal(ghiDe)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyChinhSachQuyen, asBytes); err != nil {
+		return "", fmt.Errorf("không thể cập nhật chính sách quyền: %s", err)
+	}
+	if err := phatSuKien(ctx, SuKienChinhSachQuyen, data); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// GetAccessPolicy returns the policy in force, one entry per function
+func (s *SmartContract) GetAccessPolicy(ctx contractapi.TransactionContextInterface) (string, error) {
+	chinhSach, err := getChinhSachQuyen(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	danhSach := make([]ChinhSachQuyen, 0, len(chinhSach))
+	for ham, vaiTro := range chinhSach {
+		danhSach = append(danhSach, ChinhSachQuyen{HamChucNang: ham, DanhSachVaiTro: vaiTro})
+	}
+	sort.Slice(danhSach, func(i, j int) bool { return danhSach[i].HamChucNang < danhSach[j].HamChucNang })
+
+	asBytes, err := json.Marshal(danhSach)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
@@ -0,0 +1,288 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Delegation states
+const (
+	UyQuyenHieuLuc  = "HIEU_LUC"
+	UyQuyenDaThuHoi = "DA_THU_HOI"
+)
+
+// hanhDongUyQuyen lists the transactions a delegate may run on behalf of a principal
+var hanhDongUyQuyen = map[string]bool{
+	"Update":         true,
+	"DongGoiSanPham": true,
+	"UnpackProduct":  true,
+}
+
+// SanPhamUyQuyen struct
+type SanPhamUyQuyen struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+}
+
+// UyQuyen struct
+type UyQuyen struct {
+	ChuThe           string           `json:"ChuThe"`
+	DaiDien          string           `json:"DaiDien"`
+	DanhSachHanhDong []string         `json:"DanhSachHanhDong"`
+	DanhSachSanPham  []SanPhamUyQuyen `json:"DanhSachSanPham"`
+	HetHanLuc        string           `json:"HetHanLuc"`
+	TrangThai        string           `json:"TrangThai"`
+	ThoiGian         string           `json:"ThoiGian"`
+	TxID             string           `json:"TxID"`
+	ThoiGianThuHoi   string           `json:"ThoiGianThuHoi"`
+	TxIDThuHoi       string           `json:"TxIDThuHoi"`
+}
+
+// getUyQuyen reads the delegation a principal gave one delegate
+func getUyQuyen(ctx contractapi.TransactionContextInterface, chuThe string, daiDien string) (string, *UyQuyen, error) {
+	keyUyQuyen, err := ctx.GetStub().CreateCompositeKey("UyQuyen", []string{chuThe, daiDien})
+	if err != nil {
+		return "", nil, fmt.Errorf("lỗi tạo key ủy quyền: %s", err)
+	}
+	exist, err := Exist(ctx, keyUyQuyen)
+	if err != nil {
+		return "", nil, err
+	}
+	if exist == nil {
+		return keyUyQuyen, nil, nil
+	}
+	var uyQuyen UyQuyen
+	if err := json.Unmarshal(exist, &uyQuyen); err != nil {
+		return "", nil, fmt.Errorf("lỗi phân tích ủy quyền: %s", err)
+	}
+	return keyUyQuyen, &uyQuyen, nil
+}
+
+// xacDinhChuThe resolves on whose behalf the caller acts.
+// It returns the principal and, when the caller is a delegate, the caller as second value.
+func xacDinhChuThe(ctx contractapi.TransactionContextInterface, chuThe string, hanhDong string, nhaSanXuat string, id string) (string, string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if chuThe == "" || chuThe == owner {
+		return owner, "", nil
+	}
+
+	_, uyQuyen, err := getUyQuyen(ctx, chuThe, owner)
+	if err != nil {
+		return "", "", err
+	}
+	if uyQuyen == nil || uyQuyen.TrangThai != UyQuyenHieuLuc {
+		return "", "", fmt.Errorf("%w: không được %s ủy quyền", ErrKhongDuQuyen, chuThe)
+	}
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	hetHanLuc, err := time.Parse(time.RFC3339, uyQuyen.HetHanLuc)
+	if err != nil {
+		return "", "", fmt.Errorf("lỗi phân tích thời hạn ủy quyền: %s", err)
+	}
+	if !txTime.Before(hetHanLuc) {
+		return "", "", fmt.Errorf("%w: ủy quyền của %s đã hết hạn lúc %s", ErrKhongDuQuyen, chuThe, uyQuyen.HetHanLuc)
+	}
+
+	choPhep := false
+	for _, element := range uyQuyen.DanhSachHanhDong {
+		if element == hanhDong {
+			choPhep = true
+		}
+	}
+	if !choPhep {
+		return "", "", fmt.Errorf("%w: ủy quyền không bao gồm %s", ErrKhongDuQuyen, hanhDong)
+	}
+	if len(uyQuyen.DanhSachSanPham) > 0 {
+		choPhep = false
+		for _, element := range uyQuyen.DanhSachSanPham {
+			if element.NhaSanXuat == nhaSanXuat && element.ID == id {
+				choPhep = true
+			}
+		}
+		if !choPhep {
+			return "", "", fmt.Errorf("%w: ủy quyền không bao gồm sản phẩm %s", ErrKhongDuQuyen, id)
+		}
+	}
+	return chuThe, owner, nil
+}
+
+// GrantDelegation lets another identity run some actions on behalf of the caller until HetHanLuc.
+// Granting the same delegate again replaces the previous grant.
+func (s *SmartContract) GrantDelegation(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data UyQuyen
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.DaiDien == "" {
+		return "", fmt.Errorf("thiếu người được ủy quyền")
+	}
+	if data.DaiDien == owner {
+		return "", fmt.Errorf("không thể ủy quyền cho chính mình")
+	}
+	if len(data.DanhSachHanhDong) == 0 {
+		return "", fmt.Errorf("danh sách hành động rỗng")
+	}
+	for _, element := range data.DanhSachHanhDong {
+		if !hanhDongUyQuyen[element] {
+			return "", fmt.Errorf("không thể ủy quyền hành động %s", element)
+		}
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	hetHanLuc, err := time.Parse(time.RFC3339, data.HetHanLuc)
+	if err != nil {
+		return "", fmt.Errorf("thời hạn ủy quyền không hợp lệ: %s", data.HetHanLuc)
+	}
+	if !hetHanLuc.After(txTime) {
+		return "", fmt.Errorf("thời hạn ủy quyền đã qua: %s", data.HetHanLuc)
+	}
+
+	keyUyQuyen, _, err := getUyQuyen(ctx, owner, data.DaiDien)
+	if err != nil {
+		return "", err
+	}
+	uyQuyen := UyQuyen{
+		ChuThe:           owner,
+		DaiDien:          data.DaiDien,
+		DanhSachHanhDong: data.DanhSachHanhDong,
+		DanhSachSanPham:  data.DanhSachSanPham,
+		HetHanLuc:        hetHanLuc.UTC().Format(time.RFC3339),
+		TrangThai:        UyQuyenHieuLuc,
+		ThoiGian:         txTime.Format(time.RFC3339),
+		TxID:             ctx.GetStub().GetTxID(),
+	}
+	asBytes, err := json.Marshal(uyQuyen)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyUyQuyen, asBytes); err != nil {
+		return "", fmt.Errorf("không thể lưu ủy quyền: %s", err)
+	}
+
+	// Chỉ mục để người được ủy quyền tra cứu
+	keyTheoDaiDien, err := ctx.GetStub().CreateCompositeKey("UyQuyenTheoDaiDien", []string{data.DaiDien, owner})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key ủy quyền: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyTheoDaiDien, []byte(keyUyQuyen)); err != nil {
+		return "", fmt.Errorf("không thể lưu ủy quyền: %s", err)
+	}
+
+	if err := phatSuKien(ctx, SuKienCapUyQuyen, uyQuyen); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// RevokeDelegation ends a grant the caller gave; the record is kept for audit
+func (s *SmartContract) RevokeDelegation(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data UyQuyen
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	keyUyQuyen, uyQuyen, err := getUyQuyen(ctx, owner, data.DaiDien)
+	if err != nil {
+		return "", err
+	}
+	if uyQuyen == nil || uyQuyen.TrangThai != UyQuyenHieuLuc {
+		return "", fmt.Errorf("không có ủy quyền đang hiệu lực cho %s", data.DaiDien)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	uyQuyen.TrangThai = UyQuyenDaThuHoi
+	uyQuyen.ThoiGianThuHoi = txTime.Format(time.RFC3339)
+	uyQuyen.TxIDThuHoi = ctx.GetStub().GetTxID()
+
+	asBytes, err := json.Marshal(uyQuyen)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyUyQuyen, asBytes); err != nil {
+		return "", fmt.Errorf("không thể thu hồi ủy quyền: %s", err)
+	}
+	if err := phatSuKien(ctx, SuKienThuHoiUyQuyen, uyQuyen); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// QueryDelegations lists the grants the caller gave and the grants the caller received
+func (s *SmartContract) QueryDelegations(ctx contractapi.TransactionContextInterface) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	danhSach := []UyQuyen{}
+	daCapIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("UyQuyen", []string{owner})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn ủy quyền: %s", err)
+	}
+	defer daCapIterator.Close()
+	for daCapIterator.HasNext() {
+		item, err := daCapIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn ủy quyền: %s", err)
+		}
+		var uyQuyen UyQuyen
+		if err := json.Unmarshal(item.Value, &uyQuyen); err != nil {
+			return "", fmt.Errorf("lỗi phân tích ủy quyền: %s", err)
+		}
+		danhSach = append(danhSach, uyQuyen)
+	}
+
+	duocCapIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("UyQuyenTheoDaiDien", []string{owner})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn ủy quyền: %s", err)
+	}
+	defer duocCapIterator.Close()
+	for duocCapIterator.HasNext() {
+		item, err := duocCapIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn ủy quyền: %s", err)
+		}
+		exist, err := Exist(ctx, string(item.Value))
+		if err != nil {
+			return "", err
+		}
+		if exist == nil {
+			continue
+		}
+		var uyQuyen UyQuyen
+		if err := json.Unmarshal(exist, &uyQuyen); err != nil {
+			return "", fmt.Errorf("lỗi phân tích ủy quyền: %s", err)
+		}
+		danhSach = append(danhSach, uyQuyen)
+	}
+
+	asBytes, err := json.Marshal(danhSach)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
@@ -0,0 +1,128 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// phienBanSuKien is bumped whenever the event payload changes in a way subscribers must handle
+const phienBanSuKien = 1
+
+// Event names. Fabric keeps a single event per transaction, so each transaction emits exactly one.
+const (
+	SuKienTaoSanPham         = "ProductCreated"
+	SuKienCapNhatSanPham     = "ProductUpdated"
+	SuKienDongGoiSanPham     = "ProductPackaged"
+	SuKienThaoDongGoi        = "ProductUnpacked"
+	SuKienThuHoiSanPham      = "ProductRecalled"
+	SuKienHuySanPham         = "ProductVoided"
+	SuKienHetHanSanPham      = "ProductsExpired"
+	SuKienTachLo             = "LotSplit"
+	SuKienGopLo              = "LotsMerged"
+	SuKienGopMaDongGoi       = "PackagingAggregated"
+	SuKienTachMaDongGoi      = "PackagingDisaggregated"
+	SuKienTrangThaiMaDongGoi = "PackagingStatusChanged"
+	SuKienDeNghiChuyenGiao   = "TransferProposed"
+	SuKienChuyenGiao         = "CustodyTransferred"
+	SuKienTuChoiChuyenGiao   = "TransferRejected"
+	SuKienHuyChuyenGiao      = "TransferCancelled"
+	SuKienBanHang            = "SaleRecorded"
+	SuKienTraHang            = "SaleReturned"
+	SuKienDangKyNhaSanXuat   = "ManufacturerRegistered"
+	SuKienDangKyThanhVien    = "ParticipantRegistered"
+	SuKienTrangThaiThanhVien = "ParticipantStatusChanged"
+	SuKienCapUyQuyen         = "DelegationGranted"
+	SuKienThuHoiUyQuyen      = "DelegationRevoked"
+	SuKienChinhSachQuyen     = "AccessPolicyChanged"
+	SuKienChuyenDoiDanhTinh  = "IdentitiesMigrated"
+	SuKienChuyenDoiChiMuc    = "OwnerIndexesMigrated"
+	SuKienTaoChiMucTimKiem   = "SearchIndexRebuilt"
+	SuKienCauHinhTimKiem     = "SearchConfigChanged"
+	SuKienDangKyMinhChung    = "EvidenceRegistered"
+)
+
+// SuKienSanPham struct
+type SuKienSanPham struct {
+	KeySanPham string `json:"KeySanPham"`
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	TrangThai  string `json:"TrangThai"`
+	HashValue  string `json:"HashValue"`
+}
+
+// SuKien struct
+type SuKien struct {
+	PhienBan        int             `json:"PhienBan"`
+	Loai            string          `json:"Loai"`
+	TxID            string          `json:"TxID"`
+	ThoiGian        string          `json:"ThoiGian"`
+	ThucHien        string          `json:"ThucHien"`
+	ChuThe          string          `json:"ChuThe"`
+	DanhSachSanPham []SuKienSanPham `json:"DanhSachSanPham"`
+	ChiTiet         interface{}     `json:"ChiTiet"`
+}
+
+// phatSuKien emits the event of the current transaction.
+// ThucHien is the caller; ChuThe is the principal when the caller acted as a delegate on one of the products.
+func phatSuKien(ctx contractapi.TransactionContextInterface, loai string, chiTiet interface{}, danhSach ...*Data) error {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	suKien := SuKien{
+		PhienBan:        phienBanSuKien,
+		Loai:            loai,
+		TxID:            ctx.GetStub().GetTxID(),
+		ThoiGian:        txTime.Format(time.RFC3339),
+		ThucHien:        owner,
+		ChuThe:          owner,
+		DanhSachSanPham: []SuKienSanPham{},
+		ChiTiet:         chiTiet,
+	}
+	for _, d := range danhSach {
+		keySanPham, err := ctx.GetStub().CreateCompositeKey(d.NhaSanXuat, []string{d.NhaSanXuat, d.ID})
+		if err != nil {
+			return fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+		}
+		if d.DaiDien == owner && d.ChuThe != "" {
+			suKien.ChuThe = d.ChuThe
+		}
+		suKien.DanhSachSanPham = append(suKien.DanhSachSanPham, SuKienSanPham{
+			KeySanPham: keySanPham,
+			NhaSanXuat: d.NhaSanXuat,
+			ID:         d.ID,
+			TrangThai:  d.TrangThai,
+			HashValue:  d.HashValue,
+		})
+	}
+
+	payload, err := json.Marshal(suKien)
+	if err != nil {
+		return fmt.Errorf("lỗi mã hóa sự kiện: %s", err)
+	}
+	if err := ctx.GetStub().SetEvent(loai, payload); err != nil {
+		return fmt.Errorf("không thể phát sự kiện %s: %s", loai, err)
+	}
+	return nil
+}
+
+// sanPhamTheoKey turns product keys into references for events that do not change the product itself
+func sanPhamTheoKey(ctx contractapi.TransactionContextInterface, danhSachKey []string) ([]*Data, error) {
+	danhSach := []*Data{}
+	for _, keySanPham := range danhSachKey {
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(keySanPham)
+		if err != nil || len(attributes) < 2 {
+			return nil, fmt.Errorf("key sản phẩm không hợp lệ: %s", keySanPham)
+		}
+		danhSach = append(danhSach, &Data{NhaSanXuat: attributes[0], ID: attributes[1]})
+	}
+	return danhSach, nil
+}
@@ -0,0 +1,234 @@
+package chaincode
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// thuatToanMinhChung maps the accepted digest algorithms to their hex length
+var thuatToanMinhChung = map[string]int{
+	"SHA-256":  64,
+	"SHA-384":  96,
+	"SHA-512":  128,
+	"SHA3-256": 64,
+}
+
+// thuatToanMacDinh is assumed when a registration names no algorithm
+const thuatToanMacDinh = "SHA-256"
+
+// MinhChung struct
+type MinhChung struct {
+	FormID      string `json:"FormID"`
+	NhaSanXuat  string `json:"NhaSanXuat"`
+	ID          string `json:"ID"`
+	MaBam       string `json:"MaBam"`
+	ThuatToan   string `json:"ThuatToan"`
+	LoaiNoiDung string `json:"LoaiNoiDung"`
+	KichThuoc   int64  `json:"KichThuoc"`
+	NguoiTaiLen string `json:"NguoiTaiLen"`
+	ThoiGian    string `json:"ThoiGian"`
+	TxID        string `json:"TxID"`
+}
+
+// KetQuaXacMinhMinhChung struct
+type KetQuaXacMinhMinhChung struct {
+	FormID    string     `json:"FormID"`
+	MaBam     string     `json:"MaBam"`
+	DaDangKy  bool       `json:"DaDangKy"`
+	KhopMaBam bool       `json:"KhopMaBam"`
+	MinhChung *MinhChung `json:"MinhChung"`
+}
+
+// getMinhChung reads the evidence registered for one FormID
+func getMinhChung(ctx contractapi.TransactionContextInterface, formID string) (string, *MinhChung, error) {
+	keyMinhChung, err := ctx.GetStub().CreateCompositeKey("MinhChung", []string{formID})
+	if err != nil {
+		return "", nil, fmt.Errorf("lỗi tạo key minh chứng: %s", err)
+	}
+	exist, err := Exist(ctx, keyMinhChung)
+	if err != nil {
+		return "", nil, err
+	}
+	if exist == nil {
+		return keyMinhChung, nil, nil
+	}
+	var minhChung MinhChung
+	if err := json.Unmarshal(exist, &minhChung); err != nil {
+		return "", nil, fmt.Errorf("lỗi phân tích minh chứng: %s", err)
+	}
+	return keyMinhChung, &minhChung, nil
+}
+
+// chuanHoaMaBam lower-cases a hex digest and checks its length against the algorithm
+func chuanHoaMaBam(maBam string, thuatToan string) (string, error) {
+	doDai, ok := thuatToanMinhChung[thuatToan]
+	if !ok {
+		return "", fmt.Errorf("thuật toán băm không được hỗ trợ: %s", thuatToan)
+	}
+	maBam = strings.ToLower(strings.TrimSpace(maBam))
+	if _, err := hex.DecodeString(maBam); err != nil || len(maBam) != doDai {
+		return "", fmt.Errorf("mã băm %s không hợp lệ cho %s", maBam, thuatToan)
+	}
+	return maBam, nil
+}
+
+// kiemTraMinhChung checks that a FormID cited by a product step was registered by the
+// caller for that product and, when the client also sent HashValueOffchain, that it
+// matches the registered digest. It returns the HashValueOffchain to store; a step
+// without a FormID stores none.
+func kiemTraMinhChung(ctx contractapi.TransactionContextInterface, owner string, nhaSanXuat string, id string, formID string, hashOffchain string) (string, error) {
+	if formID == "" {
+		return "", nil
+	}
+	_, minhChung, err := getMinhChung(ctx, formID)
+	if err != nil {
+		return "", err
+	}
+	if minhChung == nil {
+		return "", fmt.Errorf("FormID %s chưa đăng ký minh chứng", formID)
+	}
+	if minhChung.NguoiTaiLen != owner || minhChung.NhaSanXuat != nhaSanXuat || minhChung.ID != id {
+		return "", fmt.Errorf("%w: minh chứng của FormID %s không do người thực hiện đăng ký cho sản phẩm %s/%s", ErrKhongDuQuyen, formID, nhaSanXuat, id)
+	}
+	if hashOffchain != "" && !strings.EqualFold(hashOffchain, minhChung.MaBam) {
+		return "", fmt.Errorf("HashValueOffchain không khớp minh chứng của FormID %s", formID)
+	}
+	return minhChung.MaBam, nil
+}
+
+// kiemTraQuyenDangKyMinhChung allows evidence for a product to be registered by whoever can
+// record its next step: the holder, the recipient of a pending transfer, or, before the
+// product exists, a member of its manufacturer.
+func kiemTraQuyenDangKyMinhChung(ctx contractapi.TransactionContextInterface, owner string, nhaSanXuat string, id string) error {
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(nhaSanXuat, []string{nhaSanXuat, id})
+	if err != nil {
+		return fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	sanPham, err := getSanPham(ctx, keySanPham)
+	if err != nil {
+		return err
+	}
+	if sanPham == nil {
+		return kiemTraNhaSanXuat(ctx, nhaSanXuat)
+	}
+	if sanPham.ChuyenGiaoMoiNhat == owner {
+		return nil
+	}
+	_, deNghi, err := getDeNghiChuyenGiao(ctx, nhaSanXuat, id)
+	if err != nil {
+		return err
+	}
+	if deNghi != nil && deNghi.TrangThai == DeNghiChoXacNhan && deNghi.NguoiNhan == owner {
+		return nil
+	}
+	return fmt.Errorf("%w: chỉ người giữ sản phẩm %s được đăng ký minh chứng", ErrKhongDuQuyen, keySanPham)
+}
+
+// RegisterEvidence anchors the digest of the off-chain evidence behind a FormID for one product.
+// A FormID is registered once; the record cannot be replaced, and only the uploader can
+// cite it in a step of that product.
+func (s *SmartContract) RegisterEvidence(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data MinhChung
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.FormID == "" {
+		return "", fmt.Errorf("thiếu FormID")
+	}
+	if data.NhaSanXuat == "" || data.ID == "" {
+		return "", fmt.Errorf("thiếu sản phẩm của minh chứng")
+	}
+	if err := kiemTraQuyenDangKyMinhChung(ctx, owner, data.NhaSanXuat, data.ID); err != nil {
+		return "", err
+	}
+	if data.ThuatToan == "" {
+		data.ThuatToan = thuatToanMacDinh
+	}
+	maBam, err := chuanHoaMaBam(data.MaBam, data.ThuatToan)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(data.LoaiNoiDung, "/") {
+		return "", fmt.Errorf("loại nội dung không hợp lệ: %s", data.LoaiNoiDung)
+	}
+	if data.KichThuoc < 0 {
+		return "", fmt.Errorf("kích thước không hợp lệ: %d", data.KichThuoc)
+	}
+
+	keyMinhChung, cu, err := getMinhChung(ctx, data.FormID)
+	if err != nil {
+		return "", err
+	}
+	if cu != nil {
+		return "", fmt.Errorf("FormID %s đã đăng ký minh chứng", data.FormID)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	minhChung := MinhChung{
+		FormID:      data.FormID,
+		NhaSanXuat:  data.NhaSanXuat,
+		ID:          data.ID,
+		MaBam:       maBam,
+		ThuatToan:   data.ThuatToan,
+		LoaiNoiDung: data.LoaiNoiDung,
+		KichThuoc:   data.KichThuoc,
+		NguoiTaiLen: owner,
+		ThoiGian:    txTime.Format(time.RFC3339),
+		TxID:        ctx.GetStub().GetTxID(),
+	}
+	asBytes, err := json.Marshal(minhChung)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyMinhChung, asBytes); err != nil {
+		return "", fmt.Errorf("không thể lưu minh chứng: %s", err)
+	}
+	if err := phatSuKien(ctx, SuKienDangKyMinhChung, minhChung); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// VerifyEvidence tells whether a FormID was registered and whether a digest matches the registered one
+func (s *SmartContract) VerifyEvidence(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data MinhChung
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.FormID == "" {
+		return "", fmt.Errorf("thiếu FormID")
+	}
+
+	_, minhChung, err := getMinhChung(ctx, data.FormID)
+	if err != nil {
+		return "", err
+	}
+	ketQua := KetQuaXacMinhMinhChung{
+		FormID:    data.FormID,
+		MaBam:     data.MaBam,
+		DaDangKy:  minhChung != nil,
+		MinhChung: minhChung,
+	}
+	if minhChung != nil {
+		ketQua.KhopMaBam = strings.EqualFold(strings.TrimSpace(data.MaBam), minhChung.MaBam)
+	}
+
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
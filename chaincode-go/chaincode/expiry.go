@@ -0,0 +1,263 @@
+package chaincode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// TrangThaiHetHan is the product status written by the expiry sweep
+const TrangThaiHetHan = "HẾT HẠN"
+
+// dinhDangHSD is the layout HSD is stored in once a product is packaged
+const dinhDangHSD = "2006-01-02"
+
+var cacDinhDangHSD = []string{dinhDangHSD, "02/01/2006", "2/1/2006", time.RFC3339}
+
+// muiGioHSD is the business timezone an HSD day is counted in. A fixed UTC+7 offset keeps every peer
+// deterministic without depending on the tzdata installed in the chaincode image.
+var muiGioHSD = time.FixedZone("Asia/Ho_Chi_Minh", 7*60*60)
+
+// HangSapHetHan struct
+type HangSapHetHan struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	SoNgay     int    `json:"SoNgay"`
+}
+
+// parseHSD reads an expiry date in any of the accepted layouts as the start of that day in muiGioHSD
+func parseHSD(hsd string) (time.Time, error) {
+	for _, layout := range cacDinhDangHSD {
+		if t, err := time.Parse(layout, hsd); err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, muiGioHSD), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("hạn sử dụng không hợp lệ: %s", hsd)
+}
+
+// daHetHan reports whether goods with the given expiry date can no longer be sold at the given time.
+// Goods stay sellable until the end of the HSD day in muiGioHSD.
+func daHetHan(hsd string, now time.Time) (bool, error) {
+	if hsd == "" {
+		return false, nil
+	}
+	ngayHetHan, err := parseHSD(hsd)
+	if err != nil {
+		return false, err
+	}
+	return !now.Before(ngayHetHan.AddDate(0, 0, 1)), nil
+}
+
+// danhSachSanPhamCuaNhaSanXuat reads every product stored in a manufacturer namespace
+func danhSachSanPhamCuaNhaSanXuat(ctx contractapi.TransactionContextInterface, nhaSanXuat string) ([]string, []Data, error) {
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(nhaSanXuat, []string{nhaSanXuat})
+	if err != nil {
+		return nil, nil, fmt.Errorf("lỗi truy vấn: %s", err)
+	}
+	defer keyIterator.Close()
+
+	var keys []string
+	var products []Data
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("lỗi lặp truy vấn: %s", err)
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("lỗi tách key: %s", err)
+		}
+		// Bỏ qua các bản ghi doanh thu nằm chung không gian key
+		if len(attributes) != 2 {
+			continue
+		}
+		var product Data
+		if err := json.Unmarshal(item.Value, &product); err != nil {
+			return nil, nil, fmt.Errorf("lỗi phân tích sản phẩm: %s", err)
+		}
+		keys = append(keys, item.Key)
+		products = append(products, product)
+	}
+	return keys, products, nil
+}
+
+// QuerySanPhamSapHetHan lists products expiring within the given number of days,
+// either for one manufacturer or for the products the caller currently holds
+func (s *SmartContract) QuerySanPhamSapHetHan(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data HangSapHetHan
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.SoNgay < 0 {
+		return "", fmt.Errorf("số ngày không hợp lệ: %d", data.SoNgay)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	txTime = txTime.In(muiGioHSD)
+	homNay := time.Date(txTime.Year(), txTime.Month(), txTime.Day(), 0, 0, 0, 0, muiGioHSD)
+	moc := homNay.AddDate(0, 0, data.SoNgay)
+
+	var products []Data
+	if data.NhaSanXuat != "" {
+		_, products, err = danhSachSanPhamCuaNhaSanXuat(ctx, data.NhaSanXuat)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		danhSach, err := danhSachKeyTheoChiMuc(ctx, chiMucDangGiu, owner)
+		if err != nil {
+			return "", err
+		}
+		for _, keySanPham := range danhSach {
+			queryResult, err := ctx.GetStub().GetState(keySanPham)
+			if err != nil {
+				return "", fmt.Errorf("lỗi truy vấn sản phẩm: %s", err)
+			}
+			if queryResult == nil {
+				continue
+			}
+			var product Data
+			if err := json.Unmarshal(queryResult, &product); err != nil {
+				return "", fmt.Errorf("lỗi phân tích sản phẩm: %s", err)
+			}
+			products = append(products, product)
+		}
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	first := true
+	for _, product := range products {
+		if product.HSD == "" || product.HetHan {
+			continue
+		}
+		ngayHetHan, err := parseHSD(product.HSD)
+		if err != nil || ngayHetHan.After(moc) {
+			continue
+		}
+		asBytes, err := json.Marshal(product)
+		if err != nil {
+			return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+		}
+		if !first {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(`{"Value":`)
+		buffer.Write(asBytes)
+		buffer.WriteString("}")
+		first = false
+	}
+	buffer.WriteString("]")
+
+	return buffer.String(), nil
+}
+
+// SweepExpiredProducts moves every expired product of a manufacturer into the expired status.
+// Only products the caller created, currently holds or manages as a manufacturer member are touched.
+func (s *SmartContract) SweepExpiredProducts(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data HangSapHetHan
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NhaSanXuat == "" {
+		return "", fmt.Errorf("thiếu nhà sản xuất")
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	keys, products, err := danhSachSanPhamCuaNhaSanXuat(ctx, data.NhaSanXuat)
+	if err != nil {
+		return "", err
+	}
+
+	// Mọi sản phẩm trong vòng lặp cùng không gian nhà sản xuất nên chỉ cần kiểm tra thành viên một lần
+	laThanhVien, err := laThanhVienNhaSanXuat(ctx, data.NhaSanXuat, owner)
+	if err != nil {
+		return "", err
+	}
+
+	daXuLy := []string{}
+	hetHanMoi := []*Data{}
+	for i := range products {
+		result := products[i]
+		if result.HetHan {
+			continue
+		}
+		if result.ChuyenGiaoMoiNhat != owner && !laThanhVien && nguoiTao(&result) != owner {
+			continue
+		}
+		hetHan, err := daHetHan(result.HSD, txTime)
+		if err != nil || !hetHan {
+			continue
+		}
+
+		result.HetHan = true
+		result.TrangThai = TrangThaiHetHan
+		result.MoTa = "Hết hạn sử dụng " + result.HSD
+		result.ThoiGian = txTime.Format(time.RFC3339)
+		result.ThucHien = owner
+		result.ChuThe = owner
+		result.DaiDien = ""
+		result.HashPb = result.HashValue
+		result.HashValue = computeHashValue(&result, "")
+
+		if _, err := putSanPham(ctx, keys[i], &result); err != nil {
+			return "", err
+		}
+
+		keyTheoDoiDoanhThu, err := ctx.GetStub().CreateCompositeKey(result.NhaSanXuat, []string{result.NhaSanXuat, result.ID, "TheoDoiDoanhThu"})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key doanh thu: %s", err)
+		}
+		existDoanhThu, err := Exist(ctx, keyTheoDoiDoanhThu)
+		if err != nil {
+			return "", err
+		}
+		if existDoanhThu != nil {
+			var theoDoi TheoDoiDoanhThu
+			if err := json.Unmarshal(existDoanhThu, &theoDoi); err != nil {
+				return "", fmt.Errorf("lỗi phân tích bản ghi doanh thu: %s", err)
+			}
+			theoDoi.HetHan = true
+			asBytesDoanhThu, err := json.Marshal(theoDoi)
+			if err != nil {
+				return "", fmt.Errorf("lỗi mã hóa JSON doanh thu: %s", err)
+			}
+			if err := ctx.GetStub().PutState(keyTheoDoiDoanhThu, asBytesDoanhThu); err != nil {
+				return "", fmt.Errorf("không thể cập nhật bản ghi doanh thu: %s", err)
+			}
+		}
+
+		daXuLy = append(daXuLy, keys[i])
+		hetHanMoi = append(hetHanMoi, &result)
+	}
+
+	if len(hetHanMoi) > 0 {
+		if err := phatSuKien(ctx, SuKienHetHanSanPham, nil, hetHanMoi...); err != nil {
+			return "", err
+		}
+	}
+	asBytes, err := json.Marshal(daXuLy)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
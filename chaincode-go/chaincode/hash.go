@@ -0,0 +1,128 @@
+package chaincode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Hash scheme versions. Records without HashVersion were written with HashV1.
+// HashV3 seals the packaging codes through their Merkle root instead of listing them.
+const (
+	HashV1 = 1
+	HashV2 = 2
+	HashV3 = 3
+)
+
+// phienBanHashHienTai is the scheme new records are sealed with
+const phienBanHashHienTai = HashV3
+
+// tienToHash separates the product hash domain from any other SHA-256 input; the version is appended
+const tienToHash = "fabric-k8s-multinode/SanPham/HashV"
+
+// boMaHoaHash writes the canonical hash input: every value is prefixed with its length,
+// so no two different records produce the same byte string
+type boMaHoaHash struct {
+	buffer bytes.Buffer
+}
+
+// ghi writes one length-prefixed value
+func (b *boMaHoaHash) ghi(giaTri string) {
+	var doDai [8]byte
+	binary.BigEndian.PutUint64(doDai[:], uint64(len(giaTri)))
+	b.buffer.Write(doDai[:])
+	b.buffer.WriteString(giaTri)
+}
+
+// truong writes a named field
+func (b *boMaHoaHash) truong(ten string, giaTri string) {
+	b.ghi(ten)
+	b.ghi(giaTri)
+}
+
+// danhSach writes a named list, its length first
+func (b *boMaHoaHash) danhSach(ten string, giaTri []string) {
+	b.ghi(ten)
+	b.ghi(strconv.Itoa(len(giaTri)))
+	for _, element := range giaTri {
+		b.ghi(element)
+	}
+}
+
+// computeHashValue seals a product record with the current scheme and chains it to HashPb.
+// The extra input is kept on the record as HashDauVao so VerifyHashChain can replay the link.
+func computeHashValue(d *Data, hashDauVao string) string {
+	d.HashVersion = phienBanHashHienTai
+	d.HashDauVao = hashDauVao
+	d.MerkleRootMaDongGoi = merkleRoot(d.DanhSachMaDongGoi)
+	return tinhHash(d)
+}
+
+// tinhHash recomputes the hash of a record with the scheme it was sealed with
+func tinhHash(d *Data) string {
+	switch d.HashVersion {
+	case HashV2, HashV3:
+		return hashChuan(d)
+	}
+	return hashV1(d)
+}
+
+// hashV1 is the original scheme: a few fields concatenated without separators.
+// Once a product is packaged every packaging code is part of the hash input.
+func hashV1(d *Data) string {
+	maDongGoi := d.MaDongGoiMoiNhat
+	if maDongGoi != "" {
+		maDongGoi = strings.Join(d.DanhSachMaDongGoi, "")
+	}
+	hashv := sha256.Sum256([]byte(d.ID + d.TenSanPham + d.NhaSanXuat + d.ThoiGian + d.DiaDiem + d.ToaDo + d.TrangThai + maDongGoi + d.HashPb + d.HashDauVao))
+	return hex.EncodeToString(hashv[:])
+}
+
+// hashChuan is the canonical scheme of HashV2 and later. It covers every field of the record except
+// HashValue itself and ThoiDiemNhan, which only orders the owner index and is stamped after sealing.
+func hashChuan(d *Data) string {
+	var b boMaHoaHash
+	b.ghi(tienToHash + strconv.Itoa(d.HashVersion))
+	b.truong("ID", d.ID)
+	b.truong("TenSanPham", d.TenSanPham)
+	b.truong("NhaSanXuat", d.NhaSanXuat)
+	b.truong("ThoiGian", d.ThoiGian)
+	b.truong("DiaDiem", d.DiaDiem)
+	b.truong("ToaDo", d.ToaDo)
+	b.truong("MoTa", d.MoTa)
+	b.truong("TrangThai", d.TrangThai)
+	b.truong("ThucHien", d.ThucHien)
+	b.truong("ChuThe", d.ChuThe)
+	b.truong("DaiDien", d.DaiDien)
+	b.danhSach("DanhSachChuyenGiao", d.DanhSachChuyenGiao)
+	b.truong("ChuyenGiaoMoiNhat", d.ChuyenGiaoMoiNhat)
+	b.danhSach("DanhSachFormID", d.DanhSachFormID)
+	b.truong("FormIDMoiNhat", d.FormIDMoiNhat)
+	b.truong("MaDongGoiMoiNhat", d.MaDongGoiMoiNhat)
+	if d.HashVersion == HashV2 {
+		b.danhSach("DanhSachMaDongGoi", d.DanhSachMaDongGoi)
+	} else {
+		b.truong("SoMaDongGoi", strconv.Itoa(len(d.DanhSachMaDongGoi)))
+		b.truong("MerkleRootMaDongGoi", d.MerkleRootMaDongGoi)
+	}
+	b.truong("HoanThanhDongGoi", strconv.FormatBool(d.HoanThanhDongGoi))
+	b.truong("HashValueOffchain", d.HashValueOffchain)
+	b.truong("HashPb", d.HashPb)
+	b.truong("HashDauVao", d.HashDauVao)
+	b.truong("SoLuong", strconv.Itoa(d.SoLuong))
+	b.truong("DonViDoSoLuong", d.DonViDoSoLuong)
+	b.truong("HSD", d.HSD)
+	if d.ThuHoi == nil {
+		b.danhSach("ThuHoi", nil)
+	} else {
+		b.danhSach("ThuHoi", []string{d.ThuHoi.LyDo, d.ThuHoi.MucDo, d.ThuHoi.ThucHien, d.ThuHoi.ThoiGian, d.ThuHoi.TxID})
+	}
+	b.truong("HetHan", strconv.FormatBool(d.HetHan))
+	b.danhSach("DanhSachSanPhamNguon", d.DanhSachSanPhamNguon)
+	b.danhSach("DanhSachSanPhamCon", d.DanhSachSanPhamCon)
+	hashv := sha256.Sum256(b.buffer.Bytes())
+	return hex.EncodeToString(hashv[:])
+}
@@ -0,0 +1,178 @@
+package chaincode
+
+import "testing"
+
+// banGhiMau returns a record with every sealed field set
+func banGhiMau(phienBan int) Data {
+	d := Data{
+		ID:                   "p1",
+		TenSanPham:           "Gạo",
+		NhaSanXuat:           "nsx1",
+		ThoiGian:             "2026-01-01T00:00:00Z",
+		DiaDiem:              "Hà Nội",
+		ToaDo:                "21.0,105.8",
+		MoTa:                 "mô tả",
+		TrangThai:            "ĐÓNG GÓI",
+		ThucHien:             "Org1MSP::alice",
+		ChuThe:               "Org1MSP::alice",
+		DaiDien:              "Org1MSP::bob",
+		DanhSachChuyenGiao:   []string{"Org1MSP::alice"},
+		ChuyenGiaoMoiNhat:    "Org1MSP::alice",
+		ThoiDiemNhan:         "0001",
+		DanhSachFormID:       []string{"f1"},
+		FormIDMoiNhat:        "f1",
+		MaDongGoiMoiNhat:     "u2",
+		DanhSachMaDongGoi:    []string{"u1", "u2"},
+		HoanThanhDongGoi:     true,
+		HashValueOffchain:    "off",
+		HashPb:               "pb",
+		HashDauVao:           "in",
+		HashVersion:          phienBan,
+		SoLuong:              2,
+		DonViDoSoLuong:       "kg",
+		HSD:                  "31/12/2026",
+		ThuHoi:               &ThongTinThuHoi{LyDo: "x", MucDo: MucDoThuHoiCao, ThucHien: "Org1MSP::alice", ThoiGian: "t", TxID: "tx"},
+		HetHan:               true,
+		DanhSachSanPhamNguon: []string{"k0"},
+		DanhSachSanPhamCon:   []string{"k2"},
+	}
+	d.MerkleRootMaDongGoi = merkleRoot(d.DanhSachMaDongGoi)
+	return d
+}
+
+func TestHashChuanTachBietTruong(t *testing.T) {
+	for _, phienBan := range []int{HashV2, HashV3} {
+		a := Data{ID: "ab", TenSanPham: "c", HashVersion: phienBan}
+		b := Data{ID: "a", TenSanPham: "bc", HashVersion: phienBan}
+		if hashChuan(&a) == hashChuan(&b) {
+			t.Fatalf("HashV%d: dời ranh giới giữa hai trường cho cùng mã băm", phienBan)
+		}
+		a = Data{DanhSachFormID: []string{"a", "b"}, HashVersion: phienBan}
+		b = Data{DanhSachFormID: []string{"ab"}, HashVersion: phienBan}
+		if hashChuan(&a) == hashChuan(&b) {
+			t.Fatalf("HashV%d: gộp phần tử danh sách cho cùng mã băm", phienBan)
+		}
+		a = Data{DanhSachFormID: []string{"a"}, FormIDMoiNhat: "", HashVersion: phienBan}
+		b = Data{DanhSachFormID: []string{}, FormIDMoiNhat: "a", HashVersion: phienBan}
+		if hashChuan(&a) == hashChuan(&b) {
+			t.Fatalf("HashV%d: chuyển giá trị sang trường kế tiếp cho cùng mã băm", phienBan)
+		}
+	}
+
+	// HashV1 nối chuỗi không phân cách nên không phân biệt được; đó là lý do nó chỉ còn để xác minh bản ghi cũ
+	a := Data{ID: "ab", TenSanPham: "c"}
+	b := Data{ID: "a", TenSanPham: "bc"}
+	if hashV1(&a) != hashV1(&b) {
+		t.Fatal("HashV1 được kỳ vọng nối chuỗi không phân cách")
+	}
+}
+
+func TestHashChuanPhuMoiTruong(t *testing.T) {
+	doi := map[string]func(d *Data){
+		"ID":                   func(d *Data) { d.ID = "p2" },
+		"TenSanPham":           func(d *Data) { d.TenSanPham = "Gạo nếp" },
+		"NhaSanXuat":           func(d *Data) { d.NhaSanXuat = "nsx2" },
+		"ThoiGian":             func(d *Data) { d.ThoiGian = "2026-01-02T00:00:00Z" },
+		"DiaDiem":              func(d *Data) { d.DiaDiem = "Huế" },
+		"ToaDo":                func(d *Data) { d.ToaDo = "0,0" },
+		"MoTa":                 func(d *Data) { d.MoTa = "" },
+		"TrangThai":            func(d *Data) { d.TrangThai = "A" },
+		"ThucHien":             func(d *Data) { d.ThucHien = "Org1MSP::bob" },
+		"ChuThe":               func(d *Data) { d.ChuThe = "Org1MSP::bob" },
+		"DaiDien":              func(d *Data) { d.DaiDien = "" },
+		"DanhSachChuyenGiao":   func(d *Data) { d.DanhSachChuyenGiao = append(d.DanhSachChuyenGiao, "Org1MSP::bob") },
+		"ChuyenGiaoMoiNhat":    func(d *Data) { d.ChuyenGiaoMoiNhat = "Org1MSP::bob" },
+		"DanhSachFormID":       func(d *Data) { d.DanhSachFormID = nil },
+		"FormIDMoiNhat":        func(d *Data) { d.FormIDMoiNhat = "f2" },
+		"MaDongGoiMoiNhat":     func(d *Data) { d.MaDongGoiMoiNhat = "u1" },
+		"DanhSachMaDongGoi":    func(d *Data) { d.DanhSachMaDongGoi = append(d.DanhSachMaDongGoi, "u3") },
+		"HoanThanhDongGoi":     func(d *Data) { d.HoanThanhDongGoi = false },
+		"HashValueOffchain":    func(d *Data) { d.HashValueOffchain = "" },
+		"HashPb":               func(d *Data) { d.HashPb = "pb2" },
+		"HashDauVao":           func(d *Data) { d.HashDauVao = "" },
+		"SoLuong":              func(d *Data) { d.SoLuong = 3 },
+		"DonViDoSoLuong":       func(d *Data) { d.DonViDoSoLuong = "g" },
+		"HSD":                  func(d *Data) { d.HSD = "" },
+		"ThuHoi":               func(d *Data) { d.ThuHoi = nil },
+		"ThuHoi.LyDo":          func(d *Data) { d.ThuHoi = &ThongTinThuHoi{LyDo: "y", MucDo: MucDoThuHoiCao} },
+		"HetHan":               func(d *Data) { d.HetHan = false },
+		"DanhSachSanPhamNguon": func(d *Data) { d.DanhSachSanPhamNguon = nil },
+		"DanhSachSanPhamCon":   func(d *Data) { d.DanhSachSanPhamCon = []string{"k3"} },
+	}
+	for _, phienBan := range []int{HashV2, HashV3} {
+		goc := banGhiMau(phienBan)
+		hashGoc := hashChuan(&goc)
+		for ten, fn := range doi {
+			d := banGhiMau(phienBan)
+			fn(&d)
+			if ten == "DanhSachMaDongGoi" && phienBan == HashV3 {
+				// HashV3 niêm phong danh sách mã qua Merkle root
+				d.MerkleRootMaDongGoi = merkleRoot(d.DanhSachMaDongGoi)
+			}
+			if hashChuan(&d) == hashGoc {
+				t.Errorf("HashV%d không phủ trường %s", phienBan, ten)
+			}
+		}
+
+		// HashValue và ThoiDiemNhan nằm ngoài niêm phong
+		d := banGhiMau(phienBan)
+		d.HashValue = "khác"
+		d.ThoiDiemNhan = "9999"
+		if hashChuan(&d) != hashGoc {
+			t.Errorf("HashV%d phụ thuộc HashValue hoặc ThoiDiemNhan", phienBan)
+		}
+	}
+}
+
+func TestTinhHashTheoPhienBan(t *testing.T) {
+	for _, phienBan := range []int{0, HashV1} {
+		d := banGhiMau(phienBan)
+		if tinhHash(&d) != hashV1(&d) {
+			t.Fatalf("HashVersion %d phải tính bằng HashV1", phienBan)
+		}
+	}
+	for _, phienBan := range []int{HashV2, HashV3} {
+		d := banGhiMau(phienBan)
+		if tinhHash(&d) != hashChuan(&d) {
+			t.Fatalf("HashVersion %d phải tính bằng lược đồ chuẩn", phienBan)
+		}
+	}
+
+	// Cùng nội dung nhưng khác phiên bản thì khác mã băm
+	v2 := banGhiMau(HashV2)
+	v3 := banGhiMau(HashV3)
+	if tinhHash(&v2) == tinhHash(&v3) {
+		t.Fatal("HashV2 và HashV3 cho cùng mã băm")
+	}
+
+	// HashV2 niêm phong từng mã; HashV3 chỉ niêm phong số mã và Merkle root
+	gocV2 := banGhiMau(HashV2)
+	v2.DanhSachMaDongGoi = []string{"u1", "x"}
+	if tinhHash(&v2) == tinhHash(&gocV2) {
+		t.Fatal("HashV2 không phụ thuộc danh sách mã")
+	}
+	goc := banGhiMau(HashV3)
+	v3.DanhSachMaDongGoi = []string{"u1", "x"}
+	if tinhHash(&v3) != tinhHash(&goc) {
+		t.Fatal("HashV3 phải niêm phong danh sách mã qua Merkle root")
+	}
+	v3.MerkleRootMaDongGoi = merkleRoot(v3.DanhSachMaDongGoi)
+	if tinhHash(&v3) == tinhHash(&goc) {
+		t.Fatal("HashV3 không phụ thuộc Merkle root")
+	}
+}
+
+func TestComputeHashValue(t *testing.T) {
+	d := banGhiMau(HashV1)
+	d.MerkleRootMaDongGoi = ""
+	hashv := computeHashValue(&d, "dau-vao")
+	if d.HashVersion != phienBanHashHienTai || d.HashDauVao != "dau-vao" {
+		t.Fatalf("computeHashValue không ghi phiên bản hoặc đầu vào: %d %q", d.HashVersion, d.HashDauVao)
+	}
+	if d.MerkleRootMaDongGoi != merkleRoot(d.DanhSachMaDongGoi) {
+		t.Fatal("computeHashValue không ghi Merkle root")
+	}
+	if hashv != tinhHash(&d) {
+		t.Fatal("computeHashValue và tinhHash không khớp")
+	}
+}
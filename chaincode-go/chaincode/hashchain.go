@@ -0,0 +1,178 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Link states reported by VerifyHashChain
+const (
+	MatXichHopLe        = "HOP_LE"
+	MatXichKhongDoi     = "KHONG_DOI"
+	MatXichDutLienKet   = "DUT_LIEN_KET"
+	MatXichSaiHash      = "SAI_HASH"
+	MatXichKhongXacMinh = "KHONG_XAC_MINH"
+	MatXichDaXoa        = "DA_XOA"
+)
+
+// MatXichHash struct
+type MatXichHash struct {
+	PhienBan    int    `json:"PhienBan"`
+	TxId        string `json:"TxId"`
+	Timestamp   string `json:"Timestamp"`
+	TxIdTruoc   string `json:"TxIdTruoc"`
+	HashVersion int    `json:"HashVersion"`
+	HashValue   string `json:"HashValue"`
+	HashPb      string `json:"HashPb"`
+	HashTinhLai string `json:"HashTinhLai"`
+	TrangThai   string `json:"TrangThai"`
+}
+
+// KetQuaXacMinhHash struct
+type KetQuaXacMinhHash struct {
+	NhaSanXuat           string        `json:"NhaSanXuat"`
+	ID                   string        `json:"ID"`
+	HopLe                bool          `json:"HopLe"`
+	DayDu                bool          `json:"DayDu"`
+	SoPhienBan           int           `json:"SoPhienBan"`
+	PhienBanLoi          int           `json:"PhienBanLoi"`
+	TxIdLoi              string        `json:"TxIdLoi"`
+	DanhSachThieuLienKet []MatXichHash `json:"DanhSachThieuLienKet"`
+	DanhSach             []MatXichHash `json:"DanhSach"`
+}
+
+// xacMinhChuoiHash replays the history of a product key, oldest first, and checks every link.
+// A version whose HashValue and HashPb equal the previous one only touched bookkeeping fields and is not a link,
+// but it is still recomputed so a rewrite of sealed fields that kept the old seal shows up as SAI_HASH.
+// Each version is recomputed with the scheme named by its HashVersion, so old and new records verify side by side.
+// Versions written before HashDauVao was recorded can only be recomputed when that input was empty.
+func xacMinhChuoiHash(ctx contractapi.TransactionContextInterface, nhaSanXuat string, id string) (*KetQuaXacMinhHash, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(nhaSanXuat, []string{nhaSanXuat, id})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key: %s", err)
+	}
+	queryIterator, err := ctx.GetStub().GetHistoryForKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi truy vấn lịch sử: %s", err)
+	}
+	defer queryIterator.Close()
+
+	// Lịch sử trả về mới nhất trước
+	danhSach := []MatXichHash{}
+	giaTri := [][]byte{}
+	for queryIterator.HasNext() {
+		item, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("lỗi lặp truy vấn lịch sử: %s", err)
+		}
+		matXich := MatXichHash{
+			TxId:      item.TxId,
+			Timestamp: time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).String(),
+		}
+		if item.IsDelete {
+			matXich.TrangThai = MatXichDaXoa
+		}
+		danhSach = append([]MatXichHash{matXich}, danhSach...)
+		giaTri = append([][]byte{item.Value}, giaTri...)
+	}
+	if len(danhSach) == 0 {
+		return nil, fmt.Errorf("bản ghi không tồn tại")
+	}
+
+	ketQua := &KetQuaXacMinhHash{
+		NhaSanXuat:           nhaSanXuat,
+		ID:                   id,
+		HopLe:                true,
+		DayDu:                true,
+		SoPhienBan:           len(danhSach),
+		DanhSachThieuLienKet: []MatXichHash{},
+	}
+	var truoc *MatXichHash
+	for i := range danhSach {
+		matXich := &danhSach[i]
+		matXich.PhienBan = i + 1
+		if matXich.TrangThai == MatXichDaXoa {
+			// Bản ghi tạo lại sau khi xóa bắt đầu chuỗi mới
+			truoc = nil
+			continue
+		}
+
+		var d Data
+		if err := json.Unmarshal(giaTri[i], &d); err != nil {
+			return nil, fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+		}
+		var truong map[string]json.RawMessage
+		if err := json.Unmarshal(giaTri[i], &truong); err != nil {
+			return nil, fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+		}
+		_, coDauVao := truong["HashDauVao"]
+		matXich.HashVersion = d.HashVersion
+		if matXich.HashVersion == 0 {
+			matXich.HashVersion = HashV1
+		}
+		matXich.HashValue = d.HashValue
+		matXich.HashPb = d.HashPb
+		if truoc != nil {
+			matXich.TxIdTruoc = truoc.TxId
+		}
+
+		// Phiên bản giữ nguyên HashValue và HashPb vẫn được tính lại, để mọi ghi đè không niêm phong lại đều bị phát hiện
+		khongDoi := truoc != nil && d.HashValue == truoc.HashValue && d.HashPb == truoc.HashPb
+		if truoc != nil && !khongDoi && d.HashPb != truoc.HashValue {
+			matXich.TrangThai = MatXichDutLienKet
+			ketQua.DanhSachThieuLienKet = append(ketQua.DanhSachThieuLienKet, *matXich)
+		} else {
+			matXich.HashTinhLai = tinhHash(&d)
+			switch {
+			case d.HashVersion >= HashV3 && merkleRoot(d.DanhSachMaDongGoi) != d.MerkleRootMaDongGoi:
+				// Danh sách mã không còn khớp với Merkle root đã niêm phong
+				matXich.TrangThai = MatXichSaiHash
+			case matXich.HashTinhLai == d.HashValue && khongDoi:
+				matXich.TrangThai = MatXichKhongDoi
+			case matXich.HashTinhLai == d.HashValue:
+				matXich.TrangThai = MatXichHopLe
+			case coDauVao:
+				matXich.TrangThai = MatXichSaiHash
+			default:
+				matXich.TrangThai = MatXichKhongXacMinh
+				ketQua.DayDu = false
+			}
+		}
+		if matXich.TrangThai == MatXichDutLienKet || matXich.TrangThai == MatXichSaiHash {
+			if ketQua.HopLe {
+				ketQua.PhienBanLoi = matXich.PhienBan
+				ketQua.TxIdLoi = matXich.TxId
+			}
+			ketQua.HopLe = false
+			ketQua.DayDu = false
+		}
+		truoc = matXich
+	}
+	ketQua.DanhSach = danhSach
+	return ketQua, nil
+}
+
+// VerifyHashChain recomputes the hash chain of a product from its ledger history.
+// It reports the first broken version and every version whose HashPb does not point at the previous HashValue.
+func (s *SmartContract) VerifyHashChain(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data Data
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NhaSanXuat == "" || data.ID == "" {
+		return "", fmt.Errorf("thiếu nhà sản xuất hoặc mã sản phẩm")
+	}
+
+	ketQua, err := xacMinhChuoiHash(ctx, data.NhaSanXuat, data.ID)
+	if err != nil {
+		return "", err
+	}
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
@@ -0,0 +1,395 @@
+package chaincode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// AnhXaDanhTinh struct
+type AnhXaDanhTinh struct {
+	Cu    string `json:"Cu"`
+	MSPID string `json:"MSPID"`
+	Moi   string `json:"Moi"`
+}
+
+// ChuyenDoiDanhTinh struct
+type ChuyenDoiDanhTinh struct {
+	DanhSachAnhXa      []AnhXaDanhTinh `json:"DanhSachAnhXa"`
+	DanhSachNhaSanXuat []string        `json:"DanhSachNhaSanXuat"`
+}
+
+// DanhTinhDaChuyenDoi struct
+type DanhTinhDaChuyenDoi struct {
+	Cu       string `json:"Cu"`
+	Moi      string `json:"Moi"`
+	ThoiGian string `json:"ThoiGian"`
+	TxID     string `json:"TxID"`
+}
+
+// KetQuaChuyenDoi struct
+type KetQuaChuyenDoi struct {
+	DanhSachAnhXa    []AnhXaDanhTinh `json:"DanhSachAnhXa"`
+	SoSanPham        int             `json:"SoSanPham"`
+	SoDanhSach       int             `json:"SoDanhSach"`
+	SoChiMucNguoiGiu int             `json:"SoChiMucNguoiGiu"`
+	SoDeNghi         int             `json:"SoDeNghi"`
+	SoNhaSanXuat     int             `json:"SoNhaSanXuat"`
+	SoChiMucBanHang  int             `json:"SoChiMucBanHang"`
+}
+
+// cnTuDanhTinhCu recovers the CN from an owner string written before identities were MSP-qualified.
+// Those values are either the base64 x509 ID returned by GetID or a bare username.
+func cnTuDanhTinhCu(cu string) string {
+	chuoi := cu
+	if b, err := base64.StdEncoding.DecodeString(cu); err == nil && strings.HasPrefix(string(b), "x509::") {
+		chuoi = string(b)
+	}
+	if !strings.HasPrefix(chuoi, "x509::") {
+		if strings.ContainsAny(chuoi, "=,:") {
+			return ""
+		}
+		return chuoi
+	}
+	chuoi = strings.TrimPrefix(chuoi, "x509::")
+	if i := strings.Index(chuoi, "::"); i >= 0 {
+		chuoi = chuoi[:i]
+	}
+	for _, phan := range strings.Split(chuoi, ",") {
+		phan = strings.TrimSpace(phan)
+		if strings.HasPrefix(phan, "CN=") {
+			return strings.TrimPrefix(phan, "CN=")
+		}
+	}
+	return ""
+}
+
+// thayDanhTinh replaces a legacy identity with its new form, reporting whether anything changed
+func thayDanhTinh(giaTri *string, anhXa map[string]string) bool {
+	if moi, ok := anhXa[*giaTri]; ok {
+		*giaTri = moi
+		return true
+	}
+	return false
+}
+
+// MigrateIdentities rewrites legacy owner strings into MSP-qualified identities.
+// It covers products of every registered manufacturer plus any namespace listed, owner lists,
+// transfer proposals, manufacturer member lists and the seller index of sales receipts.
+// Each legacy identity can only be migrated once.
+func (s *SmartContract) MigrateIdentities(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data ChuyenDoiDanhTinh
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if len(data.DanhSachAnhXa) == 0 {
+		return "", fmt.Errorf("danh sách ánh xạ rỗng")
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	anhXa := map[string]string{}
+	ketQua := KetQuaChuyenDoi{}
+	for _, element := range data.DanhSachAnhXa {
+		if element.Cu == "" {
+			return "", fmt.Errorf("thiếu danh tính cũ")
+		}
+		if element.Moi == "" {
+			cn := cnTuDanhTinhCu(element.Cu)
+			if cn == "" || element.MSPID == "" {
+				return "", fmt.Errorf("không xác định được danh tính mới cho %s", element.Cu)
+			}
+			element.Moi = taoDanhTinh(element.MSPID, cn)
+		}
+		if _, ok := anhXa[element.Cu]; ok {
+			return "", fmt.Errorf("danh tính cũ bị trùng: %s", element.Cu)
+		}
+
+		keyDaChuyen, err := ctx.GetStub().CreateCompositeKey("DanhTinhDaChuyenDoi", []string{element.Cu})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key chuyển đổi: %s", err)
+		}
+		if exist, err := Exist(ctx, keyDaChuyen); err != nil {
+			return "", err
+		} else if exist != nil {
+			return "", fmt.Errorf("danh tính %s đã được chuyển đổi", element.Cu)
+		}
+
+		anhXa[element.Cu] = element.Moi
+		ketQua.DanhSachAnhXa = append(ketQua.DanhSachAnhXa, element)
+	}
+
+	// Sản phẩm trong các không gian nhà sản xuất
+	khongGian := map[string]bool{}
+	for _, nhaSanXuat := range data.DanhSachNhaSanXuat {
+		khongGian[nhaSanXuat] = true
+	}
+	dangKyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("NhaSanXuatDangKy", []string{})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn nhà sản xuất: %s", err)
+	}
+	defer dangKyIterator.Close()
+	for dangKyIterator.HasNext() {
+		item, err := dangKyIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn nhà sản xuất: %s", err)
+		}
+		var dangKy DangKyNhaSanXuat
+		if err := json.Unmarshal(item.Value, &dangKy); err != nil {
+			return "", fmt.Errorf("lỗi phân tích bản ghi nhà sản xuất: %s", err)
+		}
+		khongGian[dangKy.NhaSanXuat] = true
+
+		doi := false
+		for i := range dangKy.DanhSachThanhVien {
+			if thayDanhTinh(&dangKy.DanhSachThanhVien[i], anhXa) {
+				doi = true
+			}
+		}
+		if doi {
+			asBytes, err := json.Marshal(dangKy)
+			if err != nil {
+				return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+			}
+			if err := ctx.GetStub().PutState(item.Key, asBytes); err != nil {
+				return "", fmt.Errorf("không thể cập nhật bản ghi nhà sản xuất: %s", err)
+			}
+			ketQua.SoNhaSanXuat++
+		}
+	}
+
+	// Duyệt theo thứ tự cố định để mọi peer ghi giống nhau
+	danhSachKhongGian := make([]string, 0, len(khongGian))
+	for nhaSanXuat := range khongGian {
+		danhSachKhongGian = append(danhSachKhongGian, nhaSanXuat)
+	}
+	sort.Strings(danhSachKhongGian)
+	for _, nhaSanXuat := range danhSachKhongGian {
+		keys, products, err := danhSachSanPhamCuaNhaSanXuat(ctx, nhaSanXuat)
+		if err != nil {
+			return "", err
+		}
+		for i := range products {
+			product := products[i]
+			doi := thayDanhTinh(&product.ChuyenGiaoMoiNhat, anhXa)
+			if thayDanhTinh(&product.ThucHien, anhXa) {
+				doi = true
+			}
+			for j := range product.DanhSachChuyenGiao {
+				if thayDanhTinh(&product.DanhSachChuyenGiao[j], anhXa) {
+					doi = true
+				}
+			}
+			if !doi {
+				continue
+			}
+			// Các trường danh tính nằm trong niêm phong nên bản ghi được niêm phong lại, nối tiếp bản cũ
+			product.HashPb = product.HashValue
+			product.HashValue = computeHashValue(&product, "")
+			if _, err := putSanPham(ctx, keys[i], &product); err != nil {
+				return "", err
+			}
+			ketQua.SoSanPham++
+		}
+	}
+
+	// Danh sách sản phẩm theo người giữ; gom theo danh tính mới trước khi ghi
+	danhSachMoi := map[string]*DanhSachSanPham{}
+	var thuTuMoi []string
+	for _, element := range ketQua.DanhSachAnhXa {
+		keyCu, err := ctx.GetStub().CreateCompositeKey(element.Cu, []string{element.Cu, "danhSachSanPham"})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
+		}
+		existCu, err := Exist(ctx, keyCu)
+		if err != nil {
+			return "", err
+		}
+		if existCu == nil {
+			continue
+		}
+		var cu DanhSachSanPham
+		if err := json.Unmarshal(existCu, &cu); err != nil {
+			return "", fmt.Errorf("lỗi phân tích danh sách: %s", err)
+		}
+
+		moi, ok := danhSachMoi[element.Moi]
+		if !ok {
+			keyMoi, err := ctx.GetStub().CreateCompositeKey(element.Moi, []string{element.Moi, "danhSachSanPham"})
+			if err != nil {
+				return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
+			}
+			moi = &DanhSachSanPham{Username: element.Moi}
+			if existMoi, err := Exist(ctx, keyMoi); err != nil {
+				return "", err
+			} else if existMoi != nil {
+				if err := json.Unmarshal(existMoi, moi); err != nil {
+					return "", fmt.Errorf("lỗi phân tích danh sách: %s", err)
+				}
+			}
+			danhSachMoi[element.Moi] = moi
+			thuTuMoi = append(thuTuMoi, element.Moi)
+		}
+		daCo := map[string]bool{}
+		for _, keySanPham := range moi.DanhSach {
+			daCo[keySanPham] = true
+		}
+		for _, keySanPham := range cu.DanhSach {
+			if !daCo[keySanPham] {
+				daCo[keySanPham] = true
+				moi.DanhSach = append(moi.DanhSach, keySanPham)
+			}
+		}
+		if moi.SanPhamMoi == "" {
+			moi.SanPhamMoi = cu.SanPhamMoi
+		}
+
+		if err := ctx.GetStub().DelState(keyCu); err != nil {
+			return "", fmt.Errorf("không thể xóa danh sách cũ: %s", err)
+		}
+		ketQua.SoDanhSach++
+	}
+	for _, danhTinh := range thuTuMoi {
+		keyMoi, err := ctx.GetStub().CreateCompositeKey(danhTinh, []string{danhTinh, "danhSachSanPham"})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
+		}
+		listBytes, err := json.Marshal(danhSachMoi[danhTinh])
+		if err != nil {
+			return "", fmt.Errorf("lỗi mã hóa danh sách: %s", err)
+		}
+		if err := ctx.GetStub().PutState(keyMoi, listBytes); err != nil {
+			return "", fmt.Errorf("không thể cập nhật danh sách: %s", err)
+		}
+	}
+
+	// Chỉ mục sản phẩm theo người giữ
+	daChuyen := map[string]bool{}
+	for _, element := range ketQua.DanhSachAnhXa {
+		soChiMuc, err := chuyenChiMucNguoiGiu(ctx, element.Cu, element.Moi, daChuyen)
+		if err != nil {
+			return "", err
+		}
+		ketQua.SoChiMucNguoiGiu += soChiMuc
+	}
+
+	// Đề nghị chuyển giao và chỉ mục chờ nhận
+	deNghiIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeNghiChuyenGiao", []string{})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn đề nghị chuyển giao: %s", err)
+	}
+	defer deNghiIterator.Close()
+	for deNghiIterator.HasNext() {
+		item, err := deNghiIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn đề nghị chuyển giao: %s", err)
+		}
+		var deNghi DeNghiChuyenGiao
+		if err := json.Unmarshal(item.Value, &deNghi); err != nil {
+			return "", fmt.Errorf("lỗi phân tích đề nghị chuyển giao: %s", err)
+		}
+		nguoiNhanCu := deNghi.NguoiNhan
+		doiNguoiGui := thayDanhTinh(&deNghi.NguoiGui, anhXa)
+		doiNguoiNhan := thayDanhTinh(&deNghi.NguoiNhan, anhXa)
+		if !doiNguoiGui && !doiNguoiNhan {
+			continue
+		}
+		asBytes, err := json.Marshal(deNghi)
+		if err != nil {
+			return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+		}
+		if err := ctx.GetStub().PutState(item.Key, asBytes); err != nil {
+			return "", fmt.Errorf("không thể cập nhật đề nghị chuyển giao: %s", err)
+		}
+		if doiNguoiNhan && deNghi.TrangThai == DeNghiChoXacNhan {
+			keyCu, err := ctx.GetStub().CreateCompositeKey("DeNghiChoNhan", []string{nguoiNhanCu, deNghi.NhaSanXuat, deNghi.ID})
+			if err != nil {
+				return "", fmt.Errorf("lỗi tạo key đề nghị chờ nhận: %s", err)
+			}
+			keyMoi, err := ctx.GetStub().CreateCompositeKey("DeNghiChoNhan", []string{deNghi.NguoiNhan, deNghi.NhaSanXuat, deNghi.ID})
+			if err != nil {
+				return "", fmt.Errorf("lỗi tạo key đề nghị chờ nhận: %s", err)
+			}
+			if err := ctx.GetStub().DelState(keyCu); err != nil {
+				return "", fmt.Errorf("không thể xóa đề nghị chờ nhận: %s", err)
+			}
+			if err := ctx.GetStub().PutState(keyMoi, []byte(item.Key)); err != nil {
+				return "", fmt.Errorf("không thể tạo đề nghị chờ nhận: %s", err)
+			}
+		}
+		ketQua.SoDeNghi++
+	}
+
+	// Chỉ mục giao dịch theo người bán; biên nhận giữ nguyên vì bất biến
+	for _, element := range ketQua.DanhSachAnhXa {
+		banIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("GiaoDichTheoNguoiBan", []string{element.Cu})
+		if err != nil {
+			return "", fmt.Errorf("lỗi truy vấn chỉ mục giao dịch: %s", err)
+		}
+		for banIterator.HasNext() {
+			item, err := banIterator.Next()
+			if err != nil {
+				banIterator.Close()
+				return "", fmt.Errorf("lỗi lặp truy vấn chỉ mục giao dịch: %s", err)
+			}
+			_, attributes, err := ctx.GetStub().SplitCompositeKey(item.Key)
+			if err != nil {
+				banIterator.Close()
+				return "", fmt.Errorf("lỗi tách key: %s", err)
+			}
+			attributes[0] = element.Moi
+			keyMoi, err := ctx.GetStub().CreateCompositeKey("GiaoDichTheoNguoiBan", attributes)
+			if err != nil {
+				banIterator.Close()
+				return "", fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+			}
+			if err := ctx.GetStub().PutState(keyMoi, item.Value); err != nil {
+				banIterator.Close()
+				return "", fmt.Errorf("không thể tạo chỉ mục giao dịch: %s", err)
+			}
+			if err := ctx.GetStub().DelState(item.Key); err != nil {
+				banIterator.Close()
+				return "", fmt.Errorf("không thể xóa chỉ mục giao dịch: %s", err)
+			}
+			ketQua.SoChiMucBanHang++
+		}
+		banIterator.Close()
+	}
+
+	for _, element := range ketQua.DanhSachAnhXa {
+		keyDaChuyen, err := ctx.GetStub().CreateCompositeKey("DanhTinhDaChuyenDoi", []string{element.Cu})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key chuyển đổi: %s", err)
+		}
+		banGhi, err := json.Marshal(DanhTinhDaChuyenDoi{
+			Cu:       element.Cu,
+			Moi:      element.Moi,
+			ThoiGian: txTime.Format(time.RFC3339),
+			TxID:     ctx.GetStub().GetTxID(),
+		})
+		if err != nil {
+			return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+		}
+		if err := ctx.GetStub().PutState(keyDaChuyen, banGhi); err != nil {
+			return "", fmt.Errorf("không thể lưu bản ghi chuyển đổi: %s", err)
+		}
+	}
+
+	if err := phatSuKien(ctx, SuKienChuyenDoiDanhTinh, ketQua); err != nil {
+		return "", err
+	}
+
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
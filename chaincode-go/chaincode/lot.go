@@ -0,0 +1,386 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Statuses written by lot splitting and merging
+const (
+	TrangThaiTachLo = "TÁCH LÔ"
+	TrangThaiDaTach = "ĐÃ TÁCH LÔ"
+	TrangThaiGopLo  = "GỘP LÔ"
+	TrangThaiDaGop  = "ĐÃ GỘP LÔ"
+)
+
+// LoSanPham struct
+type LoSanPham struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	SoLuong    int    `json:"SoLuong"`
+}
+
+// TachSanPham struct
+type TachSanPham struct {
+	NhaSanXuat         string      `json:"NhaSanXuat"`
+	ID                 string      `json:"ID"`
+	DanhSachSanPhamCon []LoSanPham `json:"DanhSachSanPhamCon"`
+}
+
+// GopSanPham struct
+type GopSanPham struct {
+	DanhSachSanPham []LoSanPham `json:"DanhSachSanPham"`
+	NhaSanXuat      string      `json:"NhaSanXuat"`
+	ID              string      `json:"ID"`
+	TenSanPham      string      `json:"TenSanPham"`
+}
+
+// kiemTraCoTheChiaLo rejects lots that cannot be split or merged by the caller
+func kiemTraCoTheChiaLo(owner string, keySanPham string, d *Data) error {
+	if d.ChuyenGiaoMoiNhat != owner {
+		return fmt.Errorf("không có quyền với sản phẩm %s", keySanPham)
+	}
+	if d.ThuHoi != nil {
+		return fmt.Errorf("sản phẩm %s đã bị thu hồi", keySanPham)
+	}
+	if d.HetHan {
+		return fmt.Errorf("sản phẩm %s đã hết hạn sử dụng", keySanPham)
+	}
+	if d.MaDongGoiMoiNhat != "" || d.HoanThanhDongGoi {
+		return fmt.Errorf("sản phẩm %s đã đóng gói, không thể chia lô", keySanPham)
+	}
+	if d.SoLuong <= 0 {
+		return fmt.Errorf("sản phẩm %s không còn số lượng", keySanPham)
+	}
+	return nil
+}
+
+// getSanPham reads a product record by its ledger key
+func getSanPham(ctx contractapi.TransactionContextInterface, keySanPham string) (*Data, error) {
+	exist, err := Exist(ctx, keySanPham)
+	if err != nil {
+		return nil, err
+	}
+	if exist == nil {
+		return nil, nil
+	}
+	var result Data
+	if err := json.Unmarshal(exist, &result); err != nil {
+		return nil, fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+	}
+	return &result, nil
+}
+
+// putSanPham writes a product record under its ledger key and keeps its search index in step
+func putSanPham(ctx contractapi.TransactionContextInterface, keySanPham string, d *Data) ([]byte, error) {
+	asBytes, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keySanPham, asBytes); err != nil {
+		return nil, fmt.Errorf("không thể cập nhật bản ghi: %s", err)
+	}
+	if _, err := capNhatChiMucTimKiem(ctx, keySanPham, d.NhaSanXuat, d.ID, d); err != nil {
+		return nil, err
+	}
+	return asBytes, nil
+}
+
+// taoLoPhaiSinh creates a lot derived from one or more source lots held by the caller
+func taoLoPhaiSinh(ctx contractapi.TransactionContextInterface, owner string, mau *Data, nhaSanXuat string, id string, soLuong int, nguon []string, hashPb string, trangThai string, moTa string, thoiGian string) (string, *Data, error) {
+	if id == "" {
+		return "", nil, fmt.Errorf("thiếu mã sản phẩm mới")
+	}
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(nhaSanXuat, []string{nhaSanXuat, id})
+	if err != nil {
+		return "", nil, fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	exist, err := Exist(ctx, keySanPham)
+	if err != nil {
+		return "", nil, err
+	}
+	if exist != nil {
+		return "", nil, fmt.Errorf("bản ghi đã tồn tại: %s", keySanPham)
+	}
+	if err := kiemTraChuaBiHuy(ctx, nhaSanXuat, id); err != nil {
+		return "", nil, err
+	}
+	// Lô mới nằm ngoài không gian của các lô nguồn thì phải do nhà sản xuất đó tạo
+	cungKhongGian := len(nguon) > 0
+	for _, keyNguon := range nguon {
+		nsxNguon, _, err := ctx.GetStub().SplitCompositeKey(keyNguon)
+		if err != nil {
+			return "", nil, fmt.Errorf("lỗi tách key: %s", err)
+		}
+		if nsxNguon != nhaSanXuat {
+			cungKhongGian = false
+		}
+	}
+	if !cungKhongGian {
+		if err := kiemTraNhaSanXuat(ctx, nhaSanXuat); err != nil {
+			return "", nil, err
+		}
+	}
+
+	lo := Data{
+		ID:                   id,
+		TenSanPham:           mau.TenSanPham,
+		NhaSanXuat:           nhaSanXuat,
+		ThoiGian:             thoiGian,
+		DiaDiem:              mau.DiaDiem,
+		ToaDo:                mau.ToaDo,
+		MoTa:                 moTa,
+		TrangThai:            trangThai,
+		ThucHien:             owner,
+		ChuThe:               owner,
+		DanhSachChuyenGiao:   append([]string{}, mau.DanhSachChuyenGiao...),
+		ChuyenGiaoMoiNhat:    owner,
+		DanhSachFormID:       []string{},
+		HashPb:               hashPb,
+		SoLuong:              soLuong,
+		DonViDoSoLuong:       mau.DonViDoSoLuong,
+		HSD:                  mau.HSD,
+		DanhSachSanPhamNguon: nguon,
+	}
+	lo.HashValue = computeHashValue(&lo, "")
+
+	if err := ghiNhanNguoiGiu(ctx, keySanPham, &lo); err != nil {
+		return "", nil, err
+	}
+	if _, err := putSanPham(ctx, keySanPham, &lo); err != nil {
+		return "", nil, err
+	}
+	return keySanPham, &lo, nil
+}
+
+// SplitProduct breaks a lot into child lots that carry part of its quantity
+func (s *SmartContract) SplitProduct(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data TachSanPham
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if len(data.DanhSachSanPhamCon) == 0 {
+		return "", fmt.Errorf("danh sách lô con rỗng")
+	}
+	if err := kiemTraThanhVienHoatDong(ctx, owner); err != nil {
+		return "", err
+	}
+
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	result, err := getSanPham(ctx, keySanPham)
+	if err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", fmt.Errorf("sản phẩm không tồn tại")
+	}
+	if err := kiemTraCoTheChiaLo(owner, keySanPham, result); err != nil {
+		return "", err
+	}
+
+	// GetState không thấy ghi trong cùng giao dịch nên mã lô con trùng phải chặn ở đây
+	daThem := map[string]bool{}
+	tong := 0
+	for _, con := range data.DanhSachSanPhamCon {
+		if daThem[con.ID] {
+			return "", fmt.Errorf("lô con bị trùng: %s", con.ID)
+		}
+		daThem[con.ID] = true
+		if con.SoLuong <= 0 {
+			return "", fmt.Errorf("số lượng lô con %s không hợp lệ: %d", con.ID, con.SoLuong)
+		}
+		tong += con.SoLuong
+	}
+	if tong > result.SoLuong {
+		return "", fmt.Errorf("tổng số lượng tách (%d) vượt quá số lượng lô (%d)", tong, result.SoLuong)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	thoiGian := txTime.Format(time.RFC3339)
+
+	result.SoLuong -= tong
+	result.TrangThai = TrangThaiDaTach
+	result.MoTa = "Tách " + strconv.Itoa(tong) + " " + result.DonViDoSoLuong + " thành " + strconv.Itoa(len(data.DanhSachSanPhamCon)) + " lô con"
+	result.ThoiGian = thoiGian
+	result.ThucHien = owner
+	result.ChuThe = owner
+	result.DaiDien = ""
+	// Key lô con được ghi vào lô gốc trước khi tính hash để hash bao trùm cả danh sách này
+	for _, con := range data.DanhSachSanPhamCon {
+		keyCon, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, con.ID})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+		}
+		result.DanhSachSanPhamCon = append(result.DanhSachSanPhamCon, keyCon)
+	}
+	result.HashPb = result.HashValue
+	result.HashValue = computeHashValue(result, "")
+
+	loMoi := []*Data{result}
+	for _, con := range data.DanhSachSanPhamCon {
+		_, lo, err := taoLoPhaiSinh(ctx, owner, result, data.NhaSanXuat, con.ID, con.SoLuong, []string{keySanPham}, result.HashValue, TrangThaiTachLo, "Tách từ lô "+data.ID, thoiGian)
+		if err != nil {
+			return "", err
+		}
+		loMoi = append(loMoi, lo)
+	}
+
+	asBytes, err := putSanPham(ctx, keySanPham, result)
+	if err != nil {
+		return "", err
+	}
+	if err := phatSuKien(ctx, SuKienTachLo, nil, loMoi...); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// MergeProducts combines whole compatible lots held by the caller into a new lot
+func (s *SmartContract) MergeProducts(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data GopSanPham
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if len(data.DanhSachSanPham) < 2 {
+		return "", fmt.Errorf("cần ít nhất hai lô để gộp")
+	}
+	if err := kiemTraThanhVienHoatDong(ctx, owner); err != nil {
+		return "", err
+	}
+
+	var keys []string
+	var nguon []*Data
+	daThem := map[string]bool{}
+	tong := 0
+	for _, lo := range data.DanhSachSanPham {
+		keySanPham, err := ctx.GetStub().CreateCompositeKey(lo.NhaSanXuat, []string{lo.NhaSanXuat, lo.ID})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+		}
+		if daThem[keySanPham] {
+			return "", fmt.Errorf("lô bị trùng: %s", keySanPham)
+		}
+		daThem[keySanPham] = true
+
+		result, err := getSanPham(ctx, keySanPham)
+		if err != nil {
+			return "", err
+		}
+		if result == nil {
+			return "", fmt.Errorf("sản phẩm %s không tồn tại", keySanPham)
+		}
+		if err := kiemTraCoTheChiaLo(owner, keySanPham, result); err != nil {
+			return "", err
+		}
+		if len(nguon) > 0 {
+			dau := nguon[0]
+			if result.DonViDoSoLuong != dau.DonViDoSoLuong {
+				return "", fmt.Errorf("đơn vị đo của %s không khớp: %s khác %s", keySanPham, result.DonViDoSoLuong, dau.DonViDoSoLuong)
+			}
+			if data.TenSanPham == "" && result.TenSanPham != dau.TenSanPham {
+				return "", fmt.Errorf("các lô khác tên sản phẩm, cần chỉ định tên lô gộp")
+			}
+			if data.NhaSanXuat == "" && result.NhaSanXuat != dau.NhaSanXuat {
+				return "", fmt.Errorf("các lô khác nhà sản xuất, cần chỉ định nhà sản xuất của lô gộp")
+			}
+		}
+		keys = append(keys, keySanPham)
+		nguon = append(nguon, result)
+		tong += result.SoLuong
+	}
+
+	mau := *nguon[0]
+	if data.TenSanPham != "" {
+		mau.TenSanPham = data.TenSanPham
+	}
+	// Hạn sử dụng của lô gộp là hạn sớm nhất trong các lô nguồn; so sánh theo ngày vì HSD cũ có thể lưu dạng DD/MM/YYYY
+	var hsdSomNhat time.Time
+	for _, result := range nguon {
+		if result.HSD == "" {
+			continue
+		}
+		ngayHetHan, err := parseHSD(result.HSD)
+		if err != nil {
+			return "", err
+		}
+		if hsdSomNhat.IsZero() || ngayHetHan.Before(hsdSomNhat) {
+			hsdSomNhat = ngayHetHan
+		}
+	}
+	mau.HSD = ""
+	if !hsdSomNhat.IsZero() {
+		mau.HSD = hsdSomNhat.Format(dinhDangHSD)
+	}
+	nhaSanXuat := data.NhaSanXuat
+	if nhaSanXuat == "" {
+		nhaSanXuat = mau.NhaSanXuat
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	thoiGian := txTime.Format(time.RFC3339)
+
+	keyMoi, err := ctx.GetStub().CreateCompositeKey(nhaSanXuat, []string{nhaSanXuat, data.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+
+	// Chuỗi hash của lô gộp nối tiếp hash mới của từng lô nguồn
+	var hashNguon strings.Builder
+	for i, result := range nguon {
+		result.SoLuong = 0
+		result.TrangThai = TrangThaiDaGop
+		result.MoTa = "Gộp vào lô " + data.ID
+		result.ThoiGian = thoiGian
+		result.ThucHien = owner
+		result.ChuThe = owner
+		result.DaiDien = ""
+		result.DanhSachSanPhamCon = append(result.DanhSachSanPhamCon, keyMoi)
+		result.HashPb = result.HashValue
+		result.HashValue = computeHashValue(result, "")
+		if _, err := putSanPham(ctx, keys[i], result); err != nil {
+			return "", err
+		}
+		hashNguon.WriteString(result.HashValue)
+	}
+	hashv := sha256.Sum256([]byte(hashNguon.String()))
+
+	_, lo, err := taoLoPhaiSinh(ctx, owner, &mau, nhaSanXuat, data.ID, tong, keys, hex.EncodeToString(hashv[:]), TrangThaiGopLo, "Gộp từ "+strconv.Itoa(len(keys))+" lô", thoiGian)
+	if err != nil {
+		return "", err
+	}
+	if err := phatSuKien(ctx, SuKienGopLo, nil, append(nguon, lo)...); err != nil {
+		return "", err
+	}
+
+	asBytes, err := json.Marshal(lo)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
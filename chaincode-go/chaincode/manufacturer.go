@@ -0,0 +1,162 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DangKyNhaSanXuat struct
+type DangKyNhaSanXuat struct {
+	NhaSanXuat        string   `json:"NhaSanXuat"`
+	MSPID             string   `json:"MSPID"`
+	DanhSachThanhVien []string `json:"DanhSachThanhVien"`
+	NguoiDangKy       string   `json:"NguoiDangKy"`
+	ThoiGian          string   `json:"ThoiGian"`
+	TxID              string   `json:"TxID"`
+}
+
+// getDangKyNhaSanXuat reads the registration that owns a manufacturer namespace
+func getDangKyNhaSanXuat(ctx contractapi.TransactionContextInterface, nhaSanXuat string) (*DangKyNhaSanXuat, error) {
+	keyDangKy, err := ctx.GetStub().CreateCompositeKey("NhaSanXuatDangKy", []string{nhaSanXuat})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key nhà sản xuất: %s", err)
+	}
+	exist, err := Exist(ctx, keyDangKy)
+	if err != nil {
+		return nil, err
+	}
+	if exist == nil {
+		return nil, nil
+	}
+	var dangKy DangKyNhaSanXuat
+	if err := json.Unmarshal(exist, &dangKy); err != nil {
+		return nil, fmt.Errorf("lỗi phân tích bản ghi nhà sản xuất: %s", err)
+	}
+	return &dangKy, nil
+}
+
+// kiemTraNhaSanXuat checks that the caller belongs to the org and identity list registered for a namespace
+func kiemTraNhaSanXuat(ctx contractapi.TransactionContextInterface, nhaSanXuat string) error {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	return kiemTraThanhVienNhaSanXuat(ctx, nhaSanXuat, owner)
+}
+
+// kiemTraThanhVienNhaSanXuat does the same check for any identity, such as the principal of a delegate
+func kiemTraThanhVienNhaSanXuat(ctx contractapi.TransactionContextInterface, nhaSanXuat string, danhTinh string) error {
+	if nhaSanXuat == "" {
+		return fmt.Errorf("thiếu nhà sản xuất")
+	}
+	dangKy, err := getDangKyNhaSanXuat(ctx, nhaSanXuat)
+	if err != nil {
+		return err
+	}
+	if dangKy == nil {
+		return fmt.Errorf("%w: nhà sản xuất %s chưa được đăng ký", ErrKhongDuQuyen, nhaSanXuat)
+	}
+
+	if !strings.HasPrefix(danhTinh, dangKy.MSPID+"::") {
+		return fmt.Errorf("%w: tổ chức của %s không quản lý nhà sản xuất %s", ErrKhongDuQuyen, danhTinh, nhaSanXuat)
+	}
+	for _, thanhVien := range dangKy.DanhSachThanhVien {
+		if thanhVien == danhTinh {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: người dùng không thuộc nhà sản xuất %s", ErrKhongDuQuyen, nhaSanXuat)
+}
+
+// laThanhVienNhaSanXuat is kiemTraThanhVienNhaSanXuat for callers that branch on membership; only a failed read is an error
+func laThanhVienNhaSanXuat(ctx contractapi.TransactionContextInterface, nhaSanXuat string, danhTinh string) (bool, error) {
+	err := kiemTraThanhVienNhaSanXuat(ctx, nhaSanXuat, danhTinh)
+	if errors.Is(err, ErrKhongDuQuyen) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RegisterManufacturer binds a manufacturer namespace to an MSP and the identities allowed to act in it.
+// Registering an existing namespace again replaces its identity list but never moves it to another MSP.
+func (s *SmartContract) RegisterManufacturer(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data DangKyNhaSanXuat
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NhaSanXuat == "" || data.MSPID == "" {
+		return "", fmt.Errorf("thiếu nhà sản xuất hoặc MSP ID")
+	}
+	if len(data.DanhSachThanhVien) == 0 {
+		return "", fmt.Errorf("danh sách thành viên rỗng")
+	}
+
+	dangKyCu, err := getDangKyNhaSanXuat(ctx, data.NhaSanXuat)
+	if err != nil {
+		return "", err
+	}
+	if dangKyCu != nil && dangKyCu.MSPID != data.MSPID {
+		return "", fmt.Errorf("nhà sản xuất %s đã thuộc tổ chức %s", data.NhaSanXuat, dangKyCu.MSPID)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	dangKy := DangKyNhaSanXuat{
+		NhaSanXuat:        data.NhaSanXuat,
+		MSPID:             data.MSPID,
+		DanhSachThanhVien: data.DanhSachThanhVien,
+		NguoiDangKy:       owner,
+		ThoiGian:          txTime.Format(time.RFC3339),
+		TxID:              ctx.GetStub().GetTxID(),
+	}
+
+	keyDangKy, err := ctx.GetStub().CreateCompositeKey("NhaSanXuatDangKy", []string{data.NhaSanXuat})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key nhà sản xuất: %s", err)
+	}
+	asBytes, err := json.Marshal(dangKy)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyDangKy, asBytes); err != nil {
+		return "", fmt.Errorf("không thể lưu bản ghi nhà sản xuất: %s", err)
+	}
+	if err := phatSuKien(ctx, SuKienDangKyNhaSanXuat, dangKy); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// GetManufacturer returns the org and identities registered for a manufacturer namespace
+func (s *SmartContract) GetManufacturer(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data DangKyNhaSanXuat
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	dangKy, err := getDangKyNhaSanXuat(ctx, data.NhaSanXuat)
+	if err != nil {
+		return "", err
+	}
+	if dangKy == nil {
+		return "", fmt.Errorf("nhà sản xuất %s chưa được đăng ký", data.NhaSanXuat)
+	}
+
+	asBytes, err := json.Marshal(dangKy)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
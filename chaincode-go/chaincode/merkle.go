@@ -0,0 +1,179 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ThuatToanMerkle names the tree layout below so offline verifiers can pick the right rules:
+// leaf = SHA-256(0x00 || code), node = SHA-256(0x01 || left || right), leaves in DanhSachMaDongGoi order,
+// and the last node of an odd level is carried up unchanged.
+const ThuatToanMerkle = "sha256-merkle-v1"
+
+// Sides of a sibling in a proof path
+const (
+	BenTrai = "TRAI"
+	BenPhai = "PHAI"
+)
+
+// BuocChungMinh struct
+type BuocChungMinh struct {
+	Hash  string `json:"Hash"`
+	ViTri string `json:"ViTri"`
+}
+
+// ChungMinhMaDongGoi struct
+type ChungMinhMaDongGoi struct {
+	MaDongGoi   string          `json:"MaDongGoi"`
+	NhaSanXuat  string          `json:"NhaSanXuat"`
+	ID          string          `json:"ID"`
+	ThuatToan   string          `json:"ThuatToan"`
+	ViTri       int             `json:"ViTri"`
+	SoLa        int             `json:"SoLa"`
+	La          string          `json:"La"`
+	DuongDan    []BuocChungMinh `json:"DuongDan"`
+	MerkleRoot  string          `json:"MerkleRoot"`
+	DaNiemPhong bool            `json:"DaNiemPhong"`
+	HashVersion int             `json:"HashVersion"`
+	HashValue   string          `json:"HashValue"`
+}
+
+// laMerkle hashes one packaging code into a leaf
+func laMerkle(code string) []byte {
+	hashv := sha256.Sum256(append([]byte{0x00}, code...))
+	return hashv[:]
+}
+
+// nutMerkle hashes two children into their parent
+func nutMerkle(trai []byte, phai []byte) []byte {
+	dauVao := append([]byte{0x01}, trai...)
+	dauVao = append(dauVao, phai...)
+	hashv := sha256.Sum256(dauVao)
+	return hashv[:]
+}
+
+// cayMerkle builds every level of the tree, leaves first
+func cayMerkle(danhSachMa []string) [][][]byte {
+	if len(danhSachMa) == 0 {
+		return nil
+	}
+	muc := make([][]byte, 0, len(danhSachMa))
+	for _, code := range danhSachMa {
+		muc = append(muc, laMerkle(code))
+	}
+	cay := [][][]byte{muc}
+	for len(muc) > 1 {
+		mucTren := make([][]byte, 0, (len(muc)+1)/2)
+		for i := 0; i < len(muc); i += 2 {
+			if i+1 < len(muc) {
+				mucTren = append(mucTren, nutMerkle(muc[i], muc[i+1]))
+			} else {
+				mucTren = append(mucTren, muc[i])
+			}
+		}
+		cay = append(cay, mucTren)
+		muc = mucTren
+	}
+	return cay
+}
+
+// merkleRoot returns the hex root over the packaging codes, empty when there are none
+func merkleRoot(danhSachMa []string) string {
+	cay := cayMerkle(danhSachMa)
+	if cay == nil {
+		return ""
+	}
+	return hex.EncodeToString(cay[len(cay)-1][0])
+}
+
+// duongDanMerkle lists the siblings from the leaf at viTri up to the root
+func duongDanMerkle(danhSachMa []string, viTri int) []BuocChungMinh {
+	duongDan := []BuocChungMinh{}
+	cay := cayMerkle(danhSachMa)
+	for _, muc := range cay[:len(cay)-1] {
+		if viTri%2 == 1 {
+			duongDan = append(duongDan, BuocChungMinh{Hash: hex.EncodeToString(muc[viTri-1]), ViTri: BenTrai})
+		} else if viTri+1 < len(muc) {
+			duongDan = append(duongDan, BuocChungMinh{Hash: hex.EncodeToString(muc[viTri+1]), ViTri: BenPhai})
+		}
+		viTri /= 2
+	}
+	return duongDan
+}
+
+// chungMinhMaDongGoi builds the proof of one code against the codes of a product, nil when the code is not among them
+func chungMinhMaDongGoi(code string, result *Data) *ChungMinhMaDongGoi {
+	viTri := -1
+	for i, element := range result.DanhSachMaDongGoi {
+		if element == code {
+			viTri = i
+			break
+		}
+	}
+	if viTri < 0 {
+		return nil
+	}
+
+	root := merkleRoot(result.DanhSachMaDongGoi)
+	return &ChungMinhMaDongGoi{
+		MaDongGoi:   code,
+		NhaSanXuat:  result.NhaSanXuat,
+		ID:          result.ID,
+		ThuatToan:   ThuatToanMerkle,
+		ViTri:       viTri,
+		SoLa:        len(result.DanhSachMaDongGoi),
+		La:          hex.EncodeToString(laMerkle(code)),
+		DuongDan:    duongDanMerkle(result.DanhSachMaDongGoi, viTri),
+		MerkleRoot:  root,
+		DaNiemPhong: result.HashVersion >= HashV3 && result.MerkleRootMaDongGoi == root,
+		HashVersion: result.HashVersion,
+		HashValue:   result.HashValue,
+	}
+}
+
+// GetPackagingProof returns the Merkle path of one unit packaging code up to the root sealed in its product.
+// Folding La with each sibling of DuongDan in order must give MerkleRoot; DaNiemPhong tells whether
+// that root is part of the product's HashValue, which holds from HashV3 on.
+func (s *SmartContract) GetPackagingProof(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data Document
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	_, doc, err := getMaDongGoi(ctx, data.Key)
+	if err != nil {
+		return "", err
+	}
+	if doc == nil {
+		return "", fmt.Errorf("mã đóng gói %s không tồn tại", data.Key)
+	}
+	if doc.Value == "" {
+		return "", fmt.Errorf("mã đóng gói chứa nhiều sản phẩm, hãy tra cứu bằng ResolvePackaging")
+	}
+
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(doc.NhaSanXuat, []string{doc.NhaSanXuat, doc.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	result, err := getSanPham(ctx, keySanPham)
+	if err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", fmt.Errorf("bản ghi không tồn tại")
+	}
+	chungMinh := chungMinhMaDongGoi(data.Key, result)
+	if chungMinh == nil {
+		return "", fmt.Errorf("mã đóng gói %s không còn thuộc sản phẩm %s", data.Key, doc.ID)
+	}
+
+	asBytes, err := json.Marshal(chungMinh)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
@@ -0,0 +1,359 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Owner indexes: one key per owner and product, so writers for the same owner never touch a shared value.
+// The sort component makes a range scan return the newest entry first.
+const (
+	chiMucDangGiu           = "SanPhamDangGiu"
+	chiMucDaXuLy            = "SanPhamDaXuLy"
+	chiMucDaXuLyTheoSanPham = "DaXuLyTheoSanPham"
+)
+
+// ChuyenDoiChiMuc struct
+type ChuyenDoiChiMuc struct {
+	DanhSachNhaSanXuat []string `json:"DanhSachNhaSanXuat"`
+}
+
+// KetQuaChuyenDoiChiMuc struct
+type KetQuaChuyenDoiChiMuc struct {
+	SoDanhSach int `json:"SoDanhSach"`
+	SoDaXuLy   int `json:"SoDaXuLy"`
+	SoDangGiu  int `json:"SoDangGiu"`
+}
+
+// thoiDiemSapXep turns a time into a fixed-width sort component that orders newer times first
+func thoiDiemSapXep(t time.Time) string {
+	return fmt.Sprintf("%019d", math.MaxInt64-t.UnixNano())
+}
+
+// themDaXuLy records that an owner handled a product, unless it was already recorded.
+// The lookup key by product holds the index key so the entry can be found without a scan.
+func themDaXuLy(ctx contractapi.TransactionContextInterface, owner string, thoiDiem string, nhaSanXuat string, id string, keySanPham string) (bool, error) {
+	keyTheoSanPham, err := ctx.GetStub().CreateCompositeKey(chiMucDaXuLyTheoSanPham, []string{owner, nhaSanXuat, id})
+	if err != nil {
+		return false, fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+	}
+	exist, err := Exist(ctx, keyTheoSanPham)
+	if err != nil {
+		return false, err
+	}
+	if exist != nil {
+		return false, nil
+	}
+
+	keyChiMuc, err := ctx.GetStub().CreateCompositeKey(chiMucDaXuLy, []string{owner, thoiDiem, nhaSanXuat, id})
+	if err != nil {
+		return false, fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyChiMuc, []byte(keySanPham)); err != nil {
+		return false, fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyTheoSanPham, []byte(keyChiMuc)); err != nil {
+		return false, fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+	}
+	return true, nil
+}
+
+// xoaDaXuLy drops a product from the products an owner handled
+func xoaDaXuLy(ctx contractapi.TransactionContextInterface, owner string, nhaSanXuat string, id string) error {
+	keyTheoSanPham, err := ctx.GetStub().CreateCompositeKey(chiMucDaXuLyTheoSanPham, []string{owner, nhaSanXuat, id})
+	if err != nil {
+		return fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+	}
+	exist, err := Exist(ctx, keyTheoSanPham)
+	if err != nil {
+		return err
+	}
+	if exist == nil {
+		return nil
+	}
+	if err := ctx.GetStub().DelState(string(exist)); err != nil {
+		return fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+	}
+	if err := ctx.GetStub().DelState(keyTheoSanPham); err != nil {
+		return fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+	}
+	return nil
+}
+
+// datDangGiu writes the held entry of the product's current holder at the product's ThoiDiemNhan
+func datDangGiu(ctx contractapi.TransactionContextInterface, keySanPham string, d *Data) error {
+	keyChiMuc, err := ctx.GetStub().CreateCompositeKey(chiMucDangGiu, []string{d.ChuyenGiaoMoiNhat, d.ThoiDiemNhan, d.NhaSanXuat, d.ID})
+	if err != nil {
+		return fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyChiMuc, []byte(keySanPham)); err != nil {
+		return fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+	}
+	return nil
+}
+
+// boDangGiu removes the held entry of the product's current holder
+func boDangGiu(ctx contractapi.TransactionContextInterface, d *Data) error {
+	keyChiMuc, err := ctx.GetStub().CreateCompositeKey(chiMucDangGiu, []string{d.ChuyenGiaoMoiNhat, d.ThoiDiemNhan, d.NhaSanXuat, d.ID})
+	if err != nil {
+		return fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+	}
+	if err := ctx.GetStub().DelState(keyChiMuc); err != nil {
+		return fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+	}
+	return nil
+}
+
+// ghiNhanNguoiGiu makes owner the indexed holder of a product from the current transaction on.
+// Call it after ChuyenGiaoMoiNhat is set and before the product is stored, since it stamps ThoiDiemNhan.
+func ghiNhanNguoiGiu(ctx contractapi.TransactionContextInterface, keySanPham string, d *Data) error {
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	d.ThoiDiemNhan = thoiDiemSapXep(txTime)
+	if err := datDangGiu(ctx, keySanPham, d); err != nil {
+		return err
+	}
+	if _, err := themDaXuLy(ctx, d.ChuyenGiaoMoiNhat, d.ThoiDiemNhan, d.NhaSanXuat, d.ID, keySanPham); err != nil {
+		return err
+	}
+	return nil
+}
+
+// chuyenChiMucNguoiGiu moves the owner index entries of a legacy identity to its new identity, keeping their order.
+// daChuyen tracks handled entries written earlier in the same transaction, which cannot be read back.
+func chuyenChiMucNguoiGiu(ctx contractapi.TransactionContextInterface, cu string, moi string, daChuyen map[string]bool) (int, error) {
+	soChiMuc := 0
+	dangGiuIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(chiMucDangGiu, []string{cu})
+	if err != nil {
+		return 0, fmt.Errorf("lỗi truy vấn chỉ mục: %s", err)
+	}
+	defer dangGiuIterator.Close()
+	for dangGiuIterator.HasNext() {
+		item, err := dangGiuIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("lỗi lặp truy vấn chỉ mục: %s", err)
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil || len(attributes) != 4 {
+			return 0, fmt.Errorf("key chỉ mục không hợp lệ: %s", item.Key)
+		}
+		keyMoi, err := ctx.GetStub().CreateCompositeKey(chiMucDangGiu, []string{moi, attributes[1], attributes[2], attributes[3]})
+		if err != nil {
+			return 0, fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+		}
+		if err := ctx.GetStub().PutState(keyMoi, item.Value); err != nil {
+			return 0, fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+		}
+		if err := ctx.GetStub().DelState(item.Key); err != nil {
+			return 0, fmt.Errorf("không thể cập nhật chỉ mục: %s", err)
+		}
+		soChiMuc++
+	}
+
+	daXuLyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(chiMucDaXuLy, []string{cu})
+	if err != nil {
+		return 0, fmt.Errorf("lỗi truy vấn chỉ mục: %s", err)
+	}
+	defer daXuLyIterator.Close()
+	for daXuLyIterator.HasNext() {
+		item, err := daXuLyIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("lỗi lặp truy vấn chỉ mục: %s", err)
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil || len(attributes) != 4 {
+			return 0, fmt.Errorf("key chỉ mục không hợp lệ: %s", item.Key)
+		}
+		if err := xoaDaXuLy(ctx, cu, attributes[2], attributes[3]); err != nil {
+			return 0, err
+		}
+		keyDaChuyen := moi + "|" + attributes[2] + "|" + attributes[3]
+		if daChuyen[keyDaChuyen] {
+			continue
+		}
+		them, err := themDaXuLy(ctx, moi, attributes[1], attributes[2], attributes[3], string(item.Value))
+		if err != nil {
+			return 0, err
+		}
+		if them {
+			daChuyen[keyDaChuyen] = true
+			soChiMuc++
+		}
+	}
+	return soChiMuc, nil
+}
+
+// danhSachKeyTheoChiMuc returns the product keys of an owner index, newest first
+func danhSachKeyTheoChiMuc(ctx contractapi.TransactionContextInterface, chiMuc string, owner string) ([]string, error) {
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(chiMuc, []string{owner})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi truy vấn chỉ mục: %s", err)
+	}
+	defer keyIterator.Close()
+
+	danhSach := []string{}
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("lỗi lặp truy vấn chỉ mục: %s", err)
+		}
+		danhSach = append(danhSach, string(item.Value))
+	}
+	return danhSach, nil
+}
+
+// MigrateOwnerIndexes rebuilds the per-owner product arrays written by earlier versions into the owner indexes
+// and deletes the arrays. Products of every registered manufacturer plus any namespace listed are covered.
+// Array order is kept by spacing the rebuilt entries one nanosecond apart before the migration time.
+func (s *SmartContract) MigrateOwnerIndexes(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data ChuyenDoiChiMuc
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	khongGian := map[string]bool{}
+	for _, nhaSanXuat := range data.DanhSachNhaSanXuat {
+		khongGian[nhaSanXuat] = true
+	}
+	dangKyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("NhaSanXuatDangKy", []string{})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn nhà sản xuất: %s", err)
+	}
+	defer dangKyIterator.Close()
+	for dangKyIterator.HasNext() {
+		item, err := dangKyIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn nhà sản xuất: %s", err)
+		}
+		var dangKy DangKyNhaSanXuat
+		if err := json.Unmarshal(item.Value, &dangKy); err != nil {
+			return "", fmt.Errorf("lỗi phân tích bản ghi nhà sản xuất: %s", err)
+		}
+		khongGian[dangKy.NhaSanXuat] = true
+	}
+
+	// Duyệt theo thứ tự cố định để mọi peer ghi giống nhau
+	danhSachKhongGian := make([]string, 0, len(khongGian))
+	for nhaSanXuat := range khongGian {
+		danhSachKhongGian = append(danhSachKhongGian, nhaSanXuat)
+	}
+	sort.Strings(danhSachKhongGian)
+
+	var keys []string
+	var products []Data
+	nguoiLienQuan := map[string]bool{}
+	for _, nhaSanXuat := range danhSachKhongGian {
+		keysKhongGian, productsKhongGian, err := danhSachSanPhamCuaNhaSanXuat(ctx, nhaSanXuat)
+		if err != nil {
+			return "", err
+		}
+		for i := range productsKhongGian {
+			nguoiLienQuan[productsKhongGian[i].ChuyenGiaoMoiNhat] = true
+			for _, danhTinh := range productsKhongGian[i].DanhSachChuyenGiao {
+				nguoiLienQuan[danhTinh] = true
+			}
+		}
+		keys = append(keys, keysKhongGian...)
+		products = append(products, productsKhongGian...)
+	}
+	danhSachNguoi := make([]string, 0, len(nguoiLienQuan))
+	for danhTinh := range nguoiLienQuan {
+		if danhTinh != "" {
+			danhSachNguoi = append(danhSachNguoi, danhTinh)
+		}
+	}
+	sort.Strings(danhSachNguoi)
+
+	// Không đọc lại được giá trị vừa ghi trong cùng giao dịch nên giữ thời điểm đã cấp trong bộ nhớ
+	ketQua := KetQuaChuyenDoiChiMuc{}
+	thoiDiemDaCap := map[string]string{}
+	for _, danhTinh := range danhSachNguoi {
+		keyDanhSach, err := ctx.GetStub().CreateCompositeKey(danhTinh, []string{danhTinh, "danhSachSanPham"})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
+		}
+		exist, err := Exist(ctx, keyDanhSach)
+		if err != nil {
+			return "", err
+		}
+		if exist == nil {
+			continue
+		}
+		var danhSach DanhSachSanPham
+		if err := json.Unmarshal(exist, &danhSach); err != nil {
+			return "", fmt.Errorf("lỗi phân tích danh sách: %s", err)
+		}
+
+		for i, keySanPham := range danhSach.DanhSach {
+			_, attributes, err := ctx.GetStub().SplitCompositeKey(keySanPham)
+			if err != nil || len(attributes) < 2 {
+				return "", fmt.Errorf("key sản phẩm không hợp lệ: %s", keySanPham)
+			}
+			if _, daCap := thoiDiemDaCap[danhTinh+keySanPham]; daCap {
+				continue
+			}
+			thoiDiem := thoiDiemSapXep(txTime.Add(-time.Duration(len(danhSach.DanhSach)-i) * time.Nanosecond))
+			them, err := themDaXuLy(ctx, danhTinh, thoiDiem, attributes[0], attributes[1], keySanPham)
+			if err != nil {
+				return "", err
+			}
+			if them {
+				thoiDiemDaCap[danhTinh+keySanPham] = thoiDiem
+				ketQua.SoDaXuLy++
+			}
+		}
+
+		if err := ctx.GetStub().DelState(keyDanhSach); err != nil {
+			return "", fmt.Errorf("không thể xóa danh sách cũ: %s", err)
+		}
+		ketQua.SoDanhSach++
+	}
+
+	for i := range products {
+		product := products[i]
+		if product.ThoiDiemNhan != "" || product.ChuyenGiaoMoiNhat == "" {
+			continue
+		}
+		thoiDiem, ok := thoiDiemDaCap[product.ChuyenGiaoMoiNhat+keys[i]]
+		if !ok {
+			// Người giữ không có sản phẩm trong danh sách cũ
+			thoiDiem = thoiDiemSapXep(txTime)
+			them, err := themDaXuLy(ctx, product.ChuyenGiaoMoiNhat, thoiDiem, product.NhaSanXuat, product.ID, keys[i])
+			if err != nil {
+				return "", err
+			}
+			if them {
+				ketQua.SoDaXuLy++
+			}
+		}
+		product.ThoiDiemNhan = thoiDiem
+		if err := datDangGiu(ctx, keys[i], &product); err != nil {
+			return "", err
+		}
+		if _, err := putSanPham(ctx, keys[i], &product); err != nil {
+			return "", err
+		}
+		ketQua.SoDangGiu++
+	}
+
+	if err := phatSuKien(ctx, SuKienChuyenDoiChiMuc, ketQua); err != nil {
+		return "", err
+	}
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
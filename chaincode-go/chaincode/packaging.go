@@ -0,0 +1,407 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Packaging levels, from the unit printed on a single item up to a pallet
+const (
+	CapDonVi  = "DON_VI"
+	CapThung  = "THUNG"
+	CapPallet = "PALLET"
+)
+
+var thuTuCapDongGoi = map[string]int{
+	CapDonVi:  0,
+	CapThung:  1,
+	CapPallet: 2,
+}
+
+// Packaging code lifecycle states
+const (
+	MaHoatDong  = "HOAT_DONG"
+	MaDaHuy     = "DA_HUY"
+	MaDaBan     = "DA_BAN"
+	MaHuHong    = "HU_HONG"
+	MaDaTieuHuy = "DA_TIEU_HUY"
+	MaDaTach    = "DA_TACH"
+)
+
+// chuyenTrangThaiHopLe lists the states each code state may move to
+var chuyenTrangThaiHopLe = map[string][]string{
+	MaHoatDong: {MaDaHuy, MaDaBan, MaHuHong, MaDaTieuHuy, MaDaTach},
+	MaDaBan:    {MaHoatDong},
+	MaHuHong:   {MaDaTieuHuy},
+}
+
+// GopDongGoi struct
+type GopDongGoi struct {
+	MaDongGoi     string   `json:"MaDongGoi"`
+	CapDongGoi    string   `json:"CapDongGoi"`
+	DanhSachMaCon []string `json:"DanhSachMaCon"`
+}
+
+// CayDongGoi struct
+type CayDongGoi struct {
+	MaDongGoi       Document   `json:"MaDongGoi"`
+	DanhSachMaCha   []Document `json:"DanhSachMaCha"`
+	DanhSachMaCon   []Document `json:"DanhSachMaCon"`
+	DanhSachSanPham []string   `json:"DanhSachSanPham"`
+}
+
+// capDongGoi returns the packaging level of a code, treating records written before levels existed as units
+func capDongGoi(doc Document) string {
+	if doc.CapDongGoi == "" {
+		return CapDonVi
+	}
+	return doc.CapDongGoi
+}
+
+// trangThaiMaDongGoi returns the lifecycle state of a code, treating records written before states existed as active
+func trangThaiMaDongGoi(doc Document) string {
+	if doc.TrangThai == "" {
+		return MaHoatDong
+	}
+	return doc.TrangThai
+}
+
+// chuyenTrangThaiMaDongGoi moves a code to a new lifecycle state and stores who did it and why
+func chuyenTrangThaiMaDongGoi(ctx contractapi.TransactionContextInterface, doc *Document, trangThai string, lyDo string, thucHien string, thoiGian string) error {
+	hienTai := trangThaiMaDongGoi(*doc)
+	hopLe := false
+	for _, tiepTheo := range chuyenTrangThaiHopLe[hienTai] {
+		if tiepTheo == trangThai {
+			hopLe = true
+			break
+		}
+	}
+	if !hopLe {
+		return fmt.Errorf("mã đóng gói %s không thể chuyển từ %s sang %s", doc.Key, hienTai, trangThai)
+	}
+
+	doc.TrangThai = trangThai
+	doc.LyDo = lyDo
+	doc.ThucHien = thucHien
+	doc.ThoiGian = thoiGian
+	doc.TxID = ctx.GetStub().GetTxID()
+	return putMaDongGoi(ctx, doc)
+}
+
+// getMaDongGoi reads the packaging record stored for a code
+func getMaDongGoi(ctx contractapi.TransactionContextInterface, code string) (string, *Document, error) {
+	keyMaDongGoi, err := ctx.GetStub().CreateCompositeKey(code, []string{code, "MaDongGoi"})
+	if err != nil {
+		return "", nil, fmt.Errorf("lỗi tạo key mã đóng gói: %s", err)
+	}
+	exist, err := Exist(ctx, keyMaDongGoi)
+	if err != nil {
+		return "", nil, err
+	}
+	if exist == nil {
+		return keyMaDongGoi, nil, nil
+	}
+	var doc Document
+	if err := json.Unmarshal(exist, &doc); err != nil {
+		return "", nil, fmt.Errorf("lỗi phân tích bản ghi mã đóng gói: %s", err)
+	}
+	return keyMaDongGoi, &doc, nil
+}
+
+// putMaDongGoi writes a packaging record back under its own key
+func putMaDongGoi(ctx contractapi.TransactionContextInterface, doc *Document) error {
+	asBytes, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(doc.Key, asBytes); err != nil {
+		return fmt.Errorf("không thể cập nhật bản ghi mã đóng gói: %s", err)
+	}
+	return nil
+}
+
+// resolveCayDongGoi walks a code up to its outermost parent and down to every unit inside it
+func resolveCayDongGoi(ctx contractapi.TransactionContextInterface, code string) (*CayDongGoi, error) {
+	_, doc, err := getMaDongGoi(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("mã đóng gói %s không tồn tại", code)
+	}
+
+	cay := CayDongGoi{
+		MaDongGoi:       *doc,
+		DanhSachMaCha:   []Document{},
+		DanhSachMaCon:   []Document{},
+		DanhSachSanPham: []string{},
+	}
+
+	daDuyet := map[string]bool{code: true}
+	maCha := doc.MaCha
+	for maCha != "" {
+		if daDuyet[maCha] {
+			return nil, fmt.Errorf("cây đóng gói bị lặp tại mã %s", maCha)
+		}
+		daDuyet[maCha] = true
+		_, cha, err := getMaDongGoi(ctx, maCha)
+		if err != nil {
+			return nil, err
+		}
+		if cha == nil {
+			return nil, fmt.Errorf("mã đóng gói cha %s không tồn tại", maCha)
+		}
+		cay.DanhSachMaCha = append(cay.DanhSachMaCha, *cha)
+		maCha = cha.MaCha
+	}
+
+	sanPham := map[string]bool{}
+	hangDoi := []Document{*doc}
+	for len(hangDoi) > 0 {
+		hienTai := hangDoi[0]
+		hangDoi = hangDoi[1:]
+		if capDongGoi(hienTai) == CapDonVi {
+			if !sanPham[hienTai.Value] {
+				sanPham[hienTai.Value] = true
+				cay.DanhSachSanPham = append(cay.DanhSachSanPham, hienTai.Value)
+			}
+			continue
+		}
+		for _, maCon := range hienTai.DanhSachMaCon {
+			if daDuyet[maCon] {
+				return nil, fmt.Errorf("cây đóng gói bị lặp tại mã %s", maCon)
+			}
+			daDuyet[maCon] = true
+			_, con, err := getMaDongGoi(ctx, maCon)
+			if err != nil {
+				return nil, err
+			}
+			if con == nil {
+				return nil, fmt.Errorf("mã đóng gói con %s không tồn tại", maCon)
+			}
+			cay.DanhSachMaCon = append(cay.DanhSachMaCon, *con)
+			hangDoi = append(hangDoi, *con)
+		}
+	}
+
+	return &cay, nil
+}
+
+// kiemTraNguoiGiuSanPham checks that the caller currently holds every product in the list
+func kiemTraNguoiGiuSanPham(ctx contractapi.TransactionContextInterface, owner string, danhSachSanPham []string) error {
+	for _, keySanPham := range danhSachSanPham {
+		exist, err := Exist(ctx, keySanPham)
+		if err != nil {
+			return err
+		}
+		if exist == nil {
+			return fmt.Errorf("sản phẩm %s không tồn tại", keySanPham)
+		}
+		var sanPham Data
+		if err := json.Unmarshal(exist, &sanPham); err != nil {
+			return fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+		}
+		if owner != sanPham.ChuyenGiaoMoiNhat {
+			return fmt.Errorf("không có quyền với sản phẩm %s", keySanPham)
+		}
+	}
+	return nil
+}
+
+// AggregatePackaging groups existing codes under a new carton or pallet code
+func (s *SmartContract) AggregatePackaging(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data GopDongGoi
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.MaDongGoi == "" {
+		return "", fmt.Errorf("thiếu mã đóng gói")
+	}
+	if data.CapDongGoi != CapThung && data.CapDongGoi != CapPallet {
+		return "", fmt.Errorf("cấp đóng gói không hợp lệ: %s", data.CapDongGoi)
+	}
+	if len(data.DanhSachMaCon) == 0 {
+		return "", fmt.Errorf("danh sách mã con rỗng")
+	}
+
+	keyMaDongGoi, existing, err := getMaDongGoi(ctx, data.MaDongGoi)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("mã đóng gói đã tồn tại: %s", keyMaDongGoi)
+	}
+
+	var danhSachCon []*Document
+	var danhSachSanPham []string
+	sanPham := map[string]bool{}
+	daThem := map[string]bool{}
+	for _, maCon := range data.DanhSachMaCon {
+		if daThem[maCon] {
+			return "", fmt.Errorf("mã con bị trùng: %s", maCon)
+		}
+		daThem[maCon] = true
+
+		_, con, err := getMaDongGoi(ctx, maCon)
+		if err != nil {
+			return "", err
+		}
+		if con == nil {
+			return "", fmt.Errorf("mã đóng gói %s không tồn tại", maCon)
+		}
+		if con.MaCha != "" {
+			return "", fmt.Errorf("mã đóng gói %s đã thuộc mã %s", maCon, con.MaCha)
+		}
+		if trangThaiMaDongGoi(*con) != MaHoatDong {
+			return "", fmt.Errorf("mã đóng gói %s đang ở trạng thái %s", maCon, trangThaiMaDongGoi(*con))
+		}
+		if thuTuCapDongGoi[capDongGoi(*con)] >= thuTuCapDongGoi[data.CapDongGoi] {
+			return "", fmt.Errorf("mã %s có cấp %s, không thể gộp vào cấp %s", maCon, capDongGoi(*con), data.CapDongGoi)
+		}
+
+		cay, err := resolveCayDongGoi(ctx, maCon)
+		if err != nil {
+			return "", err
+		}
+		for _, keySanPham := range cay.DanhSachSanPham {
+			if !sanPham[keySanPham] {
+				sanPham[keySanPham] = true
+				danhSachSanPham = append(danhSachSanPham, keySanPham)
+			}
+		}
+		danhSachCon = append(danhSachCon, con)
+	}
+
+	if err := kiemTraNguoiGiuSanPham(ctx, owner, danhSachSanPham); err != nil {
+		return "", err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	dongGoi := Document{
+		Key:           keyMaDongGoi,
+		CapDongGoi:    data.CapDongGoi,
+		DanhSachMaCon: data.DanhSachMaCon,
+		TrangThai:     MaHoatDong,
+		ThucHien:      owner,
+		ThoiGian:      txTime.Format(time.RFC3339),
+		TxID:          ctx.GetStub().GetTxID(),
+	}
+	// Một thùng/pallet chỉ chứa một sản phẩm thì vẫn trỏ được về sản phẩm đó
+	if len(danhSachSanPham) == 1 {
+		dongGoi.Value = danhSachSanPham[0]
+		dongGoi.ID = danhSachCon[0].ID
+		dongGoi.NhaSanXuat = danhSachCon[0].NhaSanXuat
+	}
+	if err := putMaDongGoi(ctx, &dongGoi); err != nil {
+		return "", err
+	}
+
+	for _, con := range danhSachCon {
+		con.MaCha = data.MaDongGoi
+		if err := putMaDongGoi(ctx, con); err != nil {
+			return "", err
+		}
+	}
+
+	danhSach, err := sanPhamTheoKey(ctx, danhSachSanPham)
+	if err != nil {
+		return "", err
+	}
+	if err := phatSuKien(ctx, SuKienGopMaDongGoi, dongGoi, danhSach...); err != nil {
+		return "", err
+	}
+
+	asBytes, err := json.Marshal(dongGoi)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// DisaggregatePackaging breaks a carton or pallet code back into its children.
+// The parent code moves to MaDaTach instead of being deleted, so its history stays and it cannot be issued again.
+func (s *SmartContract) DisaggregatePackaging(ctx contractapi.TransactionContextInterface, params string) error {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	var data GopDongGoi
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	cay, err := resolveCayDongGoi(ctx, data.MaDongGoi)
+	if err != nil {
+		return err
+	}
+	dongGoi := cay.MaDongGoi
+	if capDongGoi(dongGoi) == CapDonVi {
+		return fmt.Errorf("mã %s là mã đơn vị, không thể tách", data.MaDongGoi)
+	}
+	if dongGoi.MaCha != "" {
+		return fmt.Errorf("mã đóng gói đang thuộc mã %s, cần tách mã cha trước", dongGoi.MaCha)
+	}
+	if err := kiemTraNguoiGiuSanPham(ctx, owner, cay.DanhSachSanPham); err != nil {
+		return err
+	}
+
+	for _, maCon := range dongGoi.DanhSachMaCon {
+		_, con, err := getMaDongGoi(ctx, maCon)
+		if err != nil {
+			return err
+		}
+		if con == nil {
+			return fmt.Errorf("mã đóng gói con %s không tồn tại", maCon)
+		}
+		con.MaCha = ""
+		if err := putMaDongGoi(ctx, con); err != nil {
+			return err
+		}
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	dongGoi.DanhSachMaCon = nil
+	if err := chuyenTrangThaiMaDongGoi(ctx, &dongGoi, MaDaTach, "Tách mã đóng gói", owner, txTime.Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	danhSach, err := sanPhamTheoKey(ctx, cay.DanhSachSanPham)
+	if err != nil {
+		return err
+	}
+	return phatSuKien(ctx, SuKienTachMaDongGoi, dongGoi, danhSach...)
+}
+
+// ResolvePackaging returns the parents and children of a packaging code
+func (s *SmartContract) ResolvePackaging(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data Document
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	cay, err := resolveCayDongGoi(ctx, data.Key)
+	if err != nil {
+		return "", err
+	}
+
+	asBytes, err := json.Marshal(cay)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
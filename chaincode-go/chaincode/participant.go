@@ -0,0 +1,239 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Participant states
+const (
+	ThanhVienHoatDong = "HOAT_DONG"
+	ThanhVienTamNgung = "TAM_NGUNG"
+)
+
+// ThanhVien struct
+type ThanhVien struct {
+	DanhTinh     string `json:"DanhTinh"`
+	MSPID        string `json:"MSPID"`
+	VaiTro       string `json:"VaiTro"`
+	TenPhapLy    string `json:"TenPhapLy"`
+	MaSoThue     string `json:"MaSoThue"`
+	DiaChi       string `json:"DiaChi"`
+	LienHe       string `json:"LienHe"`
+	TrangThai    string `json:"TrangThai"`
+	LyDo         string `json:"LyDo"`
+	NguoiCapNhat string `json:"NguoiCapNhat"`
+	ThoiGian     string `json:"ThoiGian"`
+	TxID         string `json:"TxID"`
+}
+
+// getThanhVien reads the registry entry of one identity
+func getThanhVien(ctx contractapi.TransactionContextInterface, danhTinh string) (string, *ThanhVien, error) {
+	keyThanhVien, err := ctx.GetStub().CreateCompositeKey("ThanhVien", []string{danhTinh})
+	if err != nil {
+		return "", nil, fmt.Errorf("lỗi tạo key thành viên: %s", err)
+	}
+	exist, err := Exist(ctx, keyThanhVien)
+	if err != nil {
+		return "", nil, err
+	}
+	if exist == nil {
+		return keyThanhVien, nil, nil
+	}
+	var thanhVien ThanhVien
+	if err := json.Unmarshal(exist, &thanhVien); err != nil {
+		return "", nil, fmt.Errorf("lỗi phân tích bản ghi thành viên: %s", err)
+	}
+	return keyThanhVien, &thanhVien, nil
+}
+
+// putThanhVien stamps and stores a registry entry
+func putThanhVien(ctx contractapi.TransactionContextInterface, keyThanhVien string, thanhVien *ThanhVien) ([]byte, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	thanhVien.NguoiCapNhat = owner
+	thanhVien.ThoiGian = txTime.Format(time.RFC3339)
+	thanhVien.TxID = ctx.GetStub().GetTxID()
+
+	asBytes, err := json.Marshal(thanhVien)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyThanhVien, asBytes); err != nil {
+		return nil, fmt.Errorf("không thể lưu bản ghi thành viên: %s", err)
+	}
+	return asBytes, nil
+}
+
+// kiemTraThanhVienHoatDong checks that an identity is registered and not suspended
+func kiemTraThanhVienHoatDong(ctx contractapi.TransactionContextInterface, danhTinh string) error {
+	_, thanhVien, err := getThanhVien(ctx, danhTinh)
+	if err != nil {
+		return err
+	}
+	if thanhVien == nil {
+		return fmt.Errorf("%s chưa đăng ký thành viên", danhTinh)
+	}
+	if thanhVien.TrangThai != ThanhVienHoatDong {
+		return fmt.Errorf("thành viên %s đang bị tạm ngưng: %s", danhTinh, thanhVien.LyDo)
+	}
+	return nil
+}
+
+// RegisterParticipant creates or updates the profile of a participant.
+// The status is left untouched on update; use SuspendParticipant and ReinstateParticipant for that.
+func (s *SmartContract) RegisterParticipant(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data ThanhVien
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.DanhTinh == "" || data.MSPID == "" {
+		return "", fmt.Errorf("thiếu danh tính hoặc MSP ID")
+	}
+	if !strings.HasPrefix(data.DanhTinh, data.MSPID+"::") {
+		return "", fmt.Errorf("danh tính %s không thuộc tổ chức %s", data.DanhTinh, data.MSPID)
+	}
+	if data.TenPhapLy == "" {
+		return "", fmt.Errorf("thiếu tên pháp lý")
+	}
+	hopLe := false
+	for _, vaiTro := range cacVaiTro {
+		if vaiTro == data.VaiTro {
+			hopLe = true
+		}
+	}
+	if !hopLe {
+		return "", fmt.Errorf("vai trò không hợp lệ: %s", data.VaiTro)
+	}
+
+	keyThanhVien, cu, err := getThanhVien(ctx, data.DanhTinh)
+	if err != nil {
+		return "", err
+	}
+	thanhVien := ThanhVien{
+		DanhTinh:  data.DanhTinh,
+		MSPID:     data.MSPID,
+		VaiTro:    data.VaiTro,
+		TenPhapLy: data.TenPhapLy,
+		MaSoThue:  data.MaSoThue,
+		DiaChi:    data.DiaChi,
+		LienHe:    data.LienHe,
+		TrangThai: ThanhVienHoatDong,
+	}
+	if cu != nil {
+		thanhVien.TrangThai = cu.TrangThai
+		thanhVien.LyDo = cu.LyDo
+	}
+
+	asBytes, err := putThanhVien(ctx, keyThanhVien, &thanhVien)
+	if err != nil {
+		return "", err
+	}
+	if err := phatSuKien(ctx, SuKienDangKyThanhVien, thanhVien); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// datTrangThaiThanhVien moves a participant to a new status with a reason
+func datTrangThaiThanhVien(ctx contractapi.TransactionContextInterface, params string, trangThai string) (string, error) {
+	var data ThanhVien
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.LyDo == "" {
+		return "", fmt.Errorf("thiếu lý do")
+	}
+
+	keyThanhVien, thanhVien, err := getThanhVien(ctx, data.DanhTinh)
+	if err != nil {
+		return "", err
+	}
+	if thanhVien == nil {
+		return "", fmt.Errorf("%s chưa đăng ký thành viên", data.DanhTinh)
+	}
+	if thanhVien.TrangThai == trangThai {
+		return "", fmt.Errorf("thành viên %s đã ở trạng thái %s", data.DanhTinh, trangThai)
+	}
+	thanhVien.TrangThai = trangThai
+	thanhVien.LyDo = data.LyDo
+
+	asBytes, err := putThanhVien(ctx, keyThanhVien, thanhVien)
+	if err != nil {
+		return "", err
+	}
+	if err := phatSuKien(ctx, SuKienTrangThaiThanhVien, thanhVien); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// SuspendParticipant stops a participant from receiving transfers and, for manufacturers, from creating or packaging products
+func (s *SmartContract) SuspendParticipant(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	return datTrangThaiThanhVien(ctx, params, ThanhVienTamNgung)
+}
+
+// ReinstateParticipant lifts a suspension
+func (s *SmartContract) ReinstateParticipant(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	return datTrangThaiThanhVien(ctx, params, ThanhVienHoatDong)
+}
+
+// GetParticipant returns the registry entry of one identity
+func (s *SmartContract) GetParticipant(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data ThanhVien
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	_, thanhVien, err := getThanhVien(ctx, data.DanhTinh)
+	if err != nil {
+		return "", err
+	}
+	if thanhVien == nil {
+		return "", fmt.Errorf("%s chưa đăng ký thành viên", data.DanhTinh)
+	}
+
+	asBytes, err := json.Marshal(thanhVien)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// QueryParticipants lists every registered participant
+func (s *SmartContract) QueryParticipants(ctx contractapi.TransactionContextInterface) (string, error) {
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("ThanhVien", []string{})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn thành viên: %s", err)
+	}
+	defer keyIterator.Close()
+
+	danhSach := []ThanhVien{}
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn thành viên: %s", err)
+		}
+		var thanhVien ThanhVien
+		if err := json.Unmarshal(item.Value, &thanhVien); err != nil {
+			return "", fmt.Errorf("lỗi phân tích bản ghi thành viên: %s", err)
+		}
+		danhSach = append(danhSach, thanhVien)
+	}
+
+	asBytes, err := json.Marshal(danhSach)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
@@ -0,0 +1,421 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// phienBanBaoCao is bumped whenever the layout of BaoCaoNguonGoc changes
+const phienBanBaoCao = 2
+
+// MocNguonGoc struct
+type MocNguonGoc struct {
+	KeySanPham        string `json:"KeySanPham"`
+	PhienBan          int    `json:"PhienBan"`
+	Loai              string `json:"Loai"`
+	TxID              string `json:"TxID"`
+	ThoiDiem          string `json:"ThoiDiem"`
+	ThoiGian          string `json:"ThoiGian"`
+	TenSanPham        string `json:"TenSanPham"`
+	TrangThai         string `json:"TrangThai"`
+	DiaDiem           string `json:"DiaDiem"`
+	ToaDo             string `json:"ToaDo"`
+	MoTa              string `json:"MoTa"`
+	ThucHien          string `json:"ThucHien"`
+	ChuThe            string `json:"ChuThe"`
+	FormID            string `json:"FormID"`
+	HashValueOffchain string `json:"HashValueOffchain"`
+	HashValue         string `json:"HashValue"`
+	HashPb            string `json:"HashPb"`
+	NiemPhong         string `json:"NiemPhong"`
+}
+
+// MocSoHuu struct
+type MocSoHuu struct {
+	KeySanPham string `json:"KeySanPham"`
+	ChuSoHuu   string `json:"ChuSoHuu"`
+	PhienBan   int    `json:"PhienBan"`
+	TxID       string `json:"TxID"`
+	ThoiDiem   string `json:"ThoiDiem"`
+}
+
+// ThongTinDongGoi struct
+type ThongTinDongGoi struct {
+	MaDongGoi        Document            `json:"MaDongGoi"`
+	TrangThai        string              `json:"TrangThai"`
+	HoanThanhDongGoi bool                `json:"HoanThanhDongGoi"`
+	ChungMinh        *ChungMinhMaDongGoi `json:"ChungMinh"`
+}
+
+// ThongTinBanHang struct
+type ThongTinBanHang struct {
+	DaBan           bool             `json:"DaBan"`
+	GiaoDich        *GiaoDichBan     `json:"GiaoDich"`
+	TheoDoiDoanhThu *TheoDoiDoanhThu `json:"TheoDoiDoanhThu"`
+}
+
+// TinhTrangThuHoi struct
+type TinhTrangThuHoi struct {
+	DaThuHoi          bool            `json:"DaThuHoi"`
+	ThuHoi            *ThongTinThuHoi `json:"ThuHoi"`
+	MaDongGoiBiThuHoi bool            `json:"MaDongGoiBiThuHoi"`
+}
+
+// BaoCaoNguonGoc struct
+type BaoCaoNguonGoc struct {
+	PhienBan        int                `json:"PhienBan"`
+	MaDongGoi       string             `json:"MaDongGoi"`
+	NhaSanXuat      string             `json:"NhaSanXuat"`
+	ID              string             `json:"ID"`
+	SanPham         *Data              `json:"SanPham"`
+	DaHuy           *BiaMo             `json:"DaHuy"`
+	DongThoiGian    []MocNguonGoc      `json:"DongThoiGian"`
+	ChuoiSoHuu      []MocSoHuu         `json:"ChuoiSoHuu"`
+	DongGoi         ThongTinDongGoi    `json:"DongGoi"`
+	BanHang         ThongTinBanHang    `json:"BanHang"`
+	ThuHoi          TinhTrangThuHoi    `json:"ThuHoi"`
+	XacMinhHash     *KetQuaXacMinhHash `json:"XacMinhHash"`
+	DanhSachMaDonVi []BaoCaoNguonGoc   `json:"DanhSachMaDonVi"`
+}
+
+// phienBanLichSu is one ledger version of a product key
+type phienBanLichSu struct {
+	txID     string
+	thoiDiem string
+	xoa      bool
+	giaTri   []byte
+}
+
+// loaiMoc names the step that turned truoc into d with the event the writing transaction emitted.
+// It returns an empty string for versions that only touched bookkeeping fields.
+func loaiMoc(truoc *Data, d *Data) string {
+	if truoc == nil {
+		switch {
+		case len(d.DanhSachSanPhamNguon) > 1:
+			return SuKienGopLo
+		case len(d.DanhSachSanPhamNguon) == 1:
+			return SuKienTachLo
+		}
+		return SuKienTaoSanPham
+	}
+	switch {
+	case d.ThuHoi != nil && truoc.ThuHoi == nil:
+		return SuKienThuHoiSanPham
+	case d.HetHan && !truoc.HetHan:
+		return SuKienHetHanSanPham
+	case d.ChuyenGiaoMoiNhat != truoc.ChuyenGiaoMoiNhat:
+		return SuKienChuyenGiao
+	case len(d.DanhSachSanPhamCon) > len(truoc.DanhSachSanPhamCon):
+		return SuKienTachLo
+	case d.TrangThai == TrangThaiDaGop && truoc.TrangThai != TrangThaiDaGop:
+		return SuKienGopLo
+	case len(d.DanhSachMaDongGoi) < len(truoc.DanhSachMaDongGoi):
+		return SuKienThaoDongGoi
+	case len(d.DanhSachMaDongGoi) > len(truoc.DanhSachMaDongGoi) || d.HoanThanhDongGoi && !truoc.HoanThanhDongGoi:
+		return SuKienDongGoiSanPham
+	case d.HashValue == truoc.HashValue:
+		return ""
+	}
+	return SuKienCapNhatSanPham
+}
+
+// dongThoiGian replays the history of a product key, oldest first, into its timeline and custody chain,
+// preceded by the history of the lots it was split or merged from, the way QueryHistory walks them.
+// Each step carries the seal state the hash-chain check gave the same version of its own key.
+func dongThoiGian(ctx contractapi.TransactionContextInterface, key string, xacMinh *KetQuaXacMinhHash, daDuyet map[string]bool) ([]MocNguonGoc, []MocSoHuu, error) {
+	if daDuyet[key] {
+		return []MocNguonGoc{}, []MocSoHuu{}, nil
+	}
+	daDuyet[key] = true
+
+	queryIterator, err := ctx.GetStub().GetHistoryForKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lỗi truy vấn lịch sử: %s", err)
+	}
+	defer queryIterator.Close()
+
+	// Lịch sử trả về mới nhất trước
+	lichSu := []phienBanLichSu{}
+	for queryIterator.HasNext() {
+		item, err := queryIterator.Next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("lỗi lặp truy vấn lịch sử: %s", err)
+		}
+		lichSu = append(lichSu, phienBanLichSu{
+			txID:     item.TxId,
+			thoiDiem: time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).UTC().Format(time.RFC3339Nano),
+			xoa:      item.IsDelete,
+			giaTri:   item.Value,
+		})
+	}
+
+	danhSachMoc := []MocNguonGoc{}
+	chuoiSoHuu := []MocSoHuu{}
+	var truoc *Data
+	var danhSachNguon []string
+	for i := len(lichSu) - 1; i >= 0; i-- {
+		banGhi := lichSu[i]
+		phienBan := len(lichSu) - i
+		niemPhong := ""
+		if xacMinh != nil && phienBan <= len(xacMinh.DanhSach) {
+			niemPhong = xacMinh.DanhSach[phienBan-1].TrangThai
+		}
+		if banGhi.xoa {
+			danhSachMoc = append(danhSachMoc, MocNguonGoc{
+				KeySanPham: key,
+				PhienBan:   phienBan,
+				Loai:       SuKienHuySanPham,
+				TxID:       banGhi.txID,
+				ThoiDiem:   banGhi.thoiDiem,
+				NiemPhong:  niemPhong,
+			})
+			truoc = nil
+			continue
+		}
+
+		var d Data
+		if err := json.Unmarshal(banGhi.giaTri, &d); err != nil {
+			return nil, nil, fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+		}
+		if danhSachNguon == nil {
+			danhSachNguon = d.DanhSachSanPhamNguon
+		}
+		if d.ChuyenGiaoMoiNhat != "" && (len(chuoiSoHuu) == 0 || chuoiSoHuu[len(chuoiSoHuu)-1].ChuSoHuu != d.ChuyenGiaoMoiNhat) {
+			chuoiSoHuu = append(chuoiSoHuu, MocSoHuu{
+				KeySanPham: key,
+				ChuSoHuu:   d.ChuyenGiaoMoiNhat,
+				PhienBan:   phienBan,
+				TxID:       banGhi.txID,
+				ThoiDiem:   banGhi.thoiDiem,
+			})
+		}
+		loai := loaiMoc(truoc, &d)
+		truoc = &d
+		if loai == "" {
+			continue
+		}
+		danhSachMoc = append(danhSachMoc, MocNguonGoc{
+			KeySanPham:        key,
+			PhienBan:          phienBan,
+			Loai:              loai,
+			TxID:              banGhi.txID,
+			ThoiDiem:          banGhi.thoiDiem,
+			ThoiGian:          d.ThoiGian,
+			TenSanPham:        d.TenSanPham,
+			TrangThai:         d.TrangThai,
+			DiaDiem:           d.DiaDiem,
+			ToaDo:             d.ToaDo,
+			MoTa:              d.MoTa,
+			ThucHien:          d.ThucHien,
+			ChuThe:            d.ChuThe,
+			FormID:            d.FormIDMoiNhat,
+			HashValueOffchain: d.HashValueOffchain,
+			HashValue:         d.HashValue,
+			HashPb:            d.HashPb,
+			NiemPhong:         niemPhong,
+		})
+	}
+
+	// Lô nguồn được ghi khi tách/gộp tạo ra key này nên lịch sử của chúng đứng trước
+	mocNguon := []MocNguonGoc{}
+	soHuuNguon := []MocSoHuu{}
+	for _, keyNguon := range danhSachNguon {
+		_, thuocTinh, err := ctx.GetStub().SplitCompositeKey(keyNguon)
+		if err != nil || len(thuocTinh) != 2 {
+			return nil, nil, fmt.Errorf("key lô nguồn không hợp lệ: %s", keyNguon)
+		}
+		xacMinhNguon, err := xacMinhChuoiHash(ctx, thuocTinh[0], thuocTinh[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		moc, soHuu, err := dongThoiGian(ctx, keyNguon, xacMinhNguon, daDuyet)
+		if err != nil {
+			return nil, nil, err
+		}
+		mocNguon = append(mocNguon, moc...)
+		soHuuNguon = append(soHuuNguon, soHuu...)
+	}
+	return append(mocNguon, danhSachMoc...), append(soHuuNguon, chuoiSoHuu...), nil
+}
+
+// getTheoDoiDoanhThu reads the stock record kept for a packaged product
+func getTheoDoiDoanhThu(ctx contractapi.TransactionContextInterface, nhaSanXuat string, id string) (*TheoDoiDoanhThu, error) {
+	keyDoanhThu, err := ctx.GetStub().CreateCompositeKey(nhaSanXuat, []string{nhaSanXuat, id, "TheoDoiDoanhThu"})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key doanh thu: %s", err)
+	}
+	exist, err := Exist(ctx, keyDoanhThu)
+	if err != nil {
+		return nil, err
+	}
+	if exist == nil {
+		return nil, nil
+	}
+	var theoDoi TheoDoiDoanhThu
+	if err := json.Unmarshal(exist, &theoDoi); err != nil {
+		return nil, fmt.Errorf("lỗi phân tích bản ghi doanh thu: %s", err)
+	}
+	return &theoDoi, nil
+}
+
+// GetProvenanceReport gathers everything a consumer scan shows for one packaging code in a single query:
+// the product, its timeline and custody chain, the packaging proof, sale and recall status and the hash-chain check.
+// A carton or pallet code carries its own packaging record and one report per unit code inside it.
+// Every section is always present so the document keeps the same shape for every code.
+func (s *SmartContract) GetProvenanceReport(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data Document
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	_, doc, err := getMaDongGoi(ctx, data.Key)
+	if err != nil {
+		return "", err
+	}
+	if doc == nil {
+		return "", fmt.Errorf("mã đóng gói %s không tồn tại", data.Key)
+	}
+
+	var baoCao *BaoCaoNguonGoc
+	if capDongGoi(*doc) == CapDonVi {
+		baoCao, err = baoCaoMaDonVi(ctx, data.Key, doc, map[string]*lichSuSanPham{})
+		if err != nil {
+			return "", err
+		}
+	} else {
+		baoCao, err = baoCaoMaChua(ctx, data.Key, doc)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	asBytes, err := json.Marshal(baoCao)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// lichSuSanPham caches the timeline of one product while a container report walks many of its units
+type lichSuSanPham struct {
+	danhSachMoc []MocNguonGoc
+	chuoiSoHuu  []MocSoHuu
+	xacMinh     *KetQuaXacMinhHash
+}
+
+// baoCaoMaChua reports a carton or pallet code through the unit codes it contains
+func baoCaoMaChua(ctx contractapi.TransactionContextInterface, code string, doc *Document) (*BaoCaoNguonGoc, error) {
+	cay, err := resolveCayDongGoi(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	baoCao := BaoCaoNguonGoc{
+		PhienBan:     phienBanBaoCao,
+		MaDongGoi:    code,
+		DongThoiGian: []MocNguonGoc{},
+		ChuoiSoHuu:   []MocSoHuu{},
+		DongGoi: ThongTinDongGoi{
+			MaDongGoi: *doc,
+			TrangThai: trangThaiMaDongGoi(*doc),
+		},
+		ThuHoi: TinhTrangThuHoi{
+			MaDongGoiBiThuHoi: doc.ThuHoi,
+		},
+		DanhSachMaDonVi: []BaoCaoNguonGoc{},
+	}
+	boNhoDem := map[string]*lichSuSanPham{}
+	for i := range cay.DanhSachMaCon {
+		con := cay.DanhSachMaCon[i]
+		if capDongGoi(con) != CapDonVi {
+			continue
+		}
+		// Key của bản ghi mã là khóa ghép (mã, "MaDongGoi")
+		_, thuocTinh, err := ctx.GetStub().SplitCompositeKey(con.Key)
+		if err != nil || len(thuocTinh) != 2 {
+			return nil, fmt.Errorf("key mã đóng gói không hợp lệ: %s", con.Key)
+		}
+		baoCaoCon, err := baoCaoMaDonVi(ctx, thuocTinh[0], &con, boNhoDem)
+		if err != nil {
+			return nil, err
+		}
+		baoCao.DanhSachMaDonVi = append(baoCao.DanhSachMaDonVi, *baoCaoCon)
+	}
+	return &baoCao, nil
+}
+
+// baoCaoMaDonVi builds the report of one unit code; products already walked are taken from boNhoDem
+func baoCaoMaDonVi(ctx contractapi.TransactionContextInterface, code string, doc *Document, boNhoDem map[string]*lichSuSanPham) (*BaoCaoNguonGoc, error) {
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(doc.NhaSanXuat, []string{doc.NhaSanXuat, doc.ID})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	sanPham, err := getSanPham(ctx, keySanPham)
+	if err != nil {
+		return nil, err
+	}
+	biaMo, err := getBiaMo(ctx, doc.NhaSanXuat, doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	lichSu := boNhoDem[keySanPham]
+	if lichSu == nil {
+		xacMinh, err := xacMinhChuoiHash(ctx, doc.NhaSanXuat, doc.ID)
+		if err != nil {
+			return nil, err
+		}
+		danhSachMoc, chuoiSoHuu, err := dongThoiGian(ctx, keySanPham, xacMinh, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		lichSu = &lichSuSanPham{danhSachMoc: danhSachMoc, chuoiSoHuu: chuoiSoHuu, xacMinh: xacMinh}
+		boNhoDem[keySanPham] = lichSu
+	}
+
+	baoCao := BaoCaoNguonGoc{
+		PhienBan:     phienBanBaoCao,
+		MaDongGoi:    code,
+		NhaSanXuat:   doc.NhaSanXuat,
+		ID:           doc.ID,
+		SanPham:      sanPham,
+		DaHuy:        biaMo,
+		DongThoiGian: lichSu.danhSachMoc,
+		ChuoiSoHuu:   lichSu.chuoiSoHuu,
+		DongGoi: ThongTinDongGoi{
+			MaDongGoi: *doc,
+			TrangThai: trangThaiMaDongGoi(*doc),
+		},
+		ThuHoi: TinhTrangThuHoi{
+			MaDongGoiBiThuHoi: doc.ThuHoi,
+		},
+		XacMinhHash:     lichSu.xacMinh,
+		DanhSachMaDonVi: []BaoCaoNguonGoc{},
+	}
+	if sanPham != nil {
+		baoCao.DongGoi.HoanThanhDongGoi = sanPham.HoanThanhDongGoi
+		baoCao.DongGoi.ChungMinh = chungMinhMaDongGoi(code, sanPham)
+		baoCao.ThuHoi.DaThuHoi = sanPham.ThuHoi != nil
+		baoCao.ThuHoi.ThuHoi = sanPham.ThuHoi
+	}
+
+	theoDoi, err := getTheoDoiDoanhThu(ctx, doc.NhaSanXuat, doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	baoCao.BanHang.TheoDoiDoanhThu = theoDoi
+	if trangThaiMaDongGoi(*doc) == MaDaBan {
+		baoCao.BanHang.DaBan = true
+		// Mã bán trước khi có UUIDGiaoDich không còn liên kết được với giao dịch
+		if doc.UUIDGiaoDich != "" {
+			giaoDich, err := getGiaoDichBan(ctx, doc.UUIDGiaoDich)
+			if err != nil {
+				return nil, err
+			}
+			baoCao.BanHang.GiaoDich = giaoDich
+		}
+	}
+	return &baoCao, nil
+}
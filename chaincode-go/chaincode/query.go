@@ -0,0 +1,380 @@
+package chaincode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	kichThuocTrangMacDinh = 20
+	kichThuocTrangToiDa   = 200
+)
+
+// Query modes reported back to the caller
+const (
+	CheDoCouchDB     = "couchdb"
+	CheDoKhongGian   = "composite-key"
+	CheDoDanhSachGiu = "holder-list"
+)
+
+// TruyVanSanPham struct
+type TruyVanSanPham struct {
+	TrangThai  string `json:"TrangThai"`
+	TuNgay     string `json:"TuNgay"`
+	DenNgay    string `json:"DenNgay"`
+	DiaDiem    string `json:"DiaDiem"`
+	HSDTu      string `json:"HSDTu"`
+	HSDDen     string `json:"HSDDen"`
+	NguoiGiu   string `json:"NguoiGiu"`
+	NhaSanXuat string `json:"NhaSanXuat"`
+	PageSize   int32  `json:"PageSize"`
+	Bookmark   string `json:"Bookmark"`
+}
+
+// BanGhiSanPham struct
+type BanGhiSanPham struct {
+	Key   string          `json:"Key"`
+	Value json.RawMessage `json:"Value"`
+}
+
+// KetQuaTruyVan struct
+type KetQuaTruyVan struct {
+	DanhSach            []BanGhiSanPham `json:"DanhSach"`
+	FetchedRecordsCount int32           `json:"FetchedRecordsCount"`
+	Bookmark            string          `json:"Bookmark"`
+	CheDo               string          `json:"CheDo"`
+}
+
+// TrangTruyVan struct
+type TrangTruyVan struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	PageSize   int32  `json:"PageSize"`
+	Bookmark   string `json:"Bookmark"`
+}
+
+// BanGhiLichSu struct
+type BanGhiLichSu struct {
+	TxId      string          `json:"TxId"`
+	Value     json.RawMessage `json:"Value"`
+	Timestamp string          `json:"Timestamp"`
+	IsDelete  string          `json:"IsDelete"`
+}
+
+// KetQuaLichSu struct
+type KetQuaLichSu struct {
+	DanhSach            []BanGhiLichSu `json:"DanhSach"`
+	FetchedRecordsCount int32          `json:"FetchedRecordsCount"`
+	Bookmark            string         `json:"Bookmark"`
+}
+
+// conTroLichSu points at the last history entry returned; it is handed out base64-encoded as the bookmark
+type conTroLichSu struct {
+	Key  string `json:"Key"`
+	TxId string `json:"TxId"`
+}
+
+// trangLichSu collects one page while the history walk skips everything up to and including the cursor
+type trangLichSu struct {
+	conTro    *conTroLichSu
+	quaConTro bool
+	pageSize  int
+	keyCuoi   string
+	day       bool
+	ketQua    *KetQuaLichSu
+}
+
+// them adds an entry to the page and reports whether the walk should go on
+func (t *trangLichSu) them(key string, banGhi BanGhiLichSu) bool {
+	if t.conTro != nil && !t.quaConTro {
+		if key == t.conTro.Key && banGhi.TxId == t.conTro.TxId {
+			t.quaConTro = true
+		}
+		return true
+	}
+	if len(t.ketQua.DanhSach) == t.pageSize {
+		// Còn bản ghi phía sau nên trả bookmark trỏ vào bản ghi cuối của trang
+		cuoi := t.ketQua.DanhSach[len(t.ketQua.DanhSach)-1]
+		asBytes, _ := json.Marshal(conTroLichSu{Key: t.keyCuoi, TxId: cuoi.TxId})
+		t.ketQua.Bookmark = base64.StdEncoding.EncodeToString(asBytes)
+		t.day = true
+		return false
+	}
+	t.ketQua.DanhSach = append(t.ketQua.DanhSach, banGhi)
+	t.keyCuoi = key
+	return true
+}
+
+// giaiMaConTroLichSu decodes a history bookmark; an empty bookmark starts from the newest entry
+func giaiMaConTroLichSu(bookmark string) (*conTroLichSu, error) {
+	if bookmark == "" {
+		return nil, nil
+	}
+	asBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("bookmark không hợp lệ: %s", bookmark)
+	}
+	var conTro conTroLichSu
+	if err := json.Unmarshal(asBytes, &conTro); err != nil || conTro.Key == "" || conTro.TxId == "" {
+		return nil, fmt.Errorf("bookmark không hợp lệ: %s", bookmark)
+	}
+	return &conTro, nil
+}
+
+// kichThuocTrang applies the default and the upper bound to a requested page size
+func kichThuocTrang(pageSize int32) (int32, error) {
+	if pageSize <= 0 {
+		return kichThuocTrangMacDinh, nil
+	}
+	if pageSize > kichThuocTrangToiDa {
+		return 0, fmt.Errorf("kích thước trang tối đa là %d", kichThuocTrangToiDa)
+	}
+	return pageSize, nil
+}
+
+// boLocSanPham is a TruyVanSanPham with its ranges normalised to the stored text formats
+type boLocSanPham struct {
+	TruyVanSanPham
+	thoiGianTu  string
+	thoiGianDen string
+	hsdTu       string
+	hsdDen      string
+}
+
+// chuanHoaTruyVan validates the filters. ThoiGian is compared as RFC3339 UTC text and HSD as YYYY-MM-DD text,
+// which is how the contract stores them; every write stamps ThoiGian from the transaction time.
+// Records written before that kept the client's text and may fall outside a time range.
+func chuanHoaTruyVan(data TruyVanSanPham) (*boLocSanPham, error) {
+	boLoc := &boLocSanPham{TruyVanSanPham: data}
+	pageSize, err := kichThuocTrang(data.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	boLoc.PageSize = pageSize
+	if data.TuNgay != "" || data.DenNgay != "" {
+		tu, den, err := parseKhoangThoiGian(data.TuNgay, data.DenNgay)
+		if err != nil {
+			return nil, err
+		}
+		if data.TuNgay != "" {
+			boLoc.thoiGianTu = tu.Format(time.RFC3339)
+		}
+		if data.DenNgay != "" {
+			boLoc.thoiGianDen = den.Format(time.RFC3339)
+		}
+	}
+	if data.HSDTu != "" {
+		t, err := parseHSD(data.HSDTu)
+		if err != nil {
+			return nil, err
+		}
+		boLoc.hsdTu = t.Format(dinhDangHSD)
+	}
+	if data.HSDDen != "" {
+		t, err := parseHSD(data.HSDDen)
+		if err != nil {
+			return nil, err
+		}
+		boLoc.hsdDen = t.Format(dinhDangHSD)
+	}
+	return boLoc, nil
+}
+
+// taoSelector builds the CouchDB query; the indexes under META-INF/statedb/couchdb/indexes cover these fields
+func taoSelector(boLoc *boLocSanPham) (string, error) {
+	selector := map[string]interface{}{}
+	if boLoc.NguoiGiu != "" {
+		selector["ChuyenGiaoMoiNhat"] = boLoc.NguoiGiu
+	} else {
+		// Chỉ bản ghi sản phẩm mới có trường này
+		selector["ChuyenGiaoMoiNhat"] = map[string]interface{}{"$exists": true}
+	}
+	if boLoc.NhaSanXuat != "" {
+		selector["NhaSanXuat"] = boLoc.NhaSanXuat
+	}
+	if boLoc.TrangThai != "" {
+		selector["TrangThai"] = boLoc.TrangThai
+	}
+	if boLoc.DiaDiem != "" {
+		selector["DiaDiem"] = boLoc.DiaDiem
+	}
+	if boLoc.thoiGianTu != "" || boLoc.thoiGianDen != "" {
+		khoang := map[string]interface{}{}
+		if boLoc.thoiGianTu != "" {
+			khoang["$gte"] = boLoc.thoiGianTu
+		}
+		if boLoc.thoiGianDen != "" {
+			khoang["$lte"] = boLoc.thoiGianDen
+		}
+		selector["ThoiGian"] = khoang
+	}
+	if boLoc.hsdTu != "" || boLoc.hsdDen != "" {
+		khoang := map[string]interface{}{}
+		if boLoc.hsdTu != "" {
+			khoang["$gte"] = boLoc.hsdTu
+		}
+		if boLoc.hsdDen != "" {
+			khoang["$lte"] = boLoc.hsdDen
+		}
+		selector["HSD"] = khoang
+	}
+
+	asBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo truy vấn: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// khopBoLoc applies the same filters in the chaincode when the peer cannot run the selector
+func khopBoLoc(d *Data, boLoc *boLocSanPham) bool {
+	if boLoc.NguoiGiu != "" && d.ChuyenGiaoMoiNhat != boLoc.NguoiGiu {
+		return false
+	}
+	if boLoc.NhaSanXuat != "" && d.NhaSanXuat != boLoc.NhaSanXuat {
+		return false
+	}
+	if boLoc.TrangThai != "" && d.TrangThai != boLoc.TrangThai {
+		return false
+	}
+	if boLoc.DiaDiem != "" && d.DiaDiem != boLoc.DiaDiem {
+		return false
+	}
+	if boLoc.thoiGianTu != "" && d.ThoiGian < boLoc.thoiGianTu {
+		return false
+	}
+	if boLoc.thoiGianDen != "" && d.ThoiGian > boLoc.thoiGianDen {
+		return false
+	}
+	if (boLoc.hsdTu != "" || boLoc.hsdDen != "") && d.HSD == "" {
+		return false
+	}
+	if boLoc.hsdTu != "" && d.HSD < boLoc.hsdTu {
+		return false
+	}
+	if boLoc.hsdDen != "" && d.HSD > boLoc.hsdDen {
+		return false
+	}
+	return true
+}
+
+// laLoiLevelDB reports whether the peer rejected a rich query because its state database is goleveldb
+func laLoiLevelDB(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "not supported for leveldb")
+}
+
+// QueryProducts filters products by status, date range, location, expiry date, holder and manufacturer, one page at a time.
+// Peers on CouchDB run it as a rich query. Peers on goleveldb fall back to scanning the manufacturer namespace,
+// or the holder index, which needs NhaSanXuat or NguoiGiu and may return short pages.
+func (s *SmartContract) QueryProducts(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data TruyVanSanPham
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	boLoc, err := chuanHoaTruyVan(data)
+	if err != nil {
+		return "", err
+	}
+
+	query, err := taoSelector(boLoc)
+	if err != nil {
+		return "", err
+	}
+	var ketQua *KetQuaTruyVan
+	queryIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(query, boLoc.PageSize, boLoc.Bookmark)
+	switch {
+	case err == nil:
+		ketQua, err = docTrangKetQua(queryIterator, metadata, nil, CheDoCouchDB)
+	case !laLoiLevelDB(err):
+		return "", fmt.Errorf("lỗi truy vấn: %s", err)
+	case boLoc.NhaSanXuat != "":
+		queryIterator, metadata, err = ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(boLoc.NhaSanXuat, []string{boLoc.NhaSanXuat}, boLoc.PageSize, boLoc.Bookmark)
+		if err != nil {
+			return "", fmt.Errorf("lỗi truy vấn: %s", err)
+		}
+		ketQua, err = docTrangKetQua(queryIterator, metadata, func(item *Data) bool { return khopBoLoc(item, boLoc) }, CheDoKhongGian)
+	case boLoc.NguoiGiu != "":
+		ketQua, err = truyVanTheoNguoiGiu(ctx, boLoc)
+	default:
+		return "", fmt.Errorf("peer đang dùng goleveldb, không hỗ trợ truy vấn tùy ý: cần lọc theo NhaSanXuat hoặc NguoiGiu")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// docTrangKetQua reads one page from an iterator, keeping only product records that pass the filter
+func docTrangKetQua(queryIterator shim.StateQueryIteratorInterface, metadata *peer.QueryResponseMetadata, khop func(*Data) bool, cheDo string) (*KetQuaTruyVan, error) {
+	defer queryIterator.Close()
+
+	ketQua := &KetQuaTruyVan{DanhSach: []BanGhiSanPham{}, CheDo: cheDo}
+	for queryIterator.HasNext() {
+		item, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("lỗi lặp truy vấn: %s", err)
+		}
+		if khop != nil {
+			var product Data
+			if err := json.Unmarshal(item.Value, &product); err != nil || product.ChuyenGiaoMoiNhat == "" {
+				// Bản ghi doanh thu nằm chung không gian key
+				continue
+			}
+			if !khop(&product) {
+				continue
+			}
+		}
+		ketQua.DanhSach = append(ketQua.DanhSach, BanGhiSanPham{Key: item.Key, Value: item.Value})
+	}
+	ketQua.Bookmark = metadata.GetBookmark()
+	ketQua.FetchedRecordsCount = int32(len(ketQua.DanhSach))
+	return ketQua, nil
+}
+
+// truyVanTheoNguoiGiu pages through the products the holder currently holds, newest first
+func truyVanTheoNguoiGiu(ctx contractapi.TransactionContextInterface, boLoc *boLocSanPham) (*KetQuaTruyVan, error) {
+	keyIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(chiMucDangGiu, []string{boLoc.NguoiGiu}, boLoc.PageSize, boLoc.Bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi truy vấn chỉ mục: %s", err)
+	}
+	defer keyIterator.Close()
+
+	ketQua := &KetQuaTruyVan{DanhSach: []BanGhiSanPham{}, CheDo: CheDoDanhSachGiu}
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("lỗi lặp truy vấn chỉ mục: %s", err)
+		}
+		keySanPham := string(item.Value)
+		queryResult, err := ctx.GetStub().GetState(keySanPham)
+		if err != nil {
+			return nil, fmt.Errorf("lỗi truy vấn sản phẩm: %s", err)
+		}
+		if queryResult == nil {
+			continue
+		}
+		var product Data
+		if err := json.Unmarshal(queryResult, &product); err != nil {
+			return nil, fmt.Errorf("lỗi phân tích sản phẩm: %s", err)
+		}
+		if !khopBoLoc(&product, boLoc) {
+			continue
+		}
+		ketQua.DanhSach = append(ketQua.DanhSach, BanGhiSanPham{Key: keySanPham, Value: queryResult})
+	}
+	ketQua.Bookmark = metadata.GetBookmark()
+	ketQua.FetchedRecordsCount = int32(len(ketQua.DanhSach))
+	return ketQua, nil
+}
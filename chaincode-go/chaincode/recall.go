@@ -0,0 +1,204 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Recall severities, from a health hazard down to a labelling issue
+const (
+	MucDoThuHoiCao       = "CAO"
+	MucDoThuHoiTrungBinh = "TRUNG_BINH"
+	MucDoThuHoiThap      = "THAP"
+)
+
+// TrangThaiThuHoi is the product status written when a product is recalled
+const TrangThaiThuHoi = "THU HỒI"
+
+// ThongTinThuHoi struct
+type ThongTinThuHoi struct {
+	LyDo     string `json:"LyDo"`
+	MucDo    string `json:"MucDo"`
+	ThucHien string `json:"ThucHien"`
+	ThoiGian string `json:"ThoiGian"`
+	TxID     string `json:"TxID"`
+}
+
+// ThuHoiSanPham struct
+type ThuHoiSanPham struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	LyDo       string `json:"LyDo"`
+	MucDo      string `json:"MucDo"`
+}
+
+// laNhaSanXuat reports whether the caller created the product or belongs to its registered manufacturer
+func laNhaSanXuat(ctx contractapi.TransactionContextInterface, owner string, d *Data) (bool, error) {
+	if nguoiTao(d) == owner {
+		return true, nil
+	}
+	return laThanhVienNhaSanXuat(ctx, d.NhaSanXuat, owner)
+}
+
+// RecallProduct recalls a product, every packaging code issued for it and every lot derived from it
+func (s *SmartContract) RecallProduct(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data ThuHoiSanPham
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if err := kiemTraNhaSanXuat(ctx, data.NhaSanXuat); err != nil {
+		return "", err
+	}
+	if data.LyDo == "" {
+		return "", fmt.Errorf("thiếu lý do thu hồi")
+	}
+	switch data.MucDo {
+	case MucDoThuHoiCao, MucDoThuHoiTrungBinh, MucDoThuHoiThap:
+	default:
+		return "", fmt.Errorf("mức độ thu hồi không hợp lệ: %s", data.MucDo)
+	}
+
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+
+	exist, err := Exist(ctx, keySanPham)
+	if err != nil {
+		return "", err
+	}
+	if exist == nil {
+		return "", fmt.Errorf("sản phẩm không tồn tại")
+	}
+
+	var result Data
+	if err := json.Unmarshal(exist, &result); err != nil {
+		return "", fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+	}
+	laNSX, err := laNhaSanXuat(ctx, owner, &result)
+	if err != nil {
+		return "", err
+	}
+	if !laNSX {
+		return "", fmt.Errorf("chỉ nhà sản xuất mới có quyền thu hồi sản phẩm")
+	}
+	if result.ThuHoi != nil {
+		return "", fmt.Errorf("sản phẩm đã bị thu hồi")
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	thuHoi := &ThongTinThuHoi{
+		LyDo:     data.LyDo,
+		MucDo:    data.MucDo,
+		ThucHien: owner,
+		ThoiGian: txTime.Format(time.RFC3339),
+		TxID:     ctx.GetStub().GetTxID(),
+	}
+
+	asBytes, err := apDungThuHoi(ctx, keySanPham, &result, thuHoi)
+	if err != nil {
+		return "", err
+	}
+
+	// Các lô được tách hoặc gộp từ sản phẩm này cũng bị thu hồi theo
+	daThuHoi := []*Data{&result}
+	daDuyet := map[string]bool{keySanPham: true}
+	hangDoi := append([]string{}, result.DanhSachSanPhamCon...)
+	for len(hangDoi) > 0 {
+		keyCon := hangDoi[0]
+		hangDoi = hangDoi[1:]
+		if daDuyet[keyCon] {
+			continue
+		}
+		daDuyet[keyCon] = true
+
+		con, err := getSanPham(ctx, keyCon)
+		if err != nil {
+			return "", err
+		}
+		if con == nil {
+			continue
+		}
+		hangDoi = append(hangDoi, con.DanhSachSanPhamCon...)
+		if con.ThuHoi != nil {
+			continue
+		}
+		if _, err := apDungThuHoi(ctx, keyCon, con, thuHoi); err != nil {
+			return "", err
+		}
+		daThuHoi = append(daThuHoi, con)
+	}
+
+	if err := phatSuKien(ctx, SuKienThuHoiSanPham, thuHoi, daThuHoi...); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// apDungThuHoi marks one product, its packaging codes and its sales tracking record as recalled
+func apDungThuHoi(ctx contractapi.TransactionContextInterface, keySanPham string, result *Data, thuHoi *ThongTinThuHoi) ([]byte, error) {
+	result.ThuHoi = thuHoi
+	result.ThoiGian = thuHoi.ThoiGian
+	result.MoTa = "Thu hồi: " + thuHoi.LyDo
+	result.TrangThai = TrangThaiThuHoi
+	result.ThucHien = thuHoi.ThucHien
+	result.ChuThe = thuHoi.ThucHien
+	result.DaiDien = ""
+	result.HashPb = result.HashValue
+	result.HashValue = computeHashValue(result, "")
+
+	asBytes, err := putSanPham(ctx, keySanPham, result)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, element := range result.DanhSachMaDongGoi {
+		_, doc, err := getMaDongGoi(ctx, element)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			continue
+		}
+		doc.ThuHoi = true
+		if err := putMaDongGoi(ctx, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	keyTheoDoiDoanhThu, err := ctx.GetStub().CreateCompositeKey(result.NhaSanXuat, []string{result.NhaSanXuat, result.ID, "TheoDoiDoanhThu"})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key doanh thu: %s", err)
+	}
+	existDoanhThu, err := Exist(ctx, keyTheoDoiDoanhThu)
+	if err != nil {
+		return nil, err
+	}
+	if existDoanhThu != nil {
+		var theoDoi TheoDoiDoanhThu
+		if err := json.Unmarshal(existDoanhThu, &theoDoi); err != nil {
+			return nil, fmt.Errorf("lỗi phân tích bản ghi doanh thu: %s", err)
+		}
+		theoDoi.ThuHoi = thuHoi
+		asBytesDoanhThu, err := json.Marshal(theoDoi)
+		if err != nil {
+			return nil, fmt.Errorf("lỗi mã hóa JSON doanh thu: %s", err)
+		}
+		if err := ctx.GetStub().PutState(keyTheoDoiDoanhThu, asBytesDoanhThu); err != nil {
+			return nil, fmt.Errorf("không thể cập nhật bản ghi doanh thu: %s", err)
+		}
+	}
+
+	return asBytes, nil
+}
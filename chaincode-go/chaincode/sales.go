@@ -0,0 +1,504 @@
+package chaincode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DongHang struct
+type DongHang struct {
+	NhaSanXuat        string   `json:"NhaSanXuat"`
+	ID                string   `json:"ID"`
+	SoLuong           int      `json:"SoLuong"`
+	DanhSachMaDongGoi []string `json:"DanhSachMaDongGoi"`
+}
+
+// GiaoDichBan struct
+type GiaoDichBan struct {
+	UUID            string     `json:"UUID"`
+	DanhSachSanPham []DongHang `json:"DanhSachSanPham"`
+	NguoiBan        string     `json:"NguoiBan"`
+	ThoiGian        string     `json:"ThoiGian"`
+	TxID            string     `json:"TxID"`
+}
+
+// BienNhanBan struct
+type BienNhanBan struct {
+	GiaoDich        GiaoDichBan `json:"GiaoDich"`
+	DanhSachTraHang []TraHang   `json:"DanhSachTraHang"`
+}
+
+// TraCuuGiaoDich struct
+type TraCuuGiaoDich struct {
+	UUID       string `json:"UUID"`
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	NguoiBan   string `json:"NguoiBan"`
+	TuNgay     string `json:"TuNgay"`
+	DenNgay    string `json:"DenNgay"`
+}
+
+// TraHang struct
+type TraHang struct {
+	UUID            string     `json:"UUID"`
+	DanhSachSanPham []DongHang `json:"DanhSachSanPham"`
+	LyDo            string     `json:"LyDo"`
+	ThucHien        string     `json:"ThucHien"`
+	ThoiGian        string     `json:"ThoiGian"`
+	TxID            string     `json:"TxID"`
+}
+
+// getGiaoDichBan reads the sale recorded under a payment UUID
+func getGiaoDichBan(ctx contractapi.TransactionContextInterface, uuid string) (*GiaoDichBan, error) {
+	keyGiaoDich, err := ctx.GetStub().CreateCompositeKey("GiaoDichBan", []string{uuid})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key giao dịch: %s", err)
+	}
+	exist, err := Exist(ctx, keyGiaoDich)
+	if err != nil {
+		return nil, err
+	}
+	if exist == nil {
+		return nil, nil
+	}
+	var giaoDich GiaoDichBan
+	if err := json.Unmarshal(exist, &giaoDich); err != nil {
+		return nil, fmt.Errorf("lỗi phân tích giao dịch: %s", err)
+	}
+	return &giaoDich, nil
+}
+
+// ghiGiaoDichBan writes the receipt of a sale once, indexed by product and by seller.
+// Receipts are never rewritten; returns are stored beside them.
+func ghiGiaoDichBan(ctx contractapi.TransactionContextInterface, uuid string, nguoiBan string, txTime time.Time, data []TheoDoiDoanhThu) (*GiaoDichBan, error) {
+	giaoDich := GiaoDichBan{
+		UUID:     uuid,
+		NguoiBan: nguoiBan,
+		ThoiGian: txTime.Format(time.RFC3339),
+		TxID:     ctx.GetStub().GetTxID(),
+	}
+	for _, element := range data {
+		giaoDich.DanhSachSanPham = append(giaoDich.DanhSachSanPham, DongHang{
+			NhaSanXuat:        element.NhaSanXuat,
+			ID:                element.ID,
+			SoLuong:           element.SoLuong,
+			DanhSachMaDongGoi: element.DanhSachMaDongGoi,
+		})
+	}
+
+	keyGiaoDich, err := ctx.GetStub().CreateCompositeKey("GiaoDichBan", []string{uuid})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key giao dịch: %s", err)
+	}
+	asBytes, err := json.Marshal(giaoDich)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi mã hóa JSON giao dịch: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyGiaoDich, asBytes); err != nil {
+		return nil, fmt.Errorf("không thể tạo bản ghi giao dịch: %s", err)
+	}
+
+	// Chỉ mục theo người bán và theo sản phẩm, sắp theo thời gian giao dịch
+	keyNguoiBan, err := ctx.GetStub().CreateCompositeKey("GiaoDichTheoNguoiBan", []string{nguoiBan, giaoDich.ThoiGian, uuid})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyNguoiBan, []byte(uuid)); err != nil {
+		return nil, fmt.Errorf("không thể tạo chỉ mục giao dịch: %s", err)
+	}
+	daThem := map[string]bool{}
+	for _, dong := range giaoDich.DanhSachSanPham {
+		if daThem[dong.NhaSanXuat+"/"+dong.ID] {
+			continue
+		}
+		daThem[dong.NhaSanXuat+"/"+dong.ID] = true
+		keySanPham, err := ctx.GetStub().CreateCompositeKey("GiaoDichTheoSanPham", []string{dong.NhaSanXuat, dong.ID, giaoDich.ThoiGian, uuid})
+		if err != nil {
+			return nil, fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+		}
+		if err := ctx.GetStub().PutState(keySanPham, []byte(uuid)); err != nil {
+			return nil, fmt.Errorf("không thể tạo chỉ mục giao dịch: %s", err)
+		}
+	}
+	return &giaoDich, nil
+}
+
+// parseKhoangThoiGian reads an optional from/to range; plain dates cover the whole day in muiGioHSD
+func parseKhoangThoiGian(tuNgay string, denNgay string) (time.Time, time.Time, error) {
+	tu := time.Time{}
+	den := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	if tuNgay != "" {
+		t, err := time.Parse(time.RFC3339, tuNgay)
+		if err != nil {
+			if t, err = parseHSD(tuNgay); err != nil {
+				return tu, den, fmt.Errorf("thời gian bắt đầu không hợp lệ: %s", tuNgay)
+			}
+		}
+		tu = t.UTC()
+	}
+	if denNgay != "" {
+		t, err := time.Parse(time.RFC3339, denNgay)
+		if err != nil {
+			if t, err = parseHSD(denNgay); err != nil {
+				return tu, den, fmt.Errorf("thời gian kết thúc không hợp lệ: %s", denNgay)
+			}
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		den = t.UTC()
+	}
+	if den.Before(tu) {
+		return tu, den, fmt.Errorf("khoảng thời gian không hợp lệ")
+	}
+	return tu, den, nil
+}
+
+// danhSachGiaoDichTheoChiMuc loads the receipts listed under an index prefix whose time falls in the range
+func danhSachGiaoDichTheoChiMuc(ctx contractapi.TransactionContextInterface, chiMuc string, prefix []string, tuNgay string, denNgay string) (string, error) {
+	tu, den, err := parseKhoangThoiGian(tuNgay, denNgay)
+	if err != nil {
+		return "", err
+	}
+
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(chiMuc, prefix)
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn: %s", err)
+	}
+	defer keyIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	first := true
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn: %s", err)
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil {
+			return "", fmt.Errorf("lỗi tách key: %s", err)
+		}
+		thoiGian, err := time.Parse(time.RFC3339, attributes[len(attributes)-2])
+		if err != nil || thoiGian.Before(tu) || thoiGian.After(den) {
+			continue
+		}
+
+		keyGiaoDich, err := ctx.GetStub().CreateCompositeKey("GiaoDichBan", []string{string(item.Value)})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key giao dịch: %s", err)
+		}
+		giaoDich, err := ctx.GetStub().GetState(keyGiaoDich)
+		if err != nil {
+			return "", fmt.Errorf("lỗi truy vấn giao dịch: %s", err)
+		}
+		if giaoDich == nil {
+			continue
+		}
+		if !first {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(`{"Value":`)
+		buffer.Write(giaoDich)
+		buffer.WriteString("}")
+		first = false
+	}
+	buffer.WriteString("]")
+
+	return buffer.String(), nil
+}
+
+// QuerySaleReceipt returns the receipt of a sale together with every return made against it
+func (s *SmartContract) QuerySaleReceipt(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data TraCuuGiaoDich
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	giaoDich, err := getGiaoDichBan(ctx, data.UUID)
+	if err != nil {
+		return "", err
+	}
+	if giaoDich == nil {
+		return "", fmt.Errorf("giao dịch %s không tồn tại", data.UUID)
+	}
+
+	bienNhan := BienNhanBan{GiaoDich: *giaoDich, DanhSachTraHang: []TraHang{}}
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("TraHang", []string{data.UUID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn trả hàng: %s", err)
+	}
+	defer keyIterator.Close()
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn trả hàng: %s", err)
+		}
+		var traHang TraHang
+		if err := json.Unmarshal(item.Value, &traHang); err != nil {
+			return "", fmt.Errorf("lỗi phân tích bản ghi trả hàng: %s", err)
+		}
+		bienNhan.DanhSachTraHang = append(bienNhan.DanhSachTraHang, traHang)
+	}
+
+	asBytes, err := json.Marshal(bienNhan)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// QuerySalesByProduct lists the sales of one product within an optional time range
+func (s *SmartContract) QuerySalesByProduct(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data TraCuuGiaoDich
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NhaSanXuat == "" || data.ID == "" {
+		return "", fmt.Errorf("thiếu nhà sản xuất hoặc mã sản phẩm")
+	}
+	return danhSachGiaoDichTheoChiMuc(ctx, "GiaoDichTheoSanPham", []string{data.NhaSanXuat, data.ID}, data.TuNgay, data.DenNgay)
+}
+
+// QuerySalesBySeller lists the sales made by a seller, the caller by default, within an optional time range
+func (s *SmartContract) QuerySalesBySeller(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data TraCuuGiaoDich
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NguoiBan == "" {
+		nguoiBan, err := getCallerIdentity(ctx)
+		if err != nil {
+			return "", err
+		}
+		data.NguoiBan = nguoiBan
+	}
+	return danhSachGiaoDichTheoChiMuc(ctx, "GiaoDichTheoNguoiBan", []string{data.NguoiBan}, data.TuNgay, data.DenNgay)
+}
+
+// daTraTheoGiaoDich sums what earlier returns already took back from a sale, per product line
+func daTraTheoGiaoDich(ctx contractapi.TransactionContextInterface, uuid string) (map[string]int, map[string]bool, error) {
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("TraHang", []string{uuid})
+	if err != nil {
+		return nil, nil, fmt.Errorf("lỗi truy vấn trả hàng: %s", err)
+	}
+	defer keyIterator.Close()
+
+	soLuong := map[string]int{}
+	maDongGoi := map[string]bool{}
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("lỗi lặp truy vấn trả hàng: %s", err)
+		}
+		var traHang TraHang
+		if err := json.Unmarshal(item.Value, &traHang); err != nil {
+			return nil, nil, fmt.Errorf("lỗi phân tích bản ghi trả hàng: %s", err)
+		}
+		for _, dong := range traHang.DanhSachSanPham {
+			soLuong[dong.NhaSanXuat+"/"+dong.ID] += dong.SoLuong
+			for _, ma := range dong.DanhSachMaDongGoi {
+				maDongGoi[ma] = true
+			}
+		}
+	}
+	return soLuong, maDongGoi, nil
+}
+
+// ReturnSale puts goods from an earlier sale back in stock.
+// With no lines given, whatever is left of the sale is returned. Only the seller on the receipt may return it;
+// an admin may return any receipt, including those written before receipts recorded their seller.
+func (s *SmartContract) ReturnSale(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data TraHang
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.LyDo == "" {
+		return "", fmt.Errorf("thiếu lý do trả hàng")
+	}
+
+	giaoDich, err := getGiaoDichBan(ctx, data.UUID)
+	if err != nil {
+		return "", err
+	}
+	if giaoDich == nil {
+		return "", fmt.Errorf("giao dịch %s không tồn tại", data.UUID)
+	}
+	// Chỉ người bán được trả hàng cho biên nhận của mình; biên nhận cũ không ghi người bán chỉ quản trị viên xử lý
+	if giaoDich.NguoiBan == "" || giaoDich.NguoiBan != owner {
+		vaiTro, err := getVaiTro(ctx)
+		if err != nil {
+			return "", err
+		}
+		if vaiTro != VaiTroQuanTri {
+			return "", fmt.Errorf("%w: chỉ người bán hoặc quản trị viên được trả hàng cho giao dịch %s", ErrKhongDuQuyen, data.UUID)
+		}
+	}
+	daTraSoLuong, daTraMa, err := daTraTheoGiaoDich(ctx, data.UUID)
+	if err != nil {
+		return "", err
+	}
+
+	daBan := map[string]DongHang{}
+	for _, dong := range giaoDich.DanhSachSanPham {
+		key := dong.NhaSanXuat + "/" + dong.ID
+		gop := daBan[key]
+		gop.NhaSanXuat = dong.NhaSanXuat
+		gop.ID = dong.ID
+		gop.SoLuong += dong.SoLuong
+		gop.DanhSachMaDongGoi = append(gop.DanhSachMaDongGoi, dong.DanhSachMaDongGoi...)
+		daBan[key] = gop
+	}
+
+	danhSachTra := data.DanhSachSanPham
+	if len(danhSachTra) == 0 {
+		daThem := map[string]bool{}
+		for _, dong := range giaoDich.DanhSachSanPham {
+			key := dong.NhaSanXuat + "/" + dong.ID
+			if daThem[key] {
+				continue
+			}
+			daThem[key] = true
+			ban := daBan[key]
+			conLai := DongHang{NhaSanXuat: ban.NhaSanXuat, ID: ban.ID, SoLuong: ban.SoLuong - daTraSoLuong[key]}
+			for _, ma := range ban.DanhSachMaDongGoi {
+				if !daTraMa[ma] && len(conLai.DanhSachMaDongGoi) < conLai.SoLuong {
+					conLai.DanhSachMaDongGoi = append(conLai.DanhSachMaDongGoi, ma)
+				}
+			}
+			if conLai.SoLuong > 0 {
+				danhSachTra = append(danhSachTra, conLai)
+			}
+		}
+		if len(danhSachTra) == 0 {
+			return "", fmt.Errorf("giao dịch %s đã được trả hết", data.UUID)
+		}
+	}
+
+	// Kiểm tra toàn bộ trước khi ghi
+	traTrongLan := map[string]int{}
+	maTrongLan := map[string]bool{}
+	for i, dong := range danhSachTra {
+		key := dong.NhaSanXuat + "/" + dong.ID
+		ban, ok := daBan[key]
+		if !ok {
+			return "", fmt.Errorf("sản phẩm %s không có trong giao dịch", key)
+		}
+		if dong.SoLuong == 0 {
+			dong.SoLuong = len(dong.DanhSachMaDongGoi)
+			danhSachTra[i].SoLuong = dong.SoLuong
+		}
+		if dong.SoLuong <= 0 || dong.SoLuong < len(dong.DanhSachMaDongGoi) {
+			return "", fmt.Errorf("số lượng trả không hợp lệ: %s", key)
+		}
+		traTrongLan[key] += dong.SoLuong
+		if daTraSoLuong[key]+traTrongLan[key] > ban.SoLuong {
+			return "", fmt.Errorf("số lượng trả vượt quá số lượng đã bán: %s", key)
+		}
+		for _, ma := range dong.DanhSachMaDongGoi {
+			daBanMa := false
+			for _, m := range ban.DanhSachMaDongGoi {
+				if m == ma {
+					daBanMa = true
+					break
+				}
+			}
+			if !daBanMa {
+				return "", fmt.Errorf("mã đóng gói %s không thuộc giao dịch", ma)
+			}
+			if daTraMa[ma] || maTrongLan[ma] {
+				return "", fmt.Errorf("mã đóng gói %s đã được trả", ma)
+			}
+			maTrongLan[ma] = true
+		}
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	thoiGian := txTime.Format(time.RFC3339)
+
+	daCapNhat := map[string]bool{}
+	for _, dong := range danhSachTra {
+		for _, ma := range dong.DanhSachMaDongGoi {
+			_, doc, err := getMaDongGoi(ctx, ma)
+			if err != nil {
+				return "", err
+			}
+			if doc == nil {
+				continue
+			}
+			doc.UUIDGiaoDich = ""
+			if err := chuyenTrangThaiMaDongGoi(ctx, doc, MaHoatDong, "Trả hàng: "+data.LyDo, owner, thoiGian); err != nil {
+				return "", err
+			}
+		}
+
+		// Mỗi bản ghi doanh thu chỉ được ghi một lần trong giao dịch
+		key := dong.NhaSanXuat + "/" + dong.ID
+		if daCapNhat[key] {
+			continue
+		}
+		daCapNhat[key] = true
+		keyMaDoanhThu, err := ctx.GetStub().CreateCompositeKey(dong.NhaSanXuat, []string{dong.NhaSanXuat, dong.ID, "TheoDoiDoanhThu"})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key doanh thu: %s", err)
+		}
+		exist, err := Exist(ctx, keyMaDoanhThu)
+		if err != nil {
+			return "", err
+		}
+		if exist == nil {
+			return "", fmt.Errorf("bản ghi doanh thu không tồn tại")
+		}
+		var theoDoi TheoDoiDoanhThu
+		if err := json.Unmarshal(exist, &theoDoi); err != nil {
+			return "", fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+		}
+		theoDoi.SoLuong += traTrongLan[key]
+		asBytes, err := json.Marshal(theoDoi)
+		if err != nil {
+			return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+		}
+		if err := ctx.GetStub().PutState(keyMaDoanhThu, asBytes); err != nil {
+			return "", fmt.Errorf("không thể cập nhật bản ghi doanh thu: %s", err)
+		}
+	}
+
+	traHang := TraHang{
+		UUID:            data.UUID,
+		DanhSachSanPham: danhSachTra,
+		LyDo:            data.LyDo,
+		ThucHien:        owner,
+		ThoiGian:        thoiGian,
+		TxID:            ctx.GetStub().GetTxID(),
+	}
+	keyTraHang, err := ctx.GetStub().CreateCompositeKey("TraHang", []string{data.UUID, traHang.TxID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key trả hàng: %s", err)
+	}
+	asBytes, err := json.Marshal(traHang)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyTraHang, asBytes); err != nil {
+		return "", fmt.Errorf("không thể tạo bản ghi trả hàng: %s", err)
+	}
+
+	danhSach := []*Data{}
+	for _, dong := range danhSachTra {
+		danhSach = append(danhSach, &Data{NhaSanXuat: dong.NhaSanXuat, ID: dong.ID})
+	}
+	if err := phatSuKien(ctx, SuKienTraHang, traHang, danhSach...); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
@@ -0,0 +1,571 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/antzucaro/matchr"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Search scopes
+const (
+	PhamViCuaToi     = "CUA_TOI"
+	PhamViNhaSanXuat = "NHA_SAN_XUAT"
+	PhamViTatCa      = "TAT_CA"
+)
+
+// CheDoChiMucTimKiem is the query mode reported by SearchSanPham
+const CheDoChiMucTimKiem = "search-index"
+
+// Search index object types. Keys are (token, NhaSanXuat, ID, field) so a manufacturer scope is a longer prefix.
+const (
+	chiMucTu          = "TimKiemTu"
+	chiMucNGram       = "TimKiemNGram"
+	chiMucTheoSanPham = "TimKiemTheoSanPham"
+	doDaiNGram        = 3
+)
+
+// Default search thresholds, used until an admin stores a CauHinhTimKiem
+const (
+	keyCauHinhTimKiem   = "CauHinhTimKiem"
+	nguongNGramMacDinh  = 0.5
+	diemToiThieuMacDinh = 0.0
+)
+
+// truongTimKiem lists the indexed product fields, in the order they win ties
+var truongTimKiem = []struct {
+	ten string
+	lay func(d *Data) string
+}{
+	{"TenSanPham", func(d *Data) string { return d.TenSanPham }},
+	{"MoTa", func(d *Data) string { return d.MoTa }},
+	{"DiaDiem", func(d *Data) string { return d.DiaDiem }},
+}
+
+// TimKiemSanPham struct
+type TimKiemSanPham struct {
+	Keyword    string `json:"Keyword"`
+	PhamVi     string `json:"PhamVi"`
+	NhaSanXuat string `json:"NhaSanXuat"`
+	PageSize   int32  `json:"PageSize"`
+	Bookmark   string `json:"Bookmark"`
+}
+
+// BanGhiTimKiem struct
+type BanGhiTimKiem struct {
+	Key        string          `json:"Key"`
+	Value      json.RawMessage `json:"Value"`
+	TruongKhop string          `json:"TruongKhop"`
+	Diem       float64         `json:"Diem"`
+}
+
+// KetQuaTimKiem struct
+type KetQuaTimKiem struct {
+	DanhSach            []BanGhiTimKiem `json:"DanhSach"`
+	FetchedRecordsCount int32           `json:"FetchedRecordsCount"`
+	Bookmark            string          `json:"Bookmark"`
+	CheDo               string          `json:"CheDo"`
+}
+
+// CauHinhTimKiem struct
+type CauHinhTimKiem struct {
+	NguongNGram  float64 `json:"NguongNGram"`
+	DiemToiThieu float64 `json:"DiemToiThieu"`
+	NguoiCapNhat string  `json:"NguoiCapNhat"`
+	ThoiGian     string  `json:"ThoiGian"`
+	TxID         string  `json:"TxID"`
+}
+
+// TaoChiMucTimKiem struct
+type TaoChiMucTimKiem struct {
+	NhaSanXuat string   `json:"NhaSanXuat"`
+	DanhSachID []string `json:"DanhSachID"`
+}
+
+// KetQuaTaoChiMuc struct
+type KetQuaTaoChiMuc struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	SoSanPham  int    `json:"SoSanPham"`
+}
+
+// removeAccent folds Vietnamese text to plain letters: NFD splits off the tone and vowel marks, which are dropped.
+// Đ has no decomposition and is mapped by hand.
+func removeAccent(s string) string {
+	var buffer strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		switch r {
+		case 'đ':
+			r = 'd'
+		case 'Đ':
+			r = 'D'
+		}
+		buffer.WriteRune(r)
+	}
+	return norm.NFC.String(buffer.String())
+}
+
+// tachTuKhoa folds text and splits it into distinct lower-case words
+func tachTuKhoa(s string) []string {
+	daCo := map[string]bool{}
+	danhSach := []string{}
+	for _, tu := range strings.FieldsFunc(strings.ToLower(removeAccent(s)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !daCo[tu] {
+			daCo[tu] = true
+			danhSach = append(danhSach, tu)
+		}
+	}
+	return danhSach
+}
+
+// nGram returns the distinct n-grams of a word; words shorter than doDaiNGram have none
+func nGram(tu string) []string {
+	chu := []rune(tu)
+	daCo := map[string]bool{}
+	danhSach := []string{}
+	for i := 0; i+doDaiNGram <= len(chu); i++ {
+		gram := string(chu[i : i+doDaiNGram])
+		if !daCo[gram] {
+			daCo[gram] = true
+			danhSach = append(danhSach, gram)
+		}
+	}
+	return danhSach
+}
+
+// diemKhop scores a field against the keyword: each keyword word takes its best Jaro-Winkler
+// similarity with a word of the field, and the field scores the mean over keyword words
+func diemKhop(danhSachTu []string, truong string) float64 {
+	cacTu := tachTuKhoa(truong)
+	if len(danhSachTu) == 0 || len(cacTu) == 0 {
+		return 0
+	}
+	tong := 0.0
+	for _, tu := range danhSachTu {
+		tot := 0.0
+		for _, element := range cacTu {
+			diem := 1.0
+			if element != tu {
+				diem = matchr.JaroWinkler(tu, element, false)
+			}
+			if diem > tot {
+				tot = diem
+			}
+		}
+		tong += tot
+	}
+	return tong / float64(len(danhSachTu))
+}
+
+// khoaTimKiem lists the index keys a product should have
+func khoaTimKiem(ctx contractapi.TransactionContextInterface, d *Data) ([]string, error) {
+	daCo := map[string]bool{}
+	danhSach := []string{}
+	them := func(loai string, token string, truong string) error {
+		key, err := ctx.GetStub().CreateCompositeKey(loai, []string{token, d.NhaSanXuat, d.ID, truong})
+		if err != nil {
+			return fmt.Errorf("lỗi tạo key tìm kiếm: %s", err)
+		}
+		if !daCo[key] {
+			daCo[key] = true
+			danhSach = append(danhSach, key)
+		}
+		return nil
+	}
+	for _, truong := range truongTimKiem {
+		for _, tu := range tachTuKhoa(truong.lay(d)) {
+			if err := them(chiMucTu, tu, truong.ten); err != nil {
+				return nil, err
+			}
+			for _, gram := range nGram(tu) {
+				if err := them(chiMucNGram, gram, truong.ten); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	sort.Strings(danhSach)
+	return danhSach, nil
+}
+
+// getCauHinhTimKiem reads the search thresholds, falling back to the defaults
+func getCauHinhTimKiem(ctx contractapi.TransactionContextInterface) (*CauHinhTimKiem, error) {
+	cauHinh := CauHinhTimKiem{NguongNGram: nguongNGramMacDinh, DiemToiThieu: diemToiThieuMacDinh}
+	exist, err := Exist(ctx, keyCauHinhTimKiem)
+	if err != nil {
+		return nil, err
+	}
+	if exist != nil {
+		if err := json.Unmarshal(exist, &cauHinh); err != nil {
+			return nil, fmt.Errorf("lỗi phân tích cấu hình tìm kiếm: %s", err)
+		}
+	}
+	return &cauHinh, nil
+}
+
+// capNhatChiMucTimKiem brings the search index of a product in line with its current fields.
+// The keys written last time are kept per product, so stale tokens are removed even if tokenising changed.
+// Pass nil as d to drop the product from the index.
+func capNhatChiMucTimKiem(ctx contractapi.TransactionContextInterface, keySanPham string, nhaSanXuat string, id string, d *Data) (bool, error) {
+	keyTheoSanPham, err := ctx.GetStub().CreateCompositeKey(chiMucTheoSanPham, []string{nhaSanXuat, id})
+	if err != nil {
+		return false, fmt.Errorf("lỗi tạo key tìm kiếm: %s", err)
+	}
+	var cu []string
+	exist, err := Exist(ctx, keyTheoSanPham)
+	if err != nil {
+		return false, err
+	}
+	if exist != nil {
+		if err := json.Unmarshal(exist, &cu); err != nil {
+			return false, fmt.Errorf("lỗi phân tích chỉ mục tìm kiếm: %s", err)
+		}
+	}
+	moi := []string{}
+	if d != nil {
+		moi, err = khoaTimKiem(ctx, d)
+		if err != nil {
+			return false, err
+		}
+	}
+	if exist != nil && strings.Join(cu, "|") == strings.Join(moi, "|") {
+		return false, nil
+	}
+
+	conLai := map[string]bool{}
+	for _, key := range moi {
+		conLai[key] = true
+	}
+	for _, key := range cu {
+		if !conLai[key] {
+			if err := ctx.GetStub().DelState(key); err != nil {
+				return false, fmt.Errorf("không thể cập nhật chỉ mục tìm kiếm: %s", err)
+			}
+		}
+	}
+	for _, key := range moi {
+		if err := ctx.GetStub().PutState(key, []byte(keySanPham)); err != nil {
+			return false, fmt.Errorf("không thể cập nhật chỉ mục tìm kiếm: %s", err)
+		}
+	}
+
+	if d == nil {
+		if err := ctx.GetStub().DelState(keyTheoSanPham); err != nil {
+			return false, fmt.Errorf("không thể cập nhật chỉ mục tìm kiếm: %s", err)
+		}
+		return true, nil
+	}
+	asBytes, err := json.Marshal(moi)
+	if err != nil {
+		return false, fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyTheoSanPham, asBytes); err != nil {
+		return false, fmt.Errorf("không thể cập nhật chỉ mục tìm kiếm: %s", err)
+	}
+	return true, nil
+}
+
+// quetChiMucTimKiem calls fn with the product key and field of every index entry under a token
+func quetChiMucTimKiem(ctx contractapi.TransactionContextInterface, loai string, token string, nhaSanXuat string, fn func(string, string)) error {
+	attributes := []string{token}
+	if nhaSanXuat != "" {
+		attributes = append(attributes, nhaSanXuat)
+	}
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(loai, attributes)
+	if err != nil {
+		return fmt.Errorf("lỗi truy vấn chỉ mục tìm kiếm: %s", err)
+	}
+	defer keyIterator.Close()
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return fmt.Errorf("lỗi lặp truy vấn chỉ mục tìm kiếm: %s", err)
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil || len(attributes) != 4 {
+			return fmt.Errorf("key tìm kiếm không hợp lệ: %s", item.Key)
+		}
+		fn(string(item.Value), attributes[3])
+	}
+	return nil
+}
+
+// SearchSanPham searches product names, descriptions and locations through the search index.
+// A field is a candidate when it has a keyword word or shares at least NguongNGram of its n-grams;
+// candidates are ranked by their Jaro-Winkler score and those below DiemToiThieu are dropped.
+// PhamVi is CUA_TOI (default, products the caller handled), NHA_SAN_XUAT or TAT_CA.
+func (s *SmartContract) SearchSanPham(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data TimKiemSanPham
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	pageSize, err := kichThuocTrang(data.PageSize)
+	if err != nil {
+		return "", err
+	}
+	batDau := 0
+	if data.Bookmark != "" {
+		batDau, err = strconv.Atoi(data.Bookmark)
+		if err != nil || batDau < 0 {
+			return "", fmt.Errorf("bookmark không hợp lệ: %s", data.Bookmark)
+		}
+	}
+	nhaSanXuat := ""
+	switch data.PhamVi {
+	case "", PhamViCuaToi, PhamViTatCa:
+	case PhamViNhaSanXuat:
+		if data.NhaSanXuat == "" {
+			return "", fmt.Errorf("thiếu nhà sản xuất")
+		}
+		nhaSanXuat = data.NhaSanXuat
+	default:
+		return "", fmt.Errorf("phạm vi tìm kiếm không hợp lệ: %s", data.PhamVi)
+	}
+	danhSachTu := tachTuKhoa(data.Keyword)
+	if len(danhSachTu) == 0 {
+		return "", fmt.Errorf("thiếu từ khóa")
+	}
+
+	cauHinh, err := getCauHinhTimKiem(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Ứng viên theo sản phẩm, mỗi sản phẩm kèm các trường đã khớp
+	type ungVien struct {
+		keySanPham string
+		truong     string
+	}
+	khop := map[string]map[string]bool{}
+	themUngVien := func(keySanPham string, truong string) {
+		if khop[keySanPham] == nil {
+			khop[keySanPham] = map[string]bool{}
+		}
+		khop[keySanPham][truong] = true
+	}
+	for _, tu := range danhSachTu {
+		if err := quetChiMucTimKiem(ctx, chiMucTu, tu, nhaSanXuat, themUngVien); err != nil {
+			return "", err
+		}
+		grams := nGram(tu)
+		if len(grams) == 0 {
+			continue
+		}
+		dem := map[ungVien]int{}
+		for _, gram := range grams {
+			if err := quetChiMucTimKiem(ctx, chiMucNGram, gram, nhaSanXuat, func(keySanPham string, truong string) {
+				dem[ungVien{keySanPham, truong}]++
+			}); err != nil {
+				return "", err
+			}
+		}
+		for element, soGram := range dem {
+			if float64(soGram)/float64(len(grams)) >= cauHinh.NguongNGram {
+				themUngVien(element.keySanPham, element.truong)
+			}
+		}
+	}
+
+	thuTuTruong := map[string]int{}
+	for i, truong := range truongTimKiem {
+		thuTuTruong[truong.ten] = i
+	}
+	danhSach := []BanGhiTimKiem{}
+	for keySanPham, cacTruong := range khop {
+		if data.PhamVi == "" || data.PhamVi == PhamViCuaToi {
+			_, attributes, err := ctx.GetStub().SplitCompositeKey(keySanPham)
+			if err != nil || len(attributes) < 2 {
+				return "", fmt.Errorf("key sản phẩm không hợp lệ: %s", keySanPham)
+			}
+			keyDaXuLy, err := ctx.GetStub().CreateCompositeKey(chiMucDaXuLyTheoSanPham, []string{owner, attributes[0], attributes[1]})
+			if err != nil {
+				return "", fmt.Errorf("lỗi tạo key chỉ mục: %s", err)
+			}
+			daXuLy, err := Exist(ctx, keyDaXuLy)
+			if err != nil {
+				return "", err
+			}
+			if daXuLy == nil {
+				continue
+			}
+		}
+
+		queryResult, err := ctx.GetStub().GetState(keySanPham)
+		if err != nil {
+			return "", fmt.Errorf("lỗi truy vấn sản phẩm: %s", err)
+		}
+		if queryResult == nil {
+			continue
+		}
+		var product Data
+		if err := json.Unmarshal(queryResult, &product); err != nil {
+			return "", fmt.Errorf("lỗi phân tích sản phẩm: %s", err)
+		}
+		banGhi := BanGhiTimKiem{Key: keySanPham, Value: queryResult}
+		for _, truong := range truongTimKiem {
+			if !cacTruong[truong.ten] {
+				continue
+			}
+			if diem := diemKhop(danhSachTu, truong.lay(&product)); diem > banGhi.Diem {
+				banGhi.Diem = diem
+				banGhi.TruongKhop = truong.ten
+			}
+		}
+		if banGhi.TruongKhop == "" || banGhi.Diem < cauHinh.DiemToiThieu {
+			continue
+		}
+		danhSach = append(danhSach, banGhi)
+	}
+	sort.Slice(danhSach, func(i, j int) bool {
+		if danhSach[i].Diem != danhSach[j].Diem {
+			return danhSach[i].Diem > danhSach[j].Diem
+		}
+		if danhSach[i].TruongKhop != danhSach[j].TruongKhop {
+			return thuTuTruong[danhSach[i].TruongKhop] < thuTuTruong[danhSach[j].TruongKhop]
+		}
+		return danhSach[i].Key < danhSach[j].Key
+	})
+
+	ketQua := KetQuaTimKiem{DanhSach: []BanGhiTimKiem{}, CheDo: CheDoChiMucTimKiem}
+	ketThuc := batDau + int(pageSize)
+	if ketThuc > len(danhSach) {
+		ketThuc = len(danhSach)
+	}
+	if batDau < ketThuc {
+		ketQua.DanhSach = danhSach[batDau:ketThuc]
+	}
+	if ketThuc < len(danhSach) {
+		ketQua.Bookmark = strconv.Itoa(ketThuc)
+	}
+	ketQua.FetchedRecordsCount = int32(len(ketQua.DanhSach))
+
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// RebuildSearchIndex re-indexes one page of products of a manufacturer after an upgrade.
+// Page the namespace with QueryByAuthor and submit the IDs of each page here: Fabric rejects writes after a
+// paginated query and range scans cannot resume inside a composite key namespace, so a scan here would
+// re-read every earlier page on each call. Each record is read back from the ledger, so the IDs only pick the page.
+func (s *SmartContract) RebuildSearchIndex(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data TaoChiMucTimKiem
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NhaSanXuat == "" {
+		return "", fmt.Errorf("thiếu nhà sản xuất")
+	}
+	if len(data.DanhSachID) == 0 {
+		return "", fmt.Errorf("danh sách sản phẩm rỗng")
+	}
+	if len(data.DanhSachID) > kichThuocTrangToiDa {
+		return "", fmt.Errorf("kích thước trang tối đa là %d", kichThuocTrangToiDa)
+	}
+
+	ketQua := KetQuaTaoChiMuc{NhaSanXuat: data.NhaSanXuat}
+	for _, id := range data.DanhSachID {
+		keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, id})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+		}
+		product, err := getSanPham(ctx, keySanPham)
+		if err != nil {
+			return "", err
+		}
+		// Sản phẩm đã bị hủy giữa lúc đọc trang và lúc gửi giao dịch thì bỏ qua
+		if product == nil {
+			continue
+		}
+		doi, err := capNhatChiMucTimKiem(ctx, keySanPham, product.NhaSanXuat, product.ID, product)
+		if err != nil {
+			return "", err
+		}
+		if doi {
+			ketQua.SoSanPham++
+		}
+	}
+
+	if err := phatSuKien(ctx, SuKienTaoChiMucTimKiem, ketQua); err != nil {
+		return "", err
+	}
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// SetSearchConfig stores the thresholds SearchSanPham applies.
+// NguongNGram is the share of a keyword word's n-grams a field must contain; DiemToiThieu is the lowest score kept.
+func (s *SmartContract) SetSearchConfig(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data CauHinhTimKiem
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NguongNGram <= 0 || data.NguongNGram > 1 {
+		return "", fmt.Errorf("ngưỡng n-gram phải trong khoảng (0, 1]: %v", data.NguongNGram)
+	}
+	if data.DiemToiThieu < 0 || data.DiemToiThieu > 1 {
+		return "", fmt.Errorf("điểm tối thiểu phải trong khoảng [0, 1]: %v", data.DiemToiThieu)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	cauHinh := CauHinhTimKiem{
+		NguongNGram:  data.NguongNGram,
+		DiemToiThieu: data.DiemToiThieu,
+		NguoiCapNhat: owner,
+		ThoiGian:     txTime.Format(time.RFC3339),
+		TxID:         ctx.GetStub().GetTxID(),
+	}
+	asBytes, err := json.Marshal(cauHinh)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyCauHinhTimKiem, asBytes); err != nil {
+		return "", fmt.Errorf("không thể lưu cấu hình tìm kiếm: %s", err)
+	}
+	if err := phatSuKien(ctx, SuKienCauHinhTimKiem, cauHinh); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// GetSearchConfig returns the thresholds in force, the defaults when none were stored
+func (s *SmartContract) GetSearchConfig(ctx contractapi.TransactionContextInterface) (string, error) {
+	cauHinh, err := getCauHinhTimKiem(ctx)
+	if err != nil {
+		return "", err
+	}
+	asBytes, err := json.Marshal(cauHinh)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
@@ -2,16 +2,12 @@ package chaincode
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
-	"github.com/antzucaro/matchr"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
@@ -22,52 +18,74 @@ type SmartContract struct {
 
 // Data struct format
 type Data struct {
-	ID                 string   `json:"ID"`
-	TenSanPham         string   `json:"TenSanPham"`
-	NhaSanXuat         string   `json:"NhaSanXuat"`
-	ThoiGian           string   `json:"ThoiGian"`
-	DiaDiem            string   `json:"DiaDiem"`
-	ToaDo              string   `json:"ToaDo"`
-	MoTa               string   `json:"MoTa"`
-	TrangThai          string   `json:"TrangThai"`
-	ThucHien           string   `json:"ThucHien"`
-	DanhSachChuyenGiao []string `json:"DanhSachChuyenGiao"`
-	ChuyenGiaoMoiNhat  string   `json:"ChuyenGiaoMoiNhat"`
-	DanhSachFormID     []string `json:"DanhSachFormID"`
-	FormIDMoiNhat      string   `json:"FormIDMoiNhat"`
-	MaDongGoiMoiNhat   string   `json:"MaDongGoiMoiNhat"`
-	DanhSachMaDongGoi  []string `json:"DanhSachMaDongGoi"`
-	HoanThanhDongGoi   bool     `json:"HoanThanhDongGoi"`
-	HashValueOffchain  string   `json:"HashValueOffchain"`
-	HashValue          string   `json:"HashValue"`
-	HashPb             string   `json:"HashPb"`
-	SoLuong            int      `json:"SoLuong"`
-	DonViDoSoLuong     string   `json:"DonViDoSoLuong"`
-	HSD                string   `json:"HSD"`
+	ID                   string          `json:"ID"`
+	TenSanPham           string          `json:"TenSanPham"`
+	NhaSanXuat           string          `json:"NhaSanXuat"`
+	ThoiGian             string          `json:"ThoiGian"`
+	DiaDiem              string          `json:"DiaDiem"`
+	ToaDo                string          `json:"ToaDo"`
+	MoTa                 string          `json:"MoTa"`
+	TrangThai            string          `json:"TrangThai"`
+	ThucHien             string          `json:"ThucHien"`
+	ChuThe               string          `json:"ChuThe"`
+	DaiDien              string          `json:"DaiDien"`
+	DanhSachChuyenGiao   []string        `json:"DanhSachChuyenGiao"`
+	ChuyenGiaoMoiNhat    string          `json:"ChuyenGiaoMoiNhat"`
+	ThoiDiemNhan         string          `json:"ThoiDiemNhan"`
+	DanhSachFormID       []string        `json:"DanhSachFormID"`
+	FormIDMoiNhat        string          `json:"FormIDMoiNhat"`
+	MaDongGoiMoiNhat     string          `json:"MaDongGoiMoiNhat"`
+	DanhSachMaDongGoi    []string        `json:"DanhSachMaDongGoi"`
+	MerkleRootMaDongGoi  string          `json:"MerkleRootMaDongGoi"`
+	HoanThanhDongGoi     bool            `json:"HoanThanhDongGoi"`
+	HashValueOffchain    string          `json:"HashValueOffchain"`
+	HashValue            string          `json:"HashValue"`
+	HashPb               string          `json:"HashPb"`
+	HashDauVao           string          `json:"HashDauVao"`
+	HashVersion          int             `json:"HashVersion"`
+	SoLuong              int             `json:"SoLuong"`
+	DonViDoSoLuong       string          `json:"DonViDoSoLuong"`
+	HSD                  string          `json:"HSD"`
+	ThuHoi               *ThongTinThuHoi `json:"ThuHoi"`
+	HetHan               bool            `json:"HetHan"`
+	DanhSachSanPhamNguon []string        `json:"DanhSachSanPhamNguon"`
+	DanhSachSanPhamCon   []string        `json:"DanhSachSanPhamCon"`
 }
 
 // Document struct
 type Document struct {
-	Key        string `json:"Key"`
-	Value      string `json:"Value"`
-	ID         string `json:"ID"`
-	NhaSanXuat string `json:"NhaSanXuat"`
+	Key           string   `json:"Key"`
+	Value         string   `json:"Value"`
+	ID            string   `json:"ID"`
+	NhaSanXuat    string   `json:"NhaSanXuat"`
+	CapDongGoi    string   `json:"CapDongGoi"`
+	MaCha         string   `json:"MaCha"`
+	DanhSachMaCon []string `json:"DanhSachMaCon"`
+	ThuHoi        bool     `json:"ThuHoi"`
+	TrangThai     string   `json:"TrangThai"`
+	LyDo          string   `json:"LyDo"`
+	UUIDGiaoDich  string   `json:"UUIDGiaoDich"`
+	ThoiGian      string   `json:"ThoiGian"`
+	ThucHien      string   `json:"ThucHien"`
+	TxID          string   `json:"TxID"`
 }
 
 // TheoDoiDoanhThu struct
 type TheoDoiDoanhThu struct {
-	TenSanPham        string   `json:"TenSanPham"`
-	ID                string   `json:"ID"`
-	NhaSanXuat        string   `json:"NhaSanXuat"`
-	ThoiGian          string   `json:"ThoiGian"`
-	DanhSachMaDongGoi []string `json:"DanhSachMaDongGoi"`
-	SoLuong           int      `json:"SoLuong"`
-	DonViDoSoLuong    string   `json:"DonViDoSoLuong"`
-	HSD               string   `json:"HSD"`
-	UUID              string   `json:"UUID"`
+	TenSanPham        string          `json:"TenSanPham"`
+	ID                string          `json:"ID"`
+	NhaSanXuat        string          `json:"NhaSanXuat"`
+	ThoiGian          string          `json:"ThoiGian"`
+	DanhSachMaDongGoi []string        `json:"DanhSachMaDongGoi"`
+	SoLuong           int             `json:"SoLuong"`
+	DonViDoSoLuong    string          `json:"DonViDoSoLuong"`
+	HSD               string          `json:"HSD"`
+	UUID              string          `json:"UUID"`
+	ThuHoi            *ThongTinThuHoi `json:"ThuHoi"`
+	HetHan            bool            `json:"HetHan"`
 }
 
-// DanhSachSanPham struct
+// DanhSachSanPham is the per-owner product array written before the owner indexes; only the migrations read it
 type DanhSachSanPham struct {
 	Username   string   `json:"Username"`
 	SanPhamMoi string   `json:"SanPhamMoi"`
@@ -87,14 +105,6 @@ type DanhSachSanPhamKemPageIndexVaPageSize struct {
 	PageSize  string `json:"PageSize"`
 }
 
-// SearchSanPham struct
-type SearchSanPham struct {
-	Keyword string `json:"Keyword"`
-}
-
-var SOURCE_CHARACTERS, LL_LENGTH = stringToRune(`ÀÁÂÃÈÉÊÌÍÒÓÔÕÙÚÝàáâãèéêìíòóôõùúýĂăĐđĨĩŨũƠơƯưẠạẢảẤấẦầẨẩẪẫẬậẮắẰằẲẳẴẵẶặẸẹẺẻẼẽẾếỀềỂểỄễỆệỈỉỊịỌọỎỏỐốỒồỔổỖỗỘộỚớỜờỞởỠỡỢợỤụỦủỨứỪừỬửỮữỰự`)
-var DESTINATION_CHARACTERS, _ = stringToRune(`AAAAEEEIIOOOOUUYaaaaeeeiioooouuyAaDdIiUuOoUuAaAaAaAaAaAaAaAaAaAaAaAaEeEeEeEeEeEeEeEeIiIiOoOoOoOoOoOoOoOoOoOoOoOoUuUuUuUuUuUuUu`)
-
 // Exist checks if a key exists in the ledger
 func Exist(ctx contractapi.TransactionContextInterface, key string) ([]byte, error) {
 	exist, err := ctx.GetStub().GetState(key)
@@ -104,55 +114,95 @@ func Exist(ctx contractapi.TransactionContextInterface, key string) ([]byte, err
 	return exist, nil
 }
 
+// getTxTime returns the transaction timestamp set by the submitting client
+func getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("không thể lấy thời gian giao dịch: %s", err)
+	}
+	return ts.AsTime().UTC(), nil
+}
+
 // Init initializes the chaincode
 func (s *SmartContract) Init(ctx contractapi.TransactionContextInterface) error {
 	return nil
 }
 
-// getUsernameFromCertificate extracts username from certificate ID
-func getUsernameFromCertificate(certID string) string {
-	// Certificate ID format: "x509::CN=username,OU=org1+OU=client+OU=department1::CN=fabric-ca-server,OU=Fabric,O=Hyperledger,ST=North Carolina,C=US"
-	// Extract username from CN=username part
-	if strings.Contains(certID, "CN=") {
-		parts := strings.Split(certID, ",")
-		for _, part := range parts {
-			if strings.HasPrefix(part, "CN=") {
-				username := strings.TrimPrefix(part, "CN=")
-				// Remove any additional parts after the first CN=
-				if strings.Contains(username, ",") {
-					username = strings.Split(username, ",")[0]
-				}
-				return username
-			}
-		}
+// getCallerIdentity returns the caller as "<MSP ID>::<certificate CN>", so equal usernames in different orgs stay apart
+func getCallerIdentity(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("không thể lấy MSP ID: %s", err)
 	}
-	return certID // fallback to original ID if parsing fails
+	cert, err := ctx.GetClientIdentity().GetX509Certificate()
+	if err != nil {
+		return "", fmt.Errorf("không thể đọc chứng chỉ người dùng: %s", err)
+	}
+	if cert == nil || cert.Subject.CommonName == "" {
+		return "", fmt.Errorf("chứng chỉ người dùng không có CN")
+	}
+	return taoDanhTinh(mspID, cert.Subject.CommonName), nil
+}
+
+// nguoiTao returns the identity that created a product. Create always starts DanhSachChuyenGiao with the
+// caller, and derived lots copy the list of their source, so the first entry is never client-supplied.
+func nguoiTao(d *Data) string {
+	if len(d.DanhSachChuyenGiao) == 0 {
+		return ""
+	}
+	return d.DanhSachChuyenGiao[0]
+}
+
+// taoDanhTinh builds the MSP-qualified identity stored in owner fields and indexes
+func taoDanhTinh(mspID string, cn string) string {
+	return mspID + "::" + cn
 }
 
 // Create creates a new product record
 func (s *SmartContract) Create(ctx contractapi.TransactionContextInterface, params string) (string, error) {
-	certID, err := ctx.GetClientIdentity().GetID()
+	owner, err := getCallerIdentity(ctx)
 	if err != nil {
-		return "", fmt.Errorf("không thể lấy ID người dùng: %s", err)
+		return "", err
 	}
-	owner := getUsernameFromCertificate(certID)
 
 	var data Data
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return "", fmt.Errorf("lỗi phân tích params: %s", err)
 	}
+	if err := kiemTraNhaSanXuat(ctx, data.NhaSanXuat); err != nil {
+		return "", err
+	}
+	if err := kiemTraThanhVienHoatDong(ctx, owner); err != nil {
+		return "", err
+	}
+	hashOffchain, err := kiemTraMinhChung(ctx, owner, data.NhaSanXuat, data.ID, data.FormIDMoiNhat, data.HashValueOffchain)
+	if err != nil {
+		return "", err
+	}
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	// Bổ sung các giá trị mặc định
-	data.ThucHien = data.NhaSanXuat
+	// Bổ sung các giá trị mặc định; ThoiGian lấy theo thời điểm giao dịch, không theo client
+	data.ThoiGian = txTime.Format(time.RFC3339)
+	data.ThucHien = owner
+	data.ChuThe = owner
+	data.DaiDien = ""
 	data.ChuyenGiaoMoiNhat = owner
-	data.DanhSachChuyenGiao = append(data.DanhSachChuyenGiao, owner)
-	data.DanhSachFormID = append(data.DanhSachFormID, data.FormIDMoiNhat)
+	data.DanhSachChuyenGiao = []string{owner}
+	data.DanhSachFormID = []string{data.FormIDMoiNhat}
+	data.HashValueOffchain = hashOffchain
 	data.HashPb = ""
 	data.MaDongGoiMoiNhat = ""
 
-	// Tính hash
-	hashv := sha256.Sum256([]byte(data.ID + data.TenSanPham + data.NhaSanXuat + data.ThoiGian + data.DiaDiem + data.ToaDo + data.TrangThai + data.MaDongGoiMoiNhat + data.HashPb + data.HashValue))
-	data.HashValue = hex.EncodeToString(hashv[:])
+	data.ThuHoi = nil
+	data.HetHan = false
+	data.DanhSachSanPhamNguon = nil
+	data.DanhSachSanPhamCon = nil
+
+	// Tính hash; HashValue do client gửi không còn là đầu vào của hash
+	data.HashValue = computeHashValue(&data, "")
 
 	// Key sản phẩm
 	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
@@ -167,6 +217,13 @@ func (s *SmartContract) Create(ctx contractapi.TransactionContextInterface, para
 	if exist != nil {
 		return "", fmt.Errorf("bản ghi đã tồn tại")
 	}
+	if err := kiemTraChuaBiHuy(ctx, data.NhaSanXuat, data.ID); err != nil {
+		return "", err
+	}
+
+	if err := ghiNhanNguoiGiu(ctx, keySanPham, &data); err != nil {
+		return "", err
+	}
 
 	// Lưu sản phẩm
 	productBytes, err := json.Marshal(data)
@@ -176,56 +233,26 @@ func (s *SmartContract) Create(ctx contractapi.TransactionContextInterface, para
 	if err := ctx.GetStub().PutState(keySanPham, productBytes); err != nil {
 		return "", fmt.Errorf("không thể tạo bản ghi: %s", err)
 	}
-
-	// Cập nhật danh sách sản phẩm
-	keyDanhSach, err := ctx.GetStub().CreateCompositeKey(owner, []string{owner, "danhSachSanPham"})
-	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
-	}
-
-	var danhSachCuaUser DanhSachSanPham
-	existDanhSach, err := Exist(ctx, keyDanhSach)
-	if err != nil {
+	if _, err := capNhatChiMucTimKiem(ctx, keySanPham, data.NhaSanXuat, data.ID, &data); err != nil {
 		return "", err
 	}
 
-	if existDanhSach != nil {
-		if err := json.Unmarshal(existDanhSach, &danhSachCuaUser); err != nil {
-			return "", fmt.Errorf("lỗi phân tích danh sách: %s", err)
-		}
-		danhSachCuaUser.SanPhamMoi = keySanPham
-		danhSachCuaUser.DanhSach = append(danhSachCuaUser.DanhSach, keySanPham)
-	} else {
-		danhSachCuaUser = DanhSachSanPham{
-			Username:   owner,
-			SanPhamMoi: keySanPham,
-			DanhSach:   []string{keySanPham},
-		}
-	}
-
-	listBytes, err := json.Marshal(danhSachCuaUser)
-	if err != nil {
-		return "", fmt.Errorf("lỗi mã hóa danh sách: %s", err)
-	}
-	if err := ctx.GetStub().PutState(keyDanhSach, listBytes); err != nil {
-		return "", fmt.Errorf("không thể cập nhật danh sách: %s", err)
+	if err := phatSuKien(ctx, SuKienTaoSanPham, nil, &data); err != nil {
+		return "", err
 	}
-
 	return string(productBytes), nil
 }
 
-// Update updates an existing product record
+// Update updates an existing product record; a delegate passes the principal in ChuThe
 func (s *SmartContract) Update(ctx contractapi.TransactionContextInterface, params string) (string, error) {
-	certID, err := ctx.GetClientIdentity().GetID()
-	if err != nil {
-		return "", fmt.Errorf("không thể lấy ID người dùng: %s", err)
-	}
-	owner := getUsernameFromCertificate(certID)
-
 	var data Data
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return "", fmt.Errorf("lỗi phân tích params: %s", err)
 	}
+	owner, daiDien, err := xacDinhChuThe(ctx, data.ChuThe, "Update", data.NhaSanXuat, data.ID)
+	if err != nil {
+		return "", err
+	}
 
 	key, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
 	if err != nil {
@@ -248,50 +275,66 @@ func (s *SmartContract) Update(ctx contractapi.TransactionContextInterface, para
 	if owner != result.ChuyenGiaoMoiNhat {
 		return "", fmt.Errorf("không có quyền cập nhật bản ghi")
 	}
+	if result.ThuHoi != nil {
+		return "", fmt.Errorf("sản phẩm đã bị thu hồi, không thể cập nhật")
+	}
 	if result.MaDongGoiMoiNhat != "" {
 		return "", fmt.Errorf("sản phẩm đang đóng gói, không thể cập nhật")
 	}
 	if result.HoanThanhDongGoi {
 		return "", fmt.Errorf("sản phẩm đã hoàn thành đóng gói, không thể cập nhật")
 	}
+	hashOffchain, err := kiemTraMinhChung(ctx, owner, data.NhaSanXuat, data.ID, data.FormIDMoiNhat, data.HashValueOffchain)
+	if err != nil {
+		return "", err
+	}
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	result.ThoiGian = data.ThoiGian
+	result.ThoiGian = txTime.Format(time.RFC3339)
 	result.DiaDiem = data.DiaDiem
 	result.ToaDo = data.ToaDo
 	result.MoTa = data.MoTa
 	result.TrangThai = data.TrangThai
-	result.ThucHien = data.ThucHien
+	result.ThucHien = owner
+	result.ChuThe = owner
+	result.DaiDien = daiDien
 	result.FormIDMoiNhat = data.FormIDMoiNhat
 	result.DanhSachFormID = append(result.DanhSachFormID, data.FormIDMoiNhat)
-	result.HashValueOffchain = data.HashValueOffchain
+	result.HashValueOffchain = hashOffchain
 	result.HashPb = result.HashValue
 
-	hashv := sha256.Sum256([]byte(result.ID + result.TenSanPham + result.NhaSanXuat + result.ThoiGian + result.DiaDiem + result.ToaDo + result.TrangThai + result.MaDongGoiMoiNhat + result.HashPb + data.HashValue))
-	result.HashValue = hex.EncodeToString(hashv[:])
+	result.HashValue = computeHashValue(&result, "")
 
-	asBytes, err := json.Marshal(result)
+	asBytes, err := putSanPham(ctx, key, &result)
 	if err != nil {
-		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
-	}
-	if err := ctx.GetStub().PutState(key, asBytes); err != nil {
-		return "", fmt.Errorf("không thể cập nhật bản ghi: %s", err)
+		return "", err
 	}
 
+	if err := phatSuKien(ctx, SuKienCapNhatSanPham, nil, &result); err != nil {
+		return "", err
+	}
 	return string(asBytes), nil
 }
 
-// DongGoiSanPham packages a product
+// DongGoiSanPham packages a product; a delegate passes the principal in ChuThe
 func (s *SmartContract) DongGoiSanPham(ctx contractapi.TransactionContextInterface, params string) (string, error) {
-	certID, err := ctx.GetClientIdentity().GetID()
-	if err != nil {
-		return "", fmt.Errorf("không thể lấy ID người dùng: %s", err)
-	}
-	owner := getUsernameFromCertificate(certID)
-
 	var data Data
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return "", fmt.Errorf("lỗi phân tích params: %s", err)
 	}
+	owner, daiDien, err := xacDinhChuThe(ctx, data.ChuThe, "DongGoiSanPham", data.NhaSanXuat, data.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := kiemTraThanhVienNhaSanXuat(ctx, data.NhaSanXuat, owner); err != nil {
+		return "", err
+	}
+	if err := kiemTraThanhVienHoatDong(ctx, owner); err != nil {
+		return "", err
+	}
 
 	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
 	if err != nil {
@@ -317,16 +360,47 @@ func (s *SmartContract) DongGoiSanPham(ctx contractapi.TransactionContextInterfa
 	if result.HoanThanhDongGoi {
 		return "", fmt.Errorf("sản phẩm đã hoàn thành đóng gói")
 	}
+	if result.ThuHoi != nil {
+		return "", fmt.Errorf("sản phẩm đã bị thu hồi, không thể đóng gói")
+	}
+
+	hashOffchain, err := kiemTraMinhChung(ctx, owner, data.NhaSanXuat, data.ID, data.FormIDMoiNhat, data.HashValueOffchain)
+	if err != nil {
+		return "", err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	if data.HSD != "" {
+		ngayHetHan, err := parseHSD(data.HSD)
+		if err != nil {
+			return "", err
+		}
+		data.HSD = ngayHetHan.Format(dinhDangHSD)
+		if hetHan, _ := daHetHan(data.HSD, txTime); hetHan {
+			return "", fmt.Errorf("sản phẩm đã hết hạn sử dụng: %s", data.HSD)
+		}
+	}
+
+	if len(data.DanhSachMaDongGoi) == 0 {
+		return "", fmt.Errorf("danh sách mã đóng gói rỗng")
+	}
 
+	// Mã đã bị hủy khi tháo đóng gói thì được phép dùng lại; mã trùng trong cùng yêu cầu không thấy được qua GetState nên chặn riêng
 	var keyTonTai strings.Builder
+	daThem := map[string]bool{}
 	for _, element := range data.DanhSachMaDongGoi {
-		keyMaDongGoi, err := ctx.GetStub().CreateCompositeKey(element, []string{element, "MaDongGoi"})
-		if err != nil {
-			return "", fmt.Errorf("lỗi tạo key mã đóng gói: %s", err)
+		if daThem[element] {
+			return "", fmt.Errorf("mã đóng gói bị trùng: %s", element)
 		}
-		if exist, err := Exist(ctx, keyMaDongGoi); err != nil {
+		daThem[element] = true
+		keyMaDongGoi, doc, err := getMaDongGoi(ctx, element)
+		if err != nil {
 			return "", err
-		} else if exist != nil {
+		}
+		if doc != nil && trangThaiMaDongGoi(*doc) != MaDaHuy {
 			keyTonTai.WriteString(" ")
 			keyTonTai.WriteString(keyMaDongGoi)
 		}
@@ -345,6 +419,11 @@ func (s *SmartContract) DongGoiSanPham(ctx contractapi.TransactionContextInterfa
 			Value:      keySanPham,
 			ID:         data.ID,
 			NhaSanXuat: data.NhaSanXuat,
+			CapDongGoi: CapDonVi,
+			TrangThai:  MaHoatDong,
+			ThucHien:   owner,
+			ThoiGian:   txTime.Format(time.RFC3339),
+			TxID:       ctx.GetStub().GetTxID(),
 		}
 		asBytes, err := json.Marshal(dongGoi)
 		if err != nil {
@@ -357,34 +436,28 @@ func (s *SmartContract) DongGoiSanPham(ctx contractapi.TransactionContextInterfa
 
 	result.MoTa = data.MoTa
 	result.ToaDo = data.ToaDo
-	result.ThoiGian = data.ThoiGian
+	result.ThoiGian = txTime.Format(time.RFC3339)
 	result.DiaDiem = data.DiaDiem
 	result.TrangThai = data.TrangThai
-	result.ThucHien = data.ThucHien
+	result.ThucHien = owner
+	result.ChuThe = owner
+	result.DaiDien = daiDien
 	result.FormIDMoiNhat = data.FormIDMoiNhat
 	result.DanhSachFormID = append(result.DanhSachFormID, data.FormIDMoiNhat)
 	result.MaDongGoiMoiNhat = data.DanhSachMaDongGoi[len(data.DanhSachMaDongGoi)-1]
 	result.DanhSachMaDongGoi = append(result.DanhSachMaDongGoi, data.DanhSachMaDongGoi...)
 	result.HoanThanhDongGoi = data.HoanThanhDongGoi
-	result.HashValueOffchain = data.HashValueOffchain
+	result.HashValueOffchain = hashOffchain
 	result.HashPb = result.HashValue
 	result.SoLuong = len(result.DanhSachMaDongGoi)
 	result.DonViDoSoLuong = data.DonViDoSoLuong
 	result.HSD = data.HSD
 
-	var maDongGoiCode strings.Builder
-	for _, v := range result.DanhSachMaDongGoi {
-		maDongGoiCode.WriteString(v)
-	}
-	hashv := sha256.Sum256([]byte(result.ID + result.TenSanPham + result.NhaSanXuat + result.ThoiGian + result.DiaDiem + result.ToaDo + result.TrangThai + maDongGoiCode.String() + result.HashPb + data.HashValue))
-	result.HashValue = hex.EncodeToString(hashv[:])
+	result.HashValue = computeHashValue(&result, "")
 
-	asBytes, err := json.Marshal(result)
+	asBytes, err := putSanPham(ctx, keySanPham, &result)
 	if err != nil {
-		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
-	}
-	if err := ctx.GetStub().PutState(keySanPham, asBytes); err != nil {
-		return "", fmt.Errorf("không thể cập nhật bản ghi: %s", err)
+		return "", err
 	}
 
 	if data.HoanThanhDongGoi {
@@ -411,127 +484,67 @@ func (s *SmartContract) DongGoiSanPham(ctx contractapi.TransactionContextInterfa
 		}
 	}
 
+	if err := phatSuKien(ctx, SuKienDongGoiSanPham, data.DanhSachMaDongGoi, &result); err != nil {
+		return "", err
+	}
 	return string(asBytes), nil
 }
 
-// Transfer transfers product ownership
+// Transfer is kept for existing clients. Custody now only moves through a proposal,
+// so it proposes the product to name, who takes it with AcceptTransfer.
+// A bare user name is taken to belong to the caller's MSP.
 func (s *SmartContract) Transfer(ctx contractapi.TransactionContextInterface, params string, name string) error {
-	certID, err := ctx.GetClientIdentity().GetID()
-	if err != nil {
-		return fmt.Errorf("không thể lấy ID người dùng: %s", err)
-	}
-	owner := getUsernameFromCertificate(certID)
-
-	var data Data
+	var data ChuyenGiao
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return fmt.Errorf("lỗi phân tích params: %s", err)
 	}
-
-	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
-	if err != nil {
-		return fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
-	}
-
-	queryResult, err := ctx.GetStub().GetState(keySanPham)
-	if err != nil {
-		return fmt.Errorf("lỗi truy vấn: %s", err)
-	}
-	if queryResult == nil {
-		return fmt.Errorf("sản phẩm %s không tồn tại", keySanPham)
-	}
-
-	var result Data
-	if err := json.Unmarshal(queryResult, &result); err != nil {
-		return fmt.Errorf("lỗi phân tích bản ghi: %s", err)
-	}
-
-	if result.DanhSachChuyenGiao[len(result.DanhSachChuyenGiao)-1] != data.ThucHien {
-		return fmt.Errorf("không có quyền chuyển giao")
-	}
-	if result.HoanThanhDongGoi {
-		return fmt.Errorf("sản phẩm đã hoàn thành đóng gói, không thể chuyển giao")
-	}
-	if result.MaDongGoiMoiNhat != "" {
-		return fmt.Errorf("sản phẩm đang đóng gói, không thể chuyển giao")
+	if name != "" && !strings.Contains(name, "::") {
+		mspID, err := ctx.GetClientIdentity().GetMSPID()
+		if err != nil {
+			return fmt.Errorf("không thể lấy MSP ID: %s", err)
+		}
+		name = taoDanhTinh(mspID, name)
 	}
+	data.NguoiNhan = name
 
-	result.DiaDiem = data.DiaDiem
-	result.ThoiGian = data.ThoiGian
-	result.ToaDo = data.ToaDo
-	result.MoTa = "Chuyển giao cho " + name
-	result.TrangThai = "CHUYỂN GIAO"
-	result.ThucHien = name
-	result.ChuyenGiaoMoiNhat = owner
-	result.DanhSachChuyenGiao = append(result.DanhSachChuyenGiao, owner)
-	result.FormIDMoiNhat = data.FormIDMoiNhat
-	result.DanhSachFormID = append(result.DanhSachFormID, data.FormIDMoiNhat)
-	result.HashValueOffchain = data.HashValueOffchain
-	result.HashPb = result.HashValue
-
-	hashv := sha256.Sum256([]byte(result.ID + result.TenSanPham + result.NhaSanXuat + result.ThoiGian + result.DiaDiem + result.ToaDo + result.TrangThai + result.MaDongGoiMoiNhat + result.HashPb + data.HashValue))
-	result.HashValue = hex.EncodeToString(hashv[:])
-
-	asBytes, err := json.Marshal(result)
+	asBytes, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("lỗi mã hóa JSON: %s", err)
 	}
-	if err := ctx.GetStub().PutState(keySanPham, asBytes); err != nil {
-		return fmt.Errorf("không thể cập nhật bản ghi: %s", err)
-	}
-
-	keyDanhSach, err := ctx.GetStub().CreateCompositeKey(owner, []string{owner, "danhSachSanPham"})
-	if err != nil {
-		return fmt.Errorf("lỗi tạo key danh sách: %s", err)
-	}
+	_, err = s.ProposeTransfer(ctx, string(asBytes))
+	return err
+}
 
-	existDanhSach, err := Exist(ctx, keyDanhSach)
+// ThanhToanSanPham processes product payment
+func (s *SmartContract) ThanhToanSanPham(ctx contractapi.TransactionContextInterface, params string, uuid string) error {
+	owner, err := getCallerIdentity(ctx)
 	if err != nil {
 		return err
 	}
 
-	var danhSachCuaUser DanhSachSanPham
-	if existDanhSach != nil {
-		if err := json.Unmarshal(existDanhSach, &danhSachCuaUser); err != nil {
-			return fmt.Errorf("lỗi phân tích danh sách: %s", err)
-		}
-		danhSachCuaUser.SanPhamMoi = keySanPham
-		exists := false
-		for _, a := range danhSachCuaUser.DanhSach {
-			if a == keySanPham {
-				exists = true
-				break
-			}
-		}
-		if !exists {
-			danhSachCuaUser.DanhSach = append(danhSachCuaUser.DanhSach, keySanPham)
-		}
-	} else {
-		danhSachCuaUser = DanhSachSanPham{
-			Username:   owner,
-			SanPhamMoi: keySanPham,
-			DanhSach:   []string{keySanPham},
-		}
+	var data []TheoDoiDoanhThu
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if uuid == "" {
+		return fmt.Errorf("thiếu mã giao dịch")
 	}
 
-	asBytes, err = json.Marshal(danhSachCuaUser)
+	giaoDichCu, err := getGiaoDichBan(ctx, uuid)
 	if err != nil {
-		return fmt.Errorf("lỗi mã hóa danh sách: %s", err)
+		return err
 	}
-	if err := ctx.GetStub().PutState(keyDanhSach, asBytes); err != nil {
-		return fmt.Errorf("không thể cập nhật danh sách: %s", err)
+	if giaoDichCu != nil {
+		return fmt.Errorf("mã giao dịch %s đã được sử dụng", uuid)
 	}
 
-	return nil
-}
-
-// ThanhToanSanPham processes product payment
-func (s *SmartContract) ThanhToanSanPham(ctx contractapi.TransactionContextInterface, params string, uuid string) error {
-	var data []TheoDoiDoanhThu
-	if err := json.Unmarshal([]byte(params), &data); err != nil {
-		return fmt.Errorf("lỗi phân tích params: %s", err)
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
 	}
 
 	var keyTonTai strings.Builder
+	daBan := map[string]bool{}
 	for _, element := range data {
 		keyMaDoanhThu, err := ctx.GetStub().CreateCompositeKey(element.NhaSanXuat, []string{element.NhaSanXuat, element.ID, "TheoDoiDoanhThu"})
 		if err != nil {
@@ -552,6 +565,39 @@ func (s *SmartContract) ThanhToanSanPham(ctx contractapi.TransactionContextInter
 			if result.SoLuong-element.SoLuong < 0 {
 				return fmt.Errorf("có hàng giả trong lô hàng: %s", keyMaDoanhThu)
 			}
+			if result.ThuHoi != nil {
+				return fmt.Errorf("sản phẩm đã bị thu hồi: %s", keyMaDoanhThu)
+			}
+			hetHan, err := daHetHan(result.HSD, txTime)
+			if err != nil {
+				return err
+			}
+			if hetHan || result.HetHan {
+				return fmt.Errorf("sản phẩm đã hết hạn sử dụng: %s", keyMaDoanhThu)
+			}
+			for _, maDongGoi := range element.DanhSachMaDongGoi {
+				if daBan[maDongGoi] {
+					return fmt.Errorf("mã đóng gói bị trùng: %s", maDongGoi)
+				}
+				daBan[maDongGoi] = true
+				_, doc, err := getMaDongGoi(ctx, maDongGoi)
+				if err != nil {
+					return err
+				}
+				if doc == nil {
+					return fmt.Errorf("mã đóng gói %s không tồn tại", maDongGoi)
+				}
+				// Chỉ bán được mã đơn vị của đúng dòng sản phẩm đang thanh toán
+				if capDongGoi(*doc) != CapDonVi || doc.NhaSanXuat != element.NhaSanXuat || doc.ID != element.ID {
+					return fmt.Errorf("mã đóng gói %s không thuộc sản phẩm %s", maDongGoi, element.ID)
+				}
+				if doc.ThuHoi {
+					return fmt.Errorf("mã đóng gói đã bị thu hồi: %s", maDongGoi)
+				}
+				if trangThaiMaDongGoi(*doc) != MaHoatDong {
+					return fmt.Errorf("mã đóng gói %s đang ở trạng thái %s", maDongGoi, trangThaiMaDongGoi(*doc))
+				}
+			}
 		}
 	}
 	if keyTonTai.Len() > 0 {
@@ -588,50 +634,93 @@ func (s *SmartContract) ThanhToanSanPham(ctx contractapi.TransactionContextInter
 		if err := ctx.GetStub().PutState(keyMaDoanhThu, asBytes); err != nil {
 			return fmt.Errorf("không thể cập nhật bản ghi doanh thu: %s", err)
 		}
+
+		for _, maDongGoi := range element.DanhSachMaDongGoi {
+			_, doc, err := getMaDongGoi(ctx, maDongGoi)
+			if err != nil {
+				return err
+			}
+			if doc == nil {
+				return fmt.Errorf("mã đóng gói %s không tồn tại", maDongGoi)
+			}
+			doc.UUIDGiaoDich = uuid
+			if err := chuyenTrangThaiMaDongGoi(ctx, doc, MaDaBan, "Thanh toán "+uuid, owner, txTime.Format(time.RFC3339)); err != nil {
+				return err
+			}
+		}
 	}
 
-	return nil
+	// Lưu biên nhận để đối soát và trả hàng về sau
+	giaoDich, err := ghiGiaoDichBan(ctx, uuid, owner, txTime, data)
+	if err != nil {
+		return err
+	}
+
+	danhSach := []*Data{}
+	for _, element := range data {
+		danhSach = append(danhSach, &Data{NhaSanXuat: element.NhaSanXuat, ID: element.ID})
+	}
+	return phatSuKien(ctx, SuKienBanHang, giaoDich, danhSach...)
 }
 
-// QueryDoanhThuSanPham queries product revenue
+// QueryDoanhThuSanPham queries product revenue.
+// A carton or pallet holding several products returns the revenue records of each of them as an array.
 func (s *SmartContract) QueryDoanhThuSanPham(ctx contractapi.TransactionContextInterface, params string) (string, error) {
 	var data Document
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return "", fmt.Errorf("lỗi phân tích params: %s", err)
 	}
 
-	keyMaDongGoi, err := ctx.GetStub().CreateCompositeKey(data.Key, []string{data.Key, "MaDongGoi"})
-	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key mã đóng gói: %s", err)
-	}
-
-	maDongGoiResult, err := ctx.GetStub().GetState(keyMaDongGoi)
+	_, result, err := getMaDongGoi(ctx, data.Key)
 	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn mã đóng gói: %s", err)
+		return "", err
 	}
-	if maDongGoiResult == nil {
+	if result == nil {
 		return "", fmt.Errorf("mã đóng gói không tồn tại")
 	}
 
-	var result Document
-	if err := json.Unmarshal(maDongGoiResult, &result); err != nil {
-		return "", fmt.Errorf("lỗi phân tích bản ghi mã đóng gói: %s", err)
+	if result.Value != "" {
+		theoDoi, err := getTheoDoiDoanhThu(ctx, result.NhaSanXuat, result.ID)
+		if err != nil {
+			return "", err
+		}
+		if theoDoi == nil {
+			return "", fmt.Errorf("bản ghi doanh thu không tồn tại")
+		}
+		asBytes, err := json.Marshal(theoDoi)
+		if err != nil {
+			return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+		}
+		return string(asBytes), nil
 	}
 
-	keyDoanhThu, err := ctx.GetStub().CreateCompositeKey(result.NhaSanXuat, []string{result.NhaSanXuat, result.ID, "TheoDoiDoanhThu"})
+	// Mã chứa nhiều sản phẩm: lấy doanh thu của từng sản phẩm bên trong
+	cay, err := resolveCayDongGoi(ctx, data.Key)
 	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key doanh thu: %s", err)
+		return "", err
 	}
-
-	doanhThuResult, err := ctx.GetStub().GetState(keyDoanhThu)
-	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn doanh thu: %s", err)
+	danhSach := []TheoDoiDoanhThu{}
+	for _, keySanPham := range cay.DanhSachSanPham {
+		_, thuocTinh, err := ctx.GetStub().SplitCompositeKey(keySanPham)
+		if err != nil || len(thuocTinh) != 2 {
+			return "", fmt.Errorf("key sản phẩm không hợp lệ: %s", keySanPham)
+		}
+		theoDoi, err := getTheoDoiDoanhThu(ctx, thuocTinh[0], thuocTinh[1])
+		if err != nil {
+			return "", err
+		}
+		if theoDoi != nil {
+			danhSach = append(danhSach, *theoDoi)
+		}
 	}
-	if doanhThuResult == nil {
+	if len(danhSach) == 0 {
 		return "", fmt.Errorf("bản ghi doanh thu không tồn tại")
 	}
-
-	return string(doanhThuResult), nil
+	asBytes, err := json.Marshal(danhSach)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
 }
 
 // Query queries a product record
@@ -651,148 +740,221 @@ func (s *SmartContract) Query(ctx contractapi.TransactionContextInterface, param
 		return "", fmt.Errorf("lỗi truy vấn: %s", err)
 	}
 	if queryResult == nil {
+		biaMo, err := getBiaMo(ctx, data.NhaSanXuat, data.ID)
+		if err != nil {
+			return "", err
+		}
+		if biaMo != nil {
+			return "", fmt.Errorf("sản phẩm đã bị hủy: %s", biaMo.LyDo)
+		}
 		return "", fmt.Errorf("bản ghi không tồn tại")
 	}
 
 	return string(queryResult), nil
 }
 
-// QueryByAuthor queries products by manufacturer
+// QueryByAuthor queries products by manufacturer, one page at a time.
+// PageSize defaults to kichThuocTrangMacDinh; pass the returned Bookmark to read the next page.
 func (s *SmartContract) QueryByAuthor(ctx contractapi.TransactionContextInterface, params string) (string, error) {
-	var data Data
+	var data TrangTruyVan
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return "", fmt.Errorf("lỗi phân tích params: %s", err)
 	}
+	pageSize, err := kichThuocTrang(data.PageSize)
+	if err != nil {
+		return "", err
+	}
 
-	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat})
+	keyIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(data.NhaSanXuat, []string{data.NhaSanXuat}, pageSize, data.Bookmark)
 	if err != nil {
 		return "", fmt.Errorf("lỗi truy vấn: %s", err)
 	}
-	defer keyIterator.Close()
-
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-	first := true
-	for keyIterator.HasNext() {
-		item, err := keyIterator.Next()
-		if err != nil {
-			return "", fmt.Errorf("lỗi lặp truy vấn: %s", err)
-		}
-		if !first {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString(`{"Value":`)
-		buffer.Write(item.Value)
-		buffer.WriteString("}")
-		first = false
+	ketQua, err := docTrangKetQua(keyIterator, metadata, nil, CheDoKhongGian)
+	if err != nil {
+		return "", err
 	}
-	buffer.WriteString("]")
 
-	return buffer.String(), nil
+	asBytes, err := json.Marshal(ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
 }
 
-// QueryHistory queries product history
+// QueryHistory queries product history, followed by the history of the lots it was split or merged from.
+// Entries come newest first per key; pass the returned Bookmark to continue after the last entry of a page.
 func (s *SmartContract) QueryHistory(ctx contractapi.TransactionContextInterface, params string) (string, error) {
-	var data Data
+	var data TrangTruyVan
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return "", fmt.Errorf("lỗi phân tích params: %s", err)
 	}
+	pageSize, err := kichThuocTrang(data.PageSize)
+	if err != nil {
+		return "", err
+	}
+	conTro, err := giaiMaConTroLichSu(data.Bookmark)
+	if err != nil {
+		return "", err
+	}
 
 	key, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
 	if err != nil {
 		return "", fmt.Errorf("lỗi tạo key: %s", err)
 	}
 
+	trang := &trangLichSu{
+		conTro:   conTro,
+		pageSize: int(pageSize),
+		ketQua:   &KetQuaLichSu{DanhSach: []BanGhiLichSu{}},
+	}
+	if err := docLichSuSanPham(ctx, trang, key, map[string]bool{}); err != nil {
+		return "", err
+	}
+	if conTro != nil && !trang.quaConTro {
+		return "", fmt.Errorf("bookmark không hợp lệ: %s", data.Bookmark)
+	}
+	trang.ketQua.FetchedRecordsCount = int32(len(trang.ketQua.DanhSach))
+
+	asBytes, err := json.Marshal(trang.ketQua)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// docLichSuSanPham reads the history of a product key into the page and then walks back through its source lots.
+// Keys the bookmark has already moved past are walked for their sources only, without reading their history;
+// GetHistoryForKey cannot start mid-key, so only the history of the bookmarked key is read again up to the cursor.
+func docLichSuSanPham(ctx contractapi.TransactionContextInterface, trang *trangLichSu, key string, daDuyet map[string]bool) error {
+	if daDuyet[key] || trang.day {
+		return nil
+	}
+	daDuyet[key] = true
+
+	if trang.conTro == nil || trang.quaConTro || key == trang.conTro.Key {
+		if err := docLichSuKey(ctx, trang, key); err != nil {
+			return err
+		}
+		if trang.day {
+			return nil
+		}
+	}
+
+	current, err := getSanPham(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return nil
+	}
+	for _, keyNguon := range current.DanhSachSanPhamNguon {
+		if err := docLichSuSanPham(ctx, trang, keyNguon, daDuyet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docLichSuKey adds the history entries of one key to the page, newest first
+func docLichSuKey(ctx contractapi.TransactionContextInterface, trang *trangLichSu, key string) error {
 	queryIterator, err := ctx.GetStub().GetHistoryForKey(key)
 	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn lịch sử: %s", err)
+		return fmt.Errorf("lỗi truy vấn lịch sử: %s", err)
 	}
 	defer queryIterator.Close()
 
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-	first := true
 	for queryIterator.HasNext() {
 		item, err := queryIterator.Next()
 		if err != nil {
-			return "", fmt.Errorf("lỗi lặp truy vấn lịch sử: %s", err)
+			return fmt.Errorf("lỗi lặp truy vấn lịch sử: %s", err)
 		}
-		if !first {
-			buffer.WriteString(",")
+		if !trang.them(key, BanGhiLichSu{
+			TxId:      item.TxId,
+			Value:     giaTriLichSu(item.Value),
+			Timestamp: time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).String(),
+			IsDelete:  strconv.FormatBool(item.IsDelete),
+		}) {
+			return nil
 		}
-		buffer.WriteString(`{"TxId":"`)
-		buffer.WriteString(item.TxId)
-		buffer.WriteString(`","Value":`)
-		buffer.Write(item.Value)
-		buffer.WriteString(`,"Timestamp":"`)
-		buffer.WriteString(time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).String())
-		buffer.WriteString(`","IsDelete":"`)
-		buffer.WriteString(strconv.FormatBool(item.IsDelete))
-		buffer.WriteString(`"}`)
-		first = false
 	}
-	buffer.WriteString("]")
-
-	return buffer.String(), nil
+	return nil
 }
 
-// QueryHistoryByMaDongGoi queries product history by package code
+// QueryHistoryByMaDongGoi queries product history by package code.
+// A carton or pallet holding several products returns the history of each of them, one product after another.
 func (s *SmartContract) QueryHistoryByMaDongGoi(ctx contractapi.TransactionContextInterface, params string) (string, error) {
 	var data Document
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
 		return "", fmt.Errorf("lỗi phân tích params: %s", err)
 	}
 
-	keyMaDongGoi, err := ctx.GetStub().CreateCompositeKey(data.Key, []string{data.Key, "MaDongGoi"})
-	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key mã đóng gói: %s", err)
-	}
-
-	queryResult, err := ctx.GetStub().GetState(keyMaDongGoi)
+	keyMaDongGoi, doc, err := getMaDongGoi(ctx, data.Key)
 	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn mã đóng gói: %s", err)
+		return "", err
 	}
-	if queryResult == nil {
+	if doc == nil {
 		return "", fmt.Errorf("mã đóng gói %s không tồn tại", keyMaDongGoi)
 	}
 
-	var doc Document
-	if err := json.Unmarshal(queryResult, &doc); err != nil {
-		return "", fmt.Errorf("lỗi phân tích bản ghi mã đóng gói: %s", err)
-	}
-
-	keySanPham, err := ctx.GetStub().CreateCompositeKey(doc.NhaSanXuat, []string{doc.NhaSanXuat, doc.ID})
-	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	danhSachSanPham := []string{}
+	if doc.Value != "" {
+		keySanPham, err := ctx.GetStub().CreateCompositeKey(doc.NhaSanXuat, []string{doc.NhaSanXuat, doc.ID})
+		if err != nil {
+			return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+		}
+		danhSachSanPham = append(danhSachSanPham, keySanPham)
+	} else {
+		cay, err := resolveCayDongGoi(ctx, data.Key)
+		if err != nil {
+			return "", err
+		}
+		danhSachSanPham = cay.DanhSachSanPham
 	}
 
-	queryIterator, err := ctx.GetStub().GetHistoryForKey(keySanPham)
-	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn lịch sử: %s", err)
-	}
-	defer queryIterator.Close()
-
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
 	first := true
-	for queryIterator.HasNext() {
-		item, err := queryIterator.Next()
+	for _, keySanPham := range danhSachSanPham {
+		sanPham, err := getSanPham(ctx, keySanPham)
 		if err != nil {
-			return "", fmt.Errorf("lỗi lặp truy vấn lịch sử: %s", err)
+			return "", err
 		}
-		if !first {
-			buffer.WriteString(",")
+		if sanPham == nil {
+			sanPham = &Data{}
 		}
-		buffer.WriteString(`{"TxId":"`)
-		buffer.WriteString(item.TxId)
-		buffer.WriteString(`","Value":`)
-		buffer.Write(item.Value)
-		buffer.WriteString(`,"Timestamp":"`)
-		buffer.WriteString(time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).String())
-		buffer.WriteString(`","IsDelete":"`)
-		buffer.WriteString(strconv.FormatBool(item.IsDelete))
-		buffer.WriteString(`"}`)
-		first = false
+		// Trạng thái thu hồi hiện tại được gắn vào mọi bản ghi để trang quét QR cảnh báo người tiêu dùng
+		thuHoi, err := json.Marshal(sanPham.ThuHoi)
+		if err != nil {
+			return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+		}
+
+		queryIterator, err := ctx.GetStub().GetHistoryForKey(keySanPham)
+		if err != nil {
+			return "", fmt.Errorf("lỗi truy vấn lịch sử: %s", err)
+		}
+		for queryIterator.HasNext() {
+			item, err := queryIterator.Next()
+			if err != nil {
+				queryIterator.Close()
+				return "", fmt.Errorf("lỗi lặp truy vấn lịch sử: %s", err)
+			}
+			if !first {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString(`{"TxId":"`)
+			buffer.WriteString(item.TxId)
+			buffer.WriteString(`","Value":`)
+			buffer.Write(giaTriLichSu(item.Value))
+			buffer.WriteString(`,"Timestamp":"`)
+			buffer.WriteString(time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).String())
+			buffer.WriteString(`","IsDelete":"`)
+			buffer.WriteString(strconv.FormatBool(item.IsDelete))
+			buffer.WriteString(`","ThuHoi":`)
+			buffer.Write(thuHoi)
+			buffer.WriteString(`}`)
+			first = false
+		}
+		queryIterator.Close()
 	}
 	buffer.WriteString("]")
 
@@ -833,7 +995,7 @@ func (s *SmartContract) GetHashValue(ctx contractapi.TransactionContextInterface
 			buffer.WriteString(`{"TxId":"`)
 			buffer.WriteString(item.TxId)
 			buffer.WriteString(`","Value":`)
-			buffer.Write(item.Value)
+			buffer.Write(giaTriLichSu(item.Value))
 			buffer.WriteString(`,"Timestamp":"`)
 			buffer.WriteString(time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).String())
 			buffer.WriteString(`","IsDelete":"`)
@@ -850,51 +1012,35 @@ func (s *SmartContract) GetHashValue(ctx contractapi.TransactionContextInterface
 
 // QueryListSanPham queries the user's product list
 func (s *SmartContract) QueryListSanPham(ctx contractapi.TransactionContextInterface) (string, error) {
-	certID, err := ctx.GetClientIdentity().GetID()
-	if err != nil {
-		return "", fmt.Errorf("không thể lấy ID người dùng: %s", err)
-	}
-	owner := getUsernameFromCertificate(certID)
-
-	keyDanhSach, err := ctx.GetStub().CreateCompositeKey(owner, []string{owner, "danhSachSanPham"})
+	owner, err := getCallerIdentity(ctx)
 	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
+		return "", err
 	}
 
-	danhSachResult, err := ctx.GetStub().GetState(keyDanhSach)
+	danhSach, err := danhSachKeyTheoChiMuc(ctx, chiMucDaXuLy, owner)
 	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn danh sách: %s", err)
+		return "", err
 	}
-	if danhSachResult == nil {
+	if len(danhSach) == 0 {
 		return "", fmt.Errorf("danh sách sản phẩm không tồn tại")
 	}
 
-	var result DanhSachSanPham
-	if err := json.Unmarshal(danhSachResult, &result); err != nil {
-		return "", fmt.Errorf("lỗi phân tích danh sách: %s", err)
-	}
-
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
-	for i := len(result.DanhSach) - 1; i >= 0; i-- {
-		queryResult, err := ctx.GetStub().GetState(result.DanhSach[i])
+	buffer.WriteString(`{"SoLuong":`)
+	buffer.WriteString(strconv.Itoa(len(danhSach)))
+	buffer.WriteString("}")
+	for _, keySanPham := range danhSach {
+		queryResult, err := ctx.GetStub().GetState(keySanPham)
 		if err != nil {
 			return "", fmt.Errorf("lỗi truy vấn sản phẩm: %s", err)
 		}
 		if queryResult == nil {
 			return "", fmt.Errorf("sản phẩm không tồn tại")
 		}
-		if i == len(result.DanhSach)-1 {
-			buffer.WriteString(`{"SoLuong":`)
-			buffer.WriteString(strconv.Itoa(len(result.DanhSach)))
-			buffer.WriteString("},")
-		}
-		buffer.WriteString(`{"Value":`)
+		buffer.WriteString(`,{"Value":`)
 		buffer.Write(queryResult)
 		buffer.WriteString("}")
-		if i > 0 {
-			buffer.WriteString(",")
-		}
 	}
 	buffer.WriteString("]")
 
@@ -903,11 +1049,10 @@ func (s *SmartContract) QueryListSanPham(ctx contractapi.TransactionContextInter
 
 // QueryListSanPhamTheoPageIndexVaPageSize queries products with pagination
 func (s *SmartContract) QueryListSanPhamTheoPageIndexVaPageSize(ctx contractapi.TransactionContextInterface, params string) (string, error) {
-	certID, err := ctx.GetClientIdentity().GetID()
+	owner, err := getCallerIdentity(ctx)
 	if err != nil {
-		return "", fmt.Errorf("không thể lấy ID người dùng: %s", err)
+		return "", err
 	}
-	owner := getUsernameFromCertificate(certID)
 
 	var data DanhSachSanPhamKemPageIndexVaPageSize
 	if err := json.Unmarshal([]byte(params), &data); err != nil {
@@ -923,190 +1068,48 @@ func (s *SmartContract) QueryListSanPhamTheoPageIndexVaPageSize(ctx contractapi.
 		return "", fmt.Errorf("lỗi phân tích pageIndex: %s", err)
 	}
 
-	keyDanhSach, err := ctx.GetStub().CreateCompositeKey(owner, []string{owner, "danhSachSanPham"})
-	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
-	}
-
-	danhSachResult, err := ctx.GetStub().GetState(keyDanhSach)
+	danhSach, err := danhSachKeyTheoChiMuc(ctx, chiMucDaXuLy, owner)
 	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn danh sách: %s", err)
+		return "", err
 	}
-	if danhSachResult == nil {
+	if len(danhSach) == 0 {
 		return "", fmt.Errorf("danh sách sản phẩm không tồn tại")
 	}
 
-	var result DanhSachSanPham
-	if err := json.Unmarshal(danhSachResult, &result); err != nil {
-		return "", fmt.Errorf("lỗi phân tích danh sách: %s", err)
-	}
-
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
 	buffer.WriteString(`{"SoLuong":`)
-	buffer.WriteString(strconv.Itoa(len(result.DanhSach)))
-	buffer.WriteString("},")
+	buffer.WriteString(strconv.Itoa(len(danhSach)))
+	buffer.WriteString("}")
 
-	endIndex := len(result.DanhSach) - pageSize*(pageIndex-1) - 1
-	startIndex := endIndex - pageSize + 1
+	// Chỉ mục đã sắp xếp mới nhất trước nên trang 1 bắt đầu từ phần tử đầu
+	startIndex := pageSize * (pageIndex - 1)
 	if startIndex < 0 {
 		startIndex = 0
 	}
+	endIndex := startIndex + pageSize
+	if endIndex > len(danhSach) {
+		endIndex = len(danhSach)
+	}
 
-	for i := endIndex; i >= startIndex && i < len(result.DanhSach); i-- {
-		queryResult, err := ctx.GetStub().GetState(result.DanhSach[i])
+	for i := startIndex; i < endIndex; i++ {
+		queryResult, err := ctx.GetStub().GetState(danhSach[i])
 		if err != nil {
 			return "", fmt.Errorf("lỗi truy vấn sản phẩm: %s", err)
 		}
 		if queryResult == nil {
 			return "", fmt.Errorf("sản phẩm không tồn tại")
 		}
-		buffer.WriteString(`{"Value":`)
+		buffer.WriteString(`,{"Value":`)
 		buffer.Write(queryResult)
 		buffer.WriteString("}")
-		if i > startIndex {
-			buffer.WriteString(",")
-		}
 	}
 	buffer.WriteString("]")
 
 	return buffer.String(), nil
 }
 
-// stringToRune converts string to rune array
-func stringToRune(s string) ([]string, int) {
-	ll := utf8.RuneCountInString(s)
-	texts := make([]string, 0, ll)
-	for _, runeValue := range s {
-		texts = append(texts, string(runeValue))
-	}
-	return texts, ll
-}
-
-// binarySearch performs binary search on sorted string slice
-func binarySearch(sortedArray []string, key string, low, high int) int {
-	if high < low {
-		return -1
-	}
-	middle := (low + high) / 2
-	if key == sortedArray[middle] {
-		return middle
-	}
-	if key < sortedArray[middle] {
-		return binarySearch(sortedArray, key, low, middle-1)
-	}
-	return binarySearch(sortedArray, key, middle+1, high)
-}
-
-// removeAccentChar removes accent from a character
-func removeAccentChar(ch string) string {
-	index := binarySearch(SOURCE_CHARACTERS, ch, 0, LL_LENGTH)
-	if index >= 0 {
-		return DESTINATION_CHARACTERS[index]
-	}
-	return ch
-}
-
-// removeAccent removes accents from a string
-func removeAccent(s string) string {
-	var buffer strings.Builder
-	for _, runeValue := range s {
-		buffer.WriteString(removeAccentChar(string(runeValue)))
-	}
-	return buffer.String()
-}
-
-// SearchSanPham searches for products by keyword
-func (s *SmartContract) SearchSanPham(ctx contractapi.TransactionContextInterface, params string) (string, error) {
-	certID, err := ctx.GetClientIdentity().GetID()
-	if err != nil {
-		return "", fmt.Errorf("không thể lấy ID người dùng: %s", err)
-	}
-	owner := getUsernameFromCertificate(certID)
-
-	var data SearchSanPham
-	if err := json.Unmarshal([]byte(params), &data); err != nil {
-		return "", fmt.Errorf("lỗi phân tích params: %s", err)
-	}
-
-	keyword := removeAccent(data.Keyword)
-	keyword = strings.ReplaceAll(keyword, " ", "")
-
-	keyDanhSach, err := ctx.GetStub().CreateCompositeKey(owner, []string{owner, "danhSachSanPham"})
-	if err != nil {
-		return "", fmt.Errorf("lỗi tạo key danh sách: %s", err)
-	}
-
-	danhSachResult, err := ctx.GetStub().GetState(keyDanhSach)
-	if err != nil {
-		return "", fmt.Errorf("lỗi truy vấn danh sách: %s", err)
-	}
-	if danhSachResult == nil {
-		return "", fmt.Errorf("danh sách sản phẩm không tồn tại")
-	}
-
-	var result DanhSachSanPham
-	if err := json.Unmarshal(danhSachResult, &result); err != nil {
-		return "", fmt.Errorf("lỗi phân tích danh sách: %s", err)
-	}
-
-	var buffer bytes.Buffer
-	count := 0
-	for i := len(result.DanhSach) - 1; i >= 0; i-- {
-		queryResult, err := ctx.GetStub().GetState(result.DanhSach[i])
-		if err != nil {
-			return "", fmt.Errorf("lỗi truy vấn sản phẩm: %s", err)
-		}
-		if queryResult == nil {
-			return "", fmt.Errorf("sản phẩm không tồn tại")
-		}
-
-		var queryItem Data
-		if err := json.Unmarshal(queryResult, &queryItem); err != nil {
-			return "", fmt.Errorf("lỗi phân tích sản phẩm: %s", err)
-		}
-
-		tenSanPhamKhongDau := removeAccent(queryItem.TenSanPham)
-		tenSanPhamKhongDau = strings.ReplaceAll(tenSanPhamKhongDau, " ", "")
-		if score := matchr.JaroWinkler(keyword, tenSanPhamKhongDau, true); score >= 0.6 {
-			if count > 0 {
-				buffer.WriteString(",")
-			}
-			buffer.WriteString(`{"Value":`)
-			buffer.Write(queryResult)
-			buffer.WriteString("}")
-			count++
-		} else {
-			tenSanPhamKhongDau = removeAccent(queryItem.TenSanPham)
-			words := strings.Split(tenSanPhamKhongDau, " ")
-			for _, word := range words {
-				if score := matchr.JaroWinkler(keyword, word, true); score >= 0.72 {
-					if count > 0 {
-						buffer.WriteString(",")
-					}
-					buffer.WriteString(`{"Value":`)
-					buffer.Write(queryResult)
-				}
-				count++
-				break
-			}
-		}
-	}
-	resultStr := buffer.String()
-	if count > 0 {
-		resultStr = fmt.Sprintf(`[{"SoLuong":%d},%s]`, count, resultStr)
-	} else {
-		resultStr = "[]"
-	}
-
-	return resultStr, nil
-}
-
-// GetID returns the client identity
+// GetID returns the MSP-qualified identity of the caller
 func (s *SmartContract) GetID(ctx contractapi.TransactionContextInterface) (string, error) {
-	owner, err := ctx.GetClientIdentity().GetID()
-	if err != nil {
-		return "", fmt.Errorf("không thể lấy ID người dùng: %s", err)
-	}
-	return owner, nil
+	return getCallerIdentity(ctx)
 }
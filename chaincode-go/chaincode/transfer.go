@@ -0,0 +1,432 @@
+package chaincode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Transfer proposal states
+const (
+	DeNghiChoXacNhan = "CHO_XAC_NHAN"
+	DeNghiChapNhan   = "DA_CHAP_NHAN"
+	DeNghiTuChoi     = "DA_TU_CHOI"
+	DeNghiDaHuy      = "DA_HUY"
+)
+
+const (
+	thoiHanDeNghiMacDinh = 72
+	thoiHanDeNghiToiDa   = 30 * 24
+)
+
+// ChuyenGiao struct
+type ChuyenGiao struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	NguoiNhan  string `json:"NguoiNhan"`
+	ThoiHanGio int    `json:"ThoiHanGio"`
+	LyDo       string `json:"LyDo"`
+}
+
+// DeNghiChuyenGiao struct
+type DeNghiChuyenGiao struct {
+	KeySanPham   string `json:"KeySanPham"`
+	NhaSanXuat   string `json:"NhaSanXuat"`
+	ID           string `json:"ID"`
+	NguoiGui     string `json:"NguoiGui"`
+	NguoiNhan    string `json:"NguoiNhan"`
+	ThoiGianGui  string `json:"ThoiGianGui"`
+	HetHanLuc    string `json:"HetHanLuc"`
+	TrangThai    string `json:"TrangThai"`
+	LyDo         string `json:"LyDo"`
+	TxIDDeNghi   string `json:"TxIDDeNghi"`
+	TxIDKetThuc  string `json:"TxIDKetThuc"`
+	ThoiGianXong string `json:"ThoiGianXong"`
+}
+
+// getDeNghiChuyenGiao reads the latest transfer proposal recorded for a product
+func getDeNghiChuyenGiao(ctx contractapi.TransactionContextInterface, nhaSanXuat string, id string) (string, *DeNghiChuyenGiao, error) {
+	keyDeNghi, err := ctx.GetStub().CreateCompositeKey("DeNghiChuyenGiao", []string{nhaSanXuat, id})
+	if err != nil {
+		return "", nil, fmt.Errorf("lỗi tạo key đề nghị chuyển giao: %s", err)
+	}
+	exist, err := Exist(ctx, keyDeNghi)
+	if err != nil {
+		return "", nil, err
+	}
+	if exist == nil {
+		return keyDeNghi, nil, nil
+	}
+	var deNghi DeNghiChuyenGiao
+	if err := json.Unmarshal(exist, &deNghi); err != nil {
+		return "", nil, fmt.Errorf("lỗi phân tích đề nghị chuyển giao: %s", err)
+	}
+	return keyDeNghi, &deNghi, nil
+}
+
+// dangChoXacNhan reports whether a proposal can still be accepted at the given time
+func dangChoXacNhan(deNghi *DeNghiChuyenGiao, now time.Time) bool {
+	if deNghi == nil || deNghi.TrangThai != DeNghiChoXacNhan {
+		return false
+	}
+	hetHan, err := time.Parse(time.RFC3339, deNghi.HetHanLuc)
+	return err == nil && now.Before(hetHan)
+}
+
+// ketThucDeNghi closes a proposal and drops it from the recipient's pending index
+func ketThucDeNghi(ctx contractapi.TransactionContextInterface, keyDeNghi string, deNghi *DeNghiChuyenGiao, trangThai string, lyDo string, now time.Time) error {
+	deNghi.TrangThai = trangThai
+	deNghi.LyDo = lyDo
+	deNghi.TxIDKetThuc = ctx.GetStub().GetTxID()
+	deNghi.ThoiGianXong = now.Format(time.RFC3339)
+
+	asBytes, err := json.Marshal(deNghi)
+	if err != nil {
+		return fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyDeNghi, asBytes); err != nil {
+		return fmt.Errorf("không thể cập nhật đề nghị chuyển giao: %s", err)
+	}
+
+	keyChoNhan, err := ctx.GetStub().CreateCompositeKey("DeNghiChoNhan", []string{deNghi.NguoiNhan, deNghi.NhaSanXuat, deNghi.ID})
+	if err != nil {
+		return fmt.Errorf("lỗi tạo key đề nghị chờ nhận: %s", err)
+	}
+	if err := ctx.GetStub().DelState(keyChoNhan); err != nil {
+		return fmt.Errorf("không thể xóa đề nghị chờ nhận: %s", err)
+	}
+	return nil
+}
+
+// ProposeTransfer offers a product held by the caller to another participant
+func (s *SmartContract) ProposeTransfer(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data ChuyenGiao
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.NguoiNhan == "" {
+		return "", fmt.Errorf("thiếu người nhận")
+	}
+	if data.NguoiNhan == owner {
+		return "", fmt.Errorf("không thể chuyển giao cho chính mình")
+	}
+	if err := kiemTraThanhVienHoatDong(ctx, data.NguoiNhan); err != nil {
+		return "", err
+	}
+	if data.ThoiHanGio == 0 {
+		data.ThoiHanGio = thoiHanDeNghiMacDinh
+	}
+	if data.ThoiHanGio < 0 || data.ThoiHanGio > thoiHanDeNghiToiDa {
+		return "", fmt.Errorf("thời hạn đề nghị không hợp lệ: %d giờ", data.ThoiHanGio)
+	}
+
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	exist, err := Exist(ctx, keySanPham)
+	if err != nil {
+		return "", err
+	}
+	if exist == nil {
+		return "", fmt.Errorf("sản phẩm %s không tồn tại", keySanPham)
+	}
+
+	var result Data
+	if err := json.Unmarshal(exist, &result); err != nil {
+		return "", fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+	}
+	if result.ChuyenGiaoMoiNhat != owner {
+		return "", fmt.Errorf("không có quyền chuyển giao")
+	}
+	if err := kiemTraCoTheChuyenGiao(&result); err != nil {
+		return "", err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	keyDeNghi, cu, err := getDeNghiChuyenGiao(ctx, data.NhaSanXuat, data.ID)
+	if err != nil {
+		return "", err
+	}
+	if dangChoXacNhan(cu, txTime) {
+		return "", fmt.Errorf("sản phẩm đang có đề nghị chuyển giao cho %s", cu.NguoiNhan)
+	}
+	if cu != nil && cu.TrangThai == DeNghiChoXacNhan {
+		// Đề nghị cũ đã quá hạn, đóng lại trước khi tạo đề nghị mới
+		if err := ketThucDeNghi(ctx, keyDeNghi, cu, DeNghiDaHuy, "quá hạn xác nhận", txTime); err != nil {
+			return "", err
+		}
+	}
+
+	deNghi := DeNghiChuyenGiao{
+		KeySanPham:  keySanPham,
+		NhaSanXuat:  data.NhaSanXuat,
+		ID:          data.ID,
+		NguoiGui:    owner,
+		NguoiNhan:   data.NguoiNhan,
+		ThoiGianGui: txTime.Format(time.RFC3339),
+		HetHanLuc:   txTime.Add(time.Duration(data.ThoiHanGio) * time.Hour).Format(time.RFC3339),
+		TrangThai:   DeNghiChoXacNhan,
+		TxIDDeNghi:  ctx.GetStub().GetTxID(),
+	}
+	asBytes, err := json.Marshal(deNghi)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyDeNghi, asBytes); err != nil {
+		return "", fmt.Errorf("không thể tạo đề nghị chuyển giao: %s", err)
+	}
+
+	keyChoNhan, err := ctx.GetStub().CreateCompositeKey("DeNghiChoNhan", []string{deNghi.NguoiNhan, deNghi.NhaSanXuat, deNghi.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key đề nghị chờ nhận: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyChoNhan, []byte(keyDeNghi)); err != nil {
+		return "", fmt.Errorf("không thể tạo đề nghị chờ nhận: %s", err)
+	}
+
+	if err := phatSuKien(ctx, SuKienDeNghiChuyenGiao, deNghi, &result); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// AcceptTransfer takes custody of a product proposed to the caller
+func (s *SmartContract) AcceptTransfer(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data Data
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	keyDeNghi, deNghi, err := getDeNghiChuyenGiao(ctx, data.NhaSanXuat, data.ID)
+	if err != nil {
+		return "", err
+	}
+	if deNghi == nil || deNghi.TrangThai != DeNghiChoXacNhan {
+		return "", fmt.Errorf("không có đề nghị chuyển giao đang chờ")
+	}
+	if deNghi.NguoiNhan != owner {
+		return "", fmt.Errorf("không có quyền nhận chuyển giao")
+	}
+	if !dangChoXacNhan(deNghi, txTime) {
+		return "", fmt.Errorf("đề nghị chuyển giao đã hết hạn lúc %s", deNghi.HetHanLuc)
+	}
+	// Người nhận có thể bị tạm ngưng sau khi đề nghị được gửi
+	if err := kiemTraThanhVienHoatDong(ctx, owner); err != nil {
+		return "", err
+	}
+
+	keySanPham := deNghi.KeySanPham
+	queryResult, err := ctx.GetStub().GetState(keySanPham)
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn: %s", err)
+	}
+	if queryResult == nil {
+		return "", fmt.Errorf("sản phẩm %s không tồn tại", keySanPham)
+	}
+
+	var result Data
+	if err := json.Unmarshal(queryResult, &result); err != nil {
+		return "", fmt.Errorf("lỗi phân tích bản ghi: %s", err)
+	}
+	if result.ChuyenGiaoMoiNhat != deNghi.NguoiGui {
+		return "", fmt.Errorf("người gửi không còn giữ sản phẩm")
+	}
+	if err := kiemTraCoTheChuyenGiao(&result); err != nil {
+		return "", err
+	}
+	hashOffchain, err := kiemTraMinhChung(ctx, owner, deNghi.NhaSanXuat, deNghi.ID, data.FormIDMoiNhat, data.HashValueOffchain)
+	if err != nil {
+		return "", err
+	}
+
+	if err := boDangGiu(ctx, &result); err != nil {
+		return "", err
+	}
+
+	result.DiaDiem = data.DiaDiem
+	result.ThoiGian = txTime.Format(time.RFC3339)
+	result.ToaDo = data.ToaDo
+	result.MoTa = "Chuyển giao cho " + owner
+	result.TrangThai = "CHUYỂN GIAO"
+	result.ThucHien = owner
+	result.ChuThe = owner
+	result.DaiDien = ""
+	result.ChuyenGiaoMoiNhat = owner
+	result.DanhSachChuyenGiao = append(result.DanhSachChuyenGiao, owner)
+	result.FormIDMoiNhat = data.FormIDMoiNhat
+	result.DanhSachFormID = append(result.DanhSachFormID, data.FormIDMoiNhat)
+	result.HashValueOffchain = hashOffchain
+	result.HashPb = result.HashValue
+	result.HashValue = computeHashValue(&result, "")
+	if err := ghiNhanNguoiGiu(ctx, keySanPham, &result); err != nil {
+		return "", err
+	}
+
+	asBytes, err := putSanPham(ctx, keySanPham, &result)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ketThucDeNghi(ctx, keyDeNghi, deNghi, DeNghiChapNhan, "", txTime); err != nil {
+		return "", err
+	}
+
+	if err := phatSuKien(ctx, SuKienChuyenGiao, deNghi, &result); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// RejectTransfer declines a transfer proposed to the caller
+func (s *SmartContract) RejectTransfer(ctx contractapi.TransactionContextInterface, params string) error {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	var data ChuyenGiao
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	keyDeNghi, deNghi, err := getDeNghiChuyenGiao(ctx, data.NhaSanXuat, data.ID)
+	if err != nil {
+		return err
+	}
+	if deNghi == nil || deNghi.TrangThai != DeNghiChoXacNhan {
+		return fmt.Errorf("không có đề nghị chuyển giao đang chờ")
+	}
+	if deNghi.NguoiNhan != owner {
+		return fmt.Errorf("không có quyền từ chối chuyển giao")
+	}
+
+	if err := ketThucDeNghi(ctx, keyDeNghi, deNghi, DeNghiTuChoi, data.LyDo, txTime); err != nil {
+		return err
+	}
+	return phatSuKien(ctx, SuKienTuChoiChuyenGiao, deNghi, &Data{NhaSanXuat: deNghi.NhaSanXuat, ID: deNghi.ID})
+}
+
+// CancelTransfer withdraws a pending transfer proposed by the caller
+func (s *SmartContract) CancelTransfer(ctx contractapi.TransactionContextInterface, params string) error {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	var data ChuyenGiao
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	keyDeNghi, deNghi, err := getDeNghiChuyenGiao(ctx, data.NhaSanXuat, data.ID)
+	if err != nil {
+		return err
+	}
+	if deNghi == nil || deNghi.TrangThai != DeNghiChoXacNhan {
+		return fmt.Errorf("không có đề nghị chuyển giao đang chờ")
+	}
+	if deNghi.NguoiGui != owner {
+		return fmt.Errorf("không có quyền hủy đề nghị chuyển giao")
+	}
+
+	if err := ketThucDeNghi(ctx, keyDeNghi, deNghi, DeNghiDaHuy, data.LyDo, txTime); err != nil {
+		return err
+	}
+	return phatSuKien(ctx, SuKienHuyChuyenGiao, deNghi, &Data{NhaSanXuat: deNghi.NhaSanXuat, ID: deNghi.ID})
+}
+
+// QueryPendingTransfers lists the transfers waiting for the caller to accept
+func (s *SmartContract) QueryPendingTransfers(ctx contractapi.TransactionContextInterface) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	keyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeNghiChoNhan", []string{owner})
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn: %s", err)
+	}
+	defer keyIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	first := true
+	for keyIterator.HasNext() {
+		item, err := keyIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn: %s", err)
+		}
+		deNghiResult, err := ctx.GetStub().GetState(string(item.Value))
+		if err != nil {
+			return "", fmt.Errorf("lỗi truy vấn đề nghị chuyển giao: %s", err)
+		}
+		if deNghiResult == nil {
+			continue
+		}
+		var deNghi DeNghiChuyenGiao
+		if err := json.Unmarshal(deNghiResult, &deNghi); err != nil {
+			return "", fmt.Errorf("lỗi phân tích đề nghị chuyển giao: %s", err)
+		}
+		if !dangChoXacNhan(&deNghi, txTime) {
+			continue
+		}
+		if !first {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(`{"Value":`)
+		buffer.Write(deNghiResult)
+		buffer.WriteString("}")
+		first = false
+	}
+	buffer.WriteString("]")
+
+	return buffer.String(), nil
+}
+
+// kiemTraCoTheChuyenGiao rejects products whose state no longer allows a change of custody
+func kiemTraCoTheChuyenGiao(result *Data) error {
+	if result.HoanThanhDongGoi {
+		return fmt.Errorf("sản phẩm đã hoàn thành đóng gói, không thể chuyển giao")
+	}
+	if result.ThuHoi != nil {
+		return fmt.Errorf("sản phẩm đã bị thu hồi, không thể chuyển giao")
+	}
+	if result.MaDongGoiMoiNhat != "" {
+		return fmt.Errorf("sản phẩm đang đóng gói, không thể chuyển giao")
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package chaincode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ThaoDongGoi struct
+type ThaoDongGoi struct {
+	NhaSanXuat        string   `json:"NhaSanXuat"`
+	ID                string   `json:"ID"`
+	DanhSachMaDongGoi []string `json:"DanhSachMaDongGoi"`
+	LyDo              string   `json:"LyDo"`
+	ChuThe            string   `json:"ChuThe"`
+}
+
+// TrangThaiMaDongGoi struct
+type TrangThaiMaDongGoi struct {
+	MaDongGoi string `json:"MaDongGoi"`
+	TrangThai string `json:"TrangThai"`
+	LyDo      string `json:"LyDo"`
+}
+
+// UnpackProduct voids codes packed by mistake before packaging is finished.
+// With no codes given every code of the product is released, which unblocks Update and transfers again.
+func (s *SmartContract) UnpackProduct(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data ThaoDongGoi
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	owner, daiDien, err := xacDinhChuThe(ctx, data.ChuThe, "UnpackProduct", data.NhaSanXuat, data.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := kiemTraThanhVienNhaSanXuat(ctx, data.NhaSanXuat, owner); err != nil {
+		return "", err
+	}
+	if data.LyDo == "" {
+		return "", fmt.Errorf("thiếu lý do tháo đóng gói")
+	}
+
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	result, err := getSanPham(ctx, keySanPham)
+	if err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", fmt.Errorf("sản phẩm không tồn tại")
+	}
+	if owner != result.ChuyenGiaoMoiNhat {
+		return "", fmt.Errorf("không có quyền cập nhật bản ghi")
+	}
+	if result.HoanThanhDongGoi {
+		return "", fmt.Errorf("sản phẩm đã hoàn thành đóng gói, không thể tháo")
+	}
+	if result.ThuHoi != nil {
+		return "", fmt.Errorf("sản phẩm đã bị thu hồi, không thể tháo đóng gói")
+	}
+	if len(result.DanhSachMaDongGoi) == 0 {
+		return "", fmt.Errorf("sản phẩm chưa được đóng gói")
+	}
+
+	danhSachThao := data.DanhSachMaDongGoi
+	if len(danhSachThao) == 0 {
+		danhSachThao = result.DanhSachMaDongGoi
+	}
+	cuaSanPham := map[string]bool{}
+	for _, element := range result.DanhSachMaDongGoi {
+		cuaSanPham[element] = true
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	thoiGian := txTime.Format(time.RFC3339)
+
+	daThao := map[string]bool{}
+	for _, element := range danhSachThao {
+		if daThao[element] {
+			return "", fmt.Errorf("mã đóng gói bị trùng: %s", element)
+		}
+		daThao[element] = true
+		if !cuaSanPham[element] {
+			return "", fmt.Errorf("mã đóng gói %s không thuộc sản phẩm", element)
+		}
+		_, doc, err := getMaDongGoi(ctx, element)
+		if err != nil {
+			return "", err
+		}
+		if doc == nil {
+			return "", fmt.Errorf("mã đóng gói %s không tồn tại", element)
+		}
+		if doc.MaCha != "" {
+			return "", fmt.Errorf("mã đóng gói %s đang thuộc mã %s, cần tách mã cha trước", element, doc.MaCha)
+		}
+		if err := chuyenTrangThaiMaDongGoi(ctx, doc, MaDaHuy, data.LyDo, owner, thoiGian); err != nil {
+			return "", err
+		}
+	}
+
+	conLai := []string{}
+	for _, element := range result.DanhSachMaDongGoi {
+		if !daThao[element] {
+			conLai = append(conLai, element)
+		}
+	}
+	result.DanhSachMaDongGoi = conLai
+	result.MaDongGoiMoiNhat = ""
+	if len(conLai) > 0 {
+		result.MaDongGoiMoiNhat = conLai[len(conLai)-1]
+	}
+	result.SoLuong = len(conLai)
+	result.MoTa = "Tháo đóng gói: " + data.LyDo
+	result.ThoiGian = thoiGian
+	result.ThucHien = owner
+	result.ChuThe = owner
+	result.DaiDien = daiDien
+	result.HashPb = result.HashValue
+	result.HashValue = computeHashValue(result, "")
+
+	asBytes, err := putSanPham(ctx, keySanPham, result)
+	if err != nil {
+		return "", err
+	}
+	if err := phatSuKien(ctx, SuKienThaoDongGoi, danhSachThao, result); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
+
+// UpdatePackagingStatus marks a code, and every code packed inside it, as damaged or destroyed
+func (s *SmartContract) UpdatePackagingStatus(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data TrangThaiMaDongGoi
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if data.TrangThai != MaHuHong && data.TrangThai != MaDaTieuHuy {
+		return "", fmt.Errorf("trạng thái không hợp lệ: %s", data.TrangThai)
+	}
+	if data.LyDo == "" {
+		return "", fmt.Errorf("thiếu lý do")
+	}
+
+	cay, err := resolveCayDongGoi(ctx, data.MaDongGoi)
+	if err != nil {
+		return "", err
+	}
+	if err := kiemTraNguoiGiuSanPham(ctx, owner, cay.DanhSachSanPham); err != nil {
+		return "", err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	thoiGian := txTime.Format(time.RFC3339)
+
+	dongGoi := cay.MaDongGoi
+	if err := chuyenTrangThaiMaDongGoi(ctx, &dongGoi, data.TrangThai, data.LyDo, owner, thoiGian); err != nil {
+		return "", err
+	}
+	for i := range cay.DanhSachMaCon {
+		con := cay.DanhSachMaCon[i]
+		if trangThaiMaDongGoi(con) == data.TrangThai {
+			continue
+		}
+		if err := chuyenTrangThaiMaDongGoi(ctx, &con, data.TrangThai, data.LyDo, owner, thoiGian); err != nil {
+			return "", err
+		}
+	}
+
+	danhSach, err := sanPhamTheoKey(ctx, cay.DanhSachSanPham)
+	if err != nil {
+		return "", err
+	}
+	if err := phatSuKien(ctx, SuKienTrangThaiMaDongGoi, data, danhSach...); err != nil {
+		return "", err
+	}
+
+	asBytes, err := json.Marshal(dongGoi)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	return string(asBytes), nil
+}
+
+// QueryPackagingCodeHistory queries every state a packaging code has been through
+func (s *SmartContract) QueryPackagingCodeHistory(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	var data Document
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+
+	keyMaDongGoi, err := ctx.GetStub().CreateCompositeKey(data.Key, []string{data.Key, "MaDongGoi"})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key mã đóng gói: %s", err)
+	}
+
+	queryIterator, err := ctx.GetStub().GetHistoryForKey(keyMaDongGoi)
+	if err != nil {
+		return "", fmt.Errorf("lỗi truy vấn lịch sử: %s", err)
+	}
+	defer queryIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	first := true
+	for queryIterator.HasNext() {
+		item, err := queryIterator.Next()
+		if err != nil {
+			return "", fmt.Errorf("lỗi lặp truy vấn lịch sử: %s", err)
+		}
+		if !first {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(`{"TxId":"`)
+		buffer.WriteString(item.TxId)
+		buffer.WriteString(`","Value":`)
+		buffer.Write(giaTriLichSu(item.Value))
+		buffer.WriteString(`,"Timestamp":"`)
+		buffer.WriteString(time.Unix(item.Timestamp.Seconds, int64(item.Timestamp.Nanos)).String())
+		buffer.WriteString(`","IsDelete":"`)
+		buffer.WriteString(strconv.FormatBool(item.IsDelete))
+		buffer.WriteString(`"}`)
+		first = false
+	}
+	buffer.WriteString("]")
+
+	return buffer.String(), nil
+}
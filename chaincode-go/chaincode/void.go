@@ -0,0 +1,165 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// HuySanPham struct
+type HuySanPham struct {
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	LyDo       string `json:"LyDo"`
+}
+
+// BiaMo struct
+type BiaMo struct {
+	KeySanPham string `json:"KeySanPham"`
+	NhaSanXuat string `json:"NhaSanXuat"`
+	ID         string `json:"ID"`
+	LyDo       string `json:"LyDo"`
+	ThucHien   string `json:"ThucHien"`
+	ThoiGian   string `json:"ThoiGian"`
+	TxID       string `json:"TxID"`
+	HashValue  string `json:"HashValue"`
+}
+
+// getBiaMo reads the tombstone left by a voided product, if any
+func getBiaMo(ctx contractapi.TransactionContextInterface, nhaSanXuat string, id string) (*BiaMo, error) {
+	keyBiaMo, err := ctx.GetStub().CreateCompositeKey("SanPhamDaHuy", []string{nhaSanXuat, id})
+	if err != nil {
+		return nil, fmt.Errorf("lỗi tạo key sản phẩm đã hủy: %s", err)
+	}
+	exist, err := Exist(ctx, keyBiaMo)
+	if err != nil {
+		return nil, err
+	}
+	if exist == nil {
+		return nil, nil
+	}
+	var biaMo BiaMo
+	if err := json.Unmarshal(exist, &biaMo); err != nil {
+		return nil, fmt.Errorf("lỗi phân tích bản ghi sản phẩm đã hủy: %s", err)
+	}
+	return &biaMo, nil
+}
+
+// kiemTraChuaBiHuy rejects IDs that belonged to a voided product
+func kiemTraChuaBiHuy(ctx contractapi.TransactionContextInterface, nhaSanXuat string, id string) error {
+	biaMo, err := getBiaMo(ctx, nhaSanXuat, id)
+	if err != nil {
+		return err
+	}
+	if biaMo != nil {
+		return fmt.Errorf("mã sản phẩm %s đã bị hủy, không thể dùng lại", id)
+	}
+	return nil
+}
+
+// giaTriLichSu returns a history value, or null for the entry written when a key was deleted
+func giaTriLichSu(value []byte) []byte {
+	if len(value) == 0 {
+		return []byte("null")
+	}
+	return value
+}
+
+// VoidProduct removes a product created by mistake and leaves a tombstone in its place.
+// Only the creator may void a product, and only before it is packaged, split or transferred.
+func (s *SmartContract) VoidProduct(ctx contractapi.TransactionContextInterface, params string) (string, error) {
+	owner, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var data HuySanPham
+	if err := json.Unmarshal([]byte(params), &data); err != nil {
+		return "", fmt.Errorf("lỗi phân tích params: %s", err)
+	}
+	if err := kiemTraNhaSanXuat(ctx, data.NhaSanXuat); err != nil {
+		return "", err
+	}
+	if data.LyDo == "" {
+		return "", fmt.Errorf("thiếu lý do hủy")
+	}
+
+	keySanPham, err := ctx.GetStub().CreateCompositeKey(data.NhaSanXuat, []string{data.NhaSanXuat, data.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm: %s", err)
+	}
+	result, err := getSanPham(ctx, keySanPham)
+	if err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", fmt.Errorf("sản phẩm không tồn tại")
+	}
+
+	if nguoiTao(result) != owner || result.ChuyenGiaoMoiNhat != owner {
+		return "", fmt.Errorf("chỉ người tạo sản phẩm mới có quyền hủy")
+	}
+	if len(result.DanhSachChuyenGiao) > 1 {
+		return "", fmt.Errorf("sản phẩm đã được chuyển giao, không thể hủy")
+	}
+	if result.MaDongGoiMoiNhat != "" || len(result.DanhSachMaDongGoi) > 0 || result.HoanThanhDongGoi {
+		return "", fmt.Errorf("sản phẩm đã đóng gói, không thể hủy")
+	}
+	if len(result.DanhSachSanPhamNguon) > 0 || len(result.DanhSachSanPhamCon) > 0 {
+		return "", fmt.Errorf("sản phẩm đã tách hoặc gộp lô, không thể hủy")
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	_, deNghi, err := getDeNghiChuyenGiao(ctx, data.NhaSanXuat, data.ID)
+	if err != nil {
+		return "", err
+	}
+	if dangChoXacNhan(deNghi, txTime) {
+		return "", fmt.Errorf("sản phẩm đang có đề nghị chuyển giao, cần hủy đề nghị trước")
+	}
+
+	biaMo := BiaMo{
+		KeySanPham: keySanPham,
+		NhaSanXuat: data.NhaSanXuat,
+		ID:         data.ID,
+		LyDo:       data.LyDo,
+		ThucHien:   owner,
+		ThoiGian:   txTime.Format(time.RFC3339),
+		TxID:       ctx.GetStub().GetTxID(),
+		HashValue:  result.HashValue,
+	}
+	keyBiaMo, err := ctx.GetStub().CreateCompositeKey("SanPhamDaHuy", []string{data.NhaSanXuat, data.ID})
+	if err != nil {
+		return "", fmt.Errorf("lỗi tạo key sản phẩm đã hủy: %s", err)
+	}
+	asBytes, err := json.Marshal(biaMo)
+	if err != nil {
+		return "", fmt.Errorf("lỗi mã hóa JSON: %s", err)
+	}
+	if err := ctx.GetStub().PutState(keyBiaMo, asBytes); err != nil {
+		return "", fmt.Errorf("không thể tạo bản ghi sản phẩm đã hủy: %s", err)
+	}
+
+	if err := ctx.GetStub().DelState(keySanPham); err != nil {
+		return "", fmt.Errorf("không thể xóa sản phẩm: %s", err)
+	}
+	if err := boDangGiu(ctx, result); err != nil {
+		return "", err
+	}
+	if err := xoaDaXuLy(ctx, owner, data.NhaSanXuat, data.ID); err != nil {
+		return "", err
+	}
+	if _, err := capNhatChiMucTimKiem(ctx, keySanPham, data.NhaSanXuat, data.ID, nil); err != nil {
+		return "", err
+	}
+
+	if err := phatSuKien(ctx, SuKienHuySanPham, biaMo, result); err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
@@ -80,7 +80,7 @@ function deploy_chaincode() {
   local cc_endorsement_policy=${3:-"OR('Org1MSP.peer','Org2MSP.peer')"} 
 
   prepare_chaincode_image ${cc_folder} ${cc_name}
-  package_chaincode       ${cc_name} ${cc_label} ${cc_package}
+  package_chaincode       ${cc_name} ${cc_label} ${cc_package} ${cc_folder}
 
   if [ "${CHAINCODE_BUILDER}" == "ccaas" ]; then
     set_chaincode_id      ${cc_package}
@@ -217,6 +217,7 @@ function package_k8s_chaincode() {
   local cc_name=$1
   local cc_label=$2
   local cc_archive=$3
+  local cc_source=$4
 
   local cc_folder=$(dirname $cc_archive)
   local archive_name=$(basename $cc_archive)
@@ -242,10 +243,17 @@ IMAGEJSON-EOF
 }
 METADATAJSON-EOF
 
-  tar -C ${cc_folder} -zcf ${cc_folder}/code.tar.gz image.json
+  # CouchDB index definitions must travel in code.tar.gz so the peer can build them on install
+  local cc_files="image.json"
+  if [ -n "${cc_source}" ] && [ -d "${cc_source}/META-INF" ]; then
+    cp -R ${cc_source}/META-INF ${cc_folder}/
+    cc_files="${cc_files} META-INF"
+  fi
+
+  tar -C ${cc_folder} -zcf ${cc_folder}/code.tar.gz ${cc_files}
   tar -C ${cc_folder} -zcf ${cc_archive} code.tar.gz metadata.json
 
-  rm ${cc_folder}/code.tar.gz
+  rm -rf ${cc_folder}/code.tar.gz ${cc_folder}/META-INF
 
   pop_fn
 }
@@ -254,6 +262,7 @@ function package_ccaas_chaincode() {
   local cc_name=$1
   local cc_label=$2
   local cc_archive=$3
+  local cc_source=$4
 
   local cc_folder=$(dirname $cc_archive)
   local archive_name=$(basename $cc_archive)
@@ -280,10 +289,17 @@ EOF
 }
 EOF
 
-  tar -C ${cc_folder} -zcf ${cc_folder}/code.tar.gz connection.json
+  # CouchDB index definitions must travel in code.tar.gz so the peer can build them on install
+  local cc_files="connection.json"
+  if [ -n "${cc_source}" ] && [ -d "${cc_source}/META-INF" ]; then
+    cp -R ${cc_source}/META-INF ${cc_folder}/
+    cc_files="${cc_files} META-INF"
+  fi
+
+  tar -C ${cc_folder} -zcf ${cc_folder}/code.tar.gz ${cc_files}
   tar -C ${cc_folder} -zcf ${cc_archive} code.tar.gz metadata.json
 
-  rm ${cc_folder}/code.tar.gz
+  rm -rf ${cc_folder}/code.tar.gz ${cc_folder}/META-INF
 
   pop_fn
 }